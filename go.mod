@@ -3,6 +3,7 @@ module esm.sh
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.3
 	github.com/aws/aws-sdk-go v1.40.45
 	github.com/dgraph-io/ristretto v0.1.0
 	github.com/evanw/esbuild v0.12.24
@@ -11,4 +12,6 @@ require (
 	github.com/ije/rex v1.5.0
 	github.com/mssola/user_agent v0.5.3
 	github.com/postui/postdb v0.6.2
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 )
@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"os"
 
 	"esm.sh/server"
 )
@@ -11,5 +12,9 @@ import (
 var fs embed.FS
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		server.Migrate(os.Args[2:])
+		return
+	}
 	server.Serve(&fs)
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// admin returns the handle of the admin APIs that are under the `/_admin/` path, the
+// requests must have the `Authorization: Bearer <token>` header.
+func admin(token string) rex.Handle {
+	return func(ctx *rex.Context) interface{} {
+		pathname := ctx.Path.String()
+		if !strings.HasPrefix(pathname, "/_admin/") {
+			return nil
+		}
+		if token == "" {
+			return rex.Status(404, "not found")
+		}
+		if !checkBearerToken(ctx, token) {
+			return rex.Status(http.StatusUnauthorized, "unauthorized")
+		}
+		if ctx.R.Method != "POST" && pathname != "/_admin/builds" && pathname != "/_admin/gc" {
+			return rex.Status(http.StatusMethodNotAllowed, "method not allowed")
+		}
+
+		switch pathname {
+		case "/_admin/builds":
+			builds, err := findBuilds(parseBuildFilter(ctx))
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			return map[string]interface{}{
+				"builds": builds,
+			}
+
+		case "/_admin/purge", "/_admin/rebuild":
+			f := parseBuildFilter(ctx)
+			if f == (buildFilter{}) {
+				return rex.Status(400, "missing filter, one of `pkg`, `version`, `target` or `id` is required")
+			}
+			ret, builds, err := purgeBuilds(f)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			log.Infof("admin: purge %d builds and %d files", len(ret.Builds), len(ret.Files))
+			if pathname == "/_admin/rebuild" {
+				for _, r := range builds {
+					buildQueue.Add(r.buildTask(), PriorityBackground)
+				}
+			}
+			return ret
+
+		case "/_admin/gc":
+			if ctx.R.Method != "POST" {
+				if lastGCReport == nil {
+					return rex.Status(404, "no gc report")
+				}
+				return lastGCReport
+			}
+			options := gcOptions
+			if v := ctx.Form.Value("keepVersions"); v != "" {
+				options.KeepVersions, _ = strconv.Atoi(v)
+			}
+			if v := ctx.Form.Value("idleDays"); v != "" {
+				days, _ := strconv.Atoi(v)
+				options.MaxIdle = time.Duration(days) * 24 * time.Hour
+			}
+			if options.KeepVersions <= 0 && options.MaxIdle <= 0 {
+				return rex.Status(400, "missing retention, one of `keepVersions` or `idleDays` is required")
+			}
+			return runGC(options)
+
+		case "/_admin/cancel":
+			id := ctx.Form.Value("id")
+			if id == "" {
+				return rex.Status(400, "missing task id")
+			}
+			if !buildQueue.Cancel(id) {
+				return rex.Status(404, "task not found")
+			}
+			log.Infof("admin: cancel task %s", id)
+			return map[string]interface{}{
+				"id":       id,
+				"canceled": true,
+			}
+		}
+		return rex.Status(404, "not found")
+	}
+}
+
+func parseBuildFilter(ctx *rex.Context) buildFilter {
+	return buildFilter{
+		Pkg:     strings.TrimSpace(ctx.Form.Value("pkg")),
+		Version: strings.TrimSpace(ctx.Form.Value("version")),
+		Target:  strings.TrimSpace(ctx.Form.Value("target")),
+		ID:      strings.TrimPrefix(strings.TrimSpace(ctx.Form.Value("id")), "/"),
+	}
+}
+
+// checkBearerToken checks the `Authorization: Bearer <token>` header of the request
+func checkBearerToken(ctx *rex.Context, token string) bool {
+	auth := ctx.R.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
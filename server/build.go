@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
@@ -21,19 +22,76 @@ import (
 
 var buildQueue = newBuildQueue(2 * runtime.NumCPU())
 
+// the error of the unknown names of the `exports` query, the failures of the shared queue
+// are stored as the messages so it's checked by the prefix.
+var errUnknownExport = errors.New("unknown export")
+
+// BuildTimeouts defines the timeouts of the build stages, the `Total` limits the whole task.
+type BuildTimeouts struct {
+	Install time.Duration
+	Build   time.Duration
+	DTS     time.Duration
+	Total   time.Duration
+}
+
+var buildTimeouts = BuildTimeouts{
+	Install: 5 * time.Minute,
+	Build:   5 * time.Minute,
+	DTS:     5 * time.Minute,
+	Total:   15 * time.Minute,
+}
+
+// parseBuildTimeouts parses the timeouts in format `install=5m,build=5m,dts=5m,total=15m`,
+// the omitted stages use the default timeouts.
+func parseBuildTimeouts(s string) (timeouts BuildTimeouts, err error) {
+	timeouts = buildTimeouts
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		key, value := utils.SplitByFirstByte(p, '=')
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return timeouts, fmt.Errorf("invalid timeout '%s'", p)
+		}
+		switch key {
+		case "install":
+			timeouts.Install = d
+		case "build":
+			timeouts.Build = d
+		case "dts":
+			timeouts.DTS = d
+		case "total":
+			timeouts.Total = d
+		default:
+			return timeouts, fmt.Errorf("unknown build stage '%s'", key)
+		}
+	}
+	return
+}
+
 type buildTask struct {
-	id     string
-	wd     string
-	stage  string
-	pkg    pkg
-	alias  map[string]string
-	deps   pkgSlice
-	target string
-	bundle bool
-	isDev  bool
+	id        string
+	wd        string
+	stage     string
+	pkg       pkg
+	alias     map[string]string
+	deps      pkgSlice
+	target    string
+	bundle    bool
+	isDev     bool
+	sourcemap bool
+	exports   []string
 }
 
 func (task *buildTask) resolvePrefix() string {
+	return task.getResolvePrefix(true)
+}
+
+// getResolvePrefix returns the resolve prefix of the `alias`, `deps` and `exports`, the `exports`
+// is only for the build itself, the sub-modules and types share the prefix without it.
+func (task *buildTask) getResolvePrefix(withExports bool) string {
 	alias := []string{}
 	if len(task.alias) > 0 {
 		var ss sort.StringSlice
@@ -51,6 +109,9 @@ func (task *buildTask) resolvePrefix() string {
 		ss.Sort()
 		alias = append(alias, fmt.Sprintf("deps:%s", strings.Join(ss, ",")))
 	}
+	if withExports && len(task.exports) > 0 {
+		alias = append(alias, fmt.Sprintf("exports:%s", strings.Join(task.exports, ",")))
+	}
 	if len(alias) > 0 {
 		return fmt.Sprintf("X-%s/", btoaUrl(strings.Join(alias, ",")))
 	}
@@ -74,6 +135,9 @@ func (task *buildTask) ID() string {
 	if task.isDev {
 		name += ".development"
 	}
+	if task.sourcemap && !task.isDev {
+		name += ".sourcemap"
+	}
 	if task.bundle {
 		name += ".bundle"
 	}
@@ -104,10 +168,13 @@ func (task *buildTask) getImportPath(pkg pkg, extendsAlias bool) string {
 	if task.isDev {
 		name += ".development"
 	}
+	if task.sourcemap && !task.isDev {
+		name += ".sourcemap"
+	}
 
 	var resolvePrefix string
 	if extendsAlias {
-		resolvePrefix = task.resolvePrefix()
+		resolvePrefix = task.getResolvePrefix(false)
 	}
 
 	return fmt.Sprintf(
@@ -121,7 +188,7 @@ func (task *buildTask) getImportPath(pkg pkg, extendsAlias bool) string {
 	)
 }
 
-func (task *buildTask) Build() (esm *ESM, err error) {
+func (task *buildTask) Build(ctx context.Context) (esm *ESM, err error) {
 	prev, err := findESM(task.ID())
 	if err == nil {
 		return prev, nil
@@ -136,23 +203,30 @@ func (task *buildTask) Build() (esm *ESM, err error) {
 	defer os.RemoveAll(task.wd)
 
 	task.stage = "install-deps"
-	err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", task.pkg.name, task.pkg.version))
+	start := time.Now()
+	installCtx, cancel := context.WithTimeout(ctx, buildTimeouts.Install)
+	err = npmInstall(installCtx, task.wd, fmt.Sprintf("%s@%s", task.pkg.name, task.pkg.version))
+	cancel()
+	buildStageDuration.ObserveSince(start, task.stage, task.target)
 	if err != nil {
 		log.Error("install deps:", err)
 		return
 	}
 
-	return task.build(newStringSet())
+	return task.build(ctx, newStringSet())
 }
 
-func (task *buildTask) build(tracing *stringSet) (esm *ESM, err error) {
+func (task *buildTask) build(ctx context.Context, tracing *stringSet) (esm *ESM, err error) {
 	if tracing.Has(task.ID()) {
 		return
 	}
 	tracing.Add(task.ID())
 
+	buildCtx, cancel := context.WithTimeout(ctx, buildTimeouts.Build)
+	defer cancel()
+
 	task.stage = "init"
-	esm, err = initESM(task.wd, task.pkg, task.target != "types", task.isDev)
+	esm, err = initESM(buildCtx, task.wd, task.pkg, task.target != "types", task.isDev)
 	if err != nil {
 		err = fmt.Errorf("init ESM: %v", err)
 		return
@@ -160,7 +234,7 @@ func (task *buildTask) build(tracing *stringSet) (esm *ESM, err error) {
 
 	if task.target == "types" {
 		task.stage = "copy-dts"
-		task.handleDTS(esm)
+		task.handleDTS(ctx, esm)
 		return
 	}
 
@@ -174,7 +248,52 @@ func (task *buildTask) build(tracing *stringSet) (esm *ESM, err error) {
 	var entryPoint string
 	var input *api.StdinOptions
 
-	if esm.Module == "" {
+	if len(task.exports) > 0 {
+		// re-export the selected names only, the others are dropped by the tree shaking
+		exports, complete := esm.Exports, true
+		if esm.Module != "" {
+			exports, complete, err = getESModuleExports(task.wd, esm.Name, esm.Module)
+			if err != nil {
+				return
+			}
+		}
+		var names []string
+		for _, name := range task.exports {
+			if name == "default" {
+				if !esm.ExportDefault {
+					err = fmt.Errorf("%w \"default\" of \"%s\"", errUnknownExport, task.pkg.ImportPath())
+					return
+				}
+				continue
+			}
+			// the names of the unresolved star re-exports are checked by esbuild
+			if complete && !includes(exports, name) {
+				err = fmt.Errorf("%w \"%s\" of \"%s\"", errUnknownExport, name, task.pkg.ImportPath())
+				return
+			}
+			names = append(names, name)
+		}
+		buf := bytes.NewBuffer(nil)
+		importPath := task.pkg.ImportPath()
+		if len(names) > 0 {
+			if esm.Module == "" {
+				fmt.Fprintf(buf, `import * as __star from "%s";%s`, importPath, "\n")
+				fmt.Fprintf(buf, `export const { %s } = __star;%s`, strings.Join(names, ","), "\n")
+			} else {
+				fmt.Fprintf(buf, `export { %s } from "%s";%s`, strings.Join(names, ","), importPath, "\n")
+			}
+		}
+		esm.ExportDefault = len(names) < len(task.exports)
+		if esm.ExportDefault {
+			fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
+		}
+		esm.Exports = names
+		input = &api.StdinOptions{
+			Contents:   buf.String(),
+			ResolveDir: task.wd,
+			Sourcefile: "mod.js",
+		}
+	} else if esm.Module == "" {
 		buf := bytes.NewBuffer(nil)
 		importPath := task.pkg.ImportPath()
 		if len(esm.Exports) > 0 {
@@ -312,6 +431,9 @@ func (task *buildTask) build(tracing *stringSet) (esm *ESM, err error) {
 	}
 
 esbuild:
+	if err = buildCtx.Err(); err != nil {
+		return
+	}
 	start := time.Now()
 	options := api.BuildOptions{
 		Outdir:            "/esbuild",
@@ -330,12 +452,18 @@ esbuild:
 	} else {
 		options.Define = define
 	}
+	if task.sourcemap || task.isDev {
+		options.Sourcemap = api.SourceMapExternal
+	}
 	if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	} else {
 		options.Stdin = input
 	}
 	result := api.Build(options)
+	if err = buildCtx.Err(); err != nil {
+		return
+	}
 	if len(result.Errors) > 0 {
 		// mark the missing module as external to exclude it from the bundle
 		msg := result.Errors[0].Text
@@ -352,13 +480,18 @@ esbuild:
 				external.Add(name)
 				goto esbuild
 			}
-		} else if strings.HasPrefix(msg, "No matching export in \"") && strings.Contains(msg, "for import \"default\"") {
+		} else if len(task.exports) == 0 && strings.HasPrefix(msg, "No matching export in \"") && strings.Contains(msg, "for import \"default\"") {
 			input = &api.StdinOptions{
 				Contents:   fmt.Sprintf(`import "%s";export default null;`, task.pkg.ImportPath()),
 				ResolveDir: task.wd,
 				Sourcefile: "mod.js",
 			}
 			goto esbuild
+		} else if len(task.exports) > 0 && strings.HasPrefix(msg, "No matching export in \"") && strings.Contains(msg, "for import \"") {
+			// the names of the unresolved star re-exports
+			a := strings.Split(msg, "\"")
+			err = fmt.Errorf("%w \"%s\" of \"%s\"", errUnknownExport, a[len(a)-2], task.pkg.ImportPath())
+			return
 		}
 		err = errors.New("esbuild: " + msg)
 		return
@@ -368,9 +501,26 @@ esbuild:
 		log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
 	}
 
+	// the source map of the js output is adjusted for the rewrites below
+	var sourceMapData []byte
+	for _, file := range result.OutputFiles {
+		if strings.HasSuffix(file.Path, ".js.map") {
+			sourceMapData = file.Contents
+		}
+	}
+
 	for _, file := range result.OutputFiles {
 		outputContent := file.Contents
 		if strings.HasSuffix(file.Path, ".js") {
+			var sm *sourceMapper
+			if sourceMapData != nil {
+				sm, err = newSourceMapper(sourceMapData, outputContent)
+				if err != nil {
+					err = fmt.Errorf("source map: %v", err)
+					return
+				}
+			}
+
 			buf := bytes.NewBufferString(fmt.Sprintf(
 				"/* esm.sh - esbuild bundle(%s) %s %s */\n",
 				task.pkg.String(),
@@ -381,6 +531,7 @@ esbuild:
 			if !task.isDev {
 				eol = ""
 			}
+			imports := newStringSet()
 
 			// replace external imports/requires
 			for _, name := range external.Values() {
@@ -398,14 +549,15 @@ esbuild:
 						submodule: submodule,
 					}
 					subTask := &buildTask{
-						wd:     task.wd, // reuse current wd
-						pkg:    subPkg,
-						alias:  task.alias,
-						deps:   task.deps,
-						target: task.target,
-						isDev:  task.isDev,
+						wd:        task.wd, // reuse current wd
+						pkg:       subPkg,
+						alias:     task.alias,
+						deps:      task.deps,
+						target:    task.target,
+						isDev:     task.isDev,
+						sourcemap: task.sourcemap,
 					}
-					subTask.build(tracing)
+					subTask.build(ctx, tracing)
 					if err != nil {
 						return
 					}
@@ -497,12 +649,13 @@ esbuild:
 								version:   p.Version,
 								submodule: submodule,
 							},
-							alias:  task.alias,
-							deps:   task.deps,
-							target: task.target,
-							isDev:  task.isDev,
+							alias:     task.alias,
+							deps:      task.deps,
+							target:    task.target,
+							isDev:     task.isDev,
+							sourcemap: task.sourcemap,
 						}
-						buildQueue.Add(t)
+						buildQueue.Add(t, PriorityPrefetch)
 						importPath = task.getImportPath(pkg{
 							name:      p.Name,
 							version:   p.Version,
@@ -531,22 +684,33 @@ esbuild:
 					err = fmt.Errorf("Could not resolve \"%s\" (Imported by \"%s\")", name, task.pkg.name)
 					return
 				}
+				if strings.HasPrefix(importPath, fmt.Sprintf("/v%d/", VERSION)) {
+					imports.Add(importPath)
+				}
 				buffer := bytes.NewBuffer(nil)
 				identifier := identify(name)
-				slice := bytes.Split(outputContent, []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL:%s\"", name)))
+				marker := []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL:%s\"", name))
+				slice := bytes.Split(outputContent, marker)
 				cjsContext := false
 				cjsImports := newStringSet()
+				runs := make([]textRun, len(slice))
+				offset := 0
 				for i, p := range slice {
+					start := offset
+					offset += len(p) + len(marker)
 					if cjsContext {
-						p = bytes.TrimPrefix(p, []byte{')'})
+						if bytes.HasPrefix(p, []byte{')'}) {
+							p = p[1:]
+							start++
+						}
 						var marked bool
 						if _, ok := builtInNodeModules[name]; !ok {
 							pkg, err := parsePkg(name)
 							if err == nil && !fileExists(path.Join(task.wd, "node_modules", pkg.name, "package.json")) {
-								err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", pkg.name, pkg.version))
+								err = npmInstall(buildCtx, task.wd, fmt.Sprintf("%s@%s", pkg.name, pkg.version))
 							}
 							if err == nil {
-								meta, err := initESM(task.wd, *pkg, true, task.isDev)
+								meta, err := initESM(buildCtx, task.wd, *pkg, true, task.isDev)
 								if err == nil {
 									if bytes.HasPrefix(p, []byte{'.'}) {
 										// right shift to strip the object `key`
@@ -566,6 +730,7 @@ esbuild:
 												cjsImports.Add(importName)
 												marked = true
 												p = p[1:]
+												start++
 												break
 											}
 										}
@@ -598,6 +763,7 @@ esbuild:
 							p = p[0 : len(p)-(shift+1)]
 						}
 					}
+					runs[i] = textRun{start, buffer.Len(), len(p)}
 					buffer.Write(p)
 					if i < len(slice)-1 {
 						if cjsContext {
@@ -624,18 +790,24 @@ esbuild:
 					outputContent = make([]byte, buf.Len()+buffer.Len())
 					copy(outputContent, buf.Bytes())
 					copy(outputContent[buf.Len():], buffer.Bytes())
+					for i := range runs {
+						runs[i].newStart += buf.Len()
+					}
 				} else {
 					outputContent = buffer.Bytes()
 				}
+				sm.apply(runs)
 			}
 
 			// add nodejs/deno compatibility
 			if task.target != "node" {
 				if bytes.Contains(outputContent, []byte("__process$")) {
 					fmt.Fprintf(buf, `import __process$ from "/v%d/node_process.js";%s__process$.env.NODE_ENV="%s";%s`, VERSION, eol, nodeEnv, eol)
+					imports.Add(fmt.Sprintf("/v%d/node_process.js", VERSION))
 				}
 				if bytes.Contains(outputContent, []byte("__Buffer$")) {
 					fmt.Fprintf(buf, `import { Buffer as __Buffer$ } from "/v%d/node_buffer.js";%s`, VERSION, eol)
+					imports.Add(fmt.Sprintf("/v%d/node_buffer.js", VERSION))
 				}
 				if bytes.Contains(outputContent, []byte("__global$")) {
 					fmt.Fprintf(buf, `var __global$ = window;%s`, eol)
@@ -648,15 +820,31 @@ esbuild:
 				}
 			}
 
+			sm.shift(buf.Len())
 			_, err = buf.Write(outputContent)
 			if err != nil {
 				return
 			}
 
+			if sm != nil {
+				filename := path.Base(task.ID())
+				err = fs.WriteData(path.Join("builds", task.ID()+".map"), sm.encode(buf.Bytes(), filename, task.wd))
+				if err != nil {
+					return
+				}
+				if !bytes.HasSuffix(buf.Bytes(), []byte{'\n'}) {
+					buf.WriteByte('\n')
+				}
+				fmt.Fprintf(buf, "//# sourceMappingURL=%s.map\n", filename)
+			}
+
 			err = fs.WriteData(path.Join("builds", task.ID()), buf.Bytes())
 			if err != nil {
 				return
 			}
+			esm.Integrity = computeIntegrity(buf.Bytes())
+			esm.Imports = imports.Values()
+			sort.Strings(esm.Imports)
 		} else if strings.HasSuffix(file.Path, ".css") {
 			err = fs.WriteData(path.Join("builds", strings.TrimSuffix(task.ID(), ".js")+".css"), outputContent)
 			if err != nil {
@@ -667,9 +855,10 @@ esbuild:
 	}
 
 	log.Debugf("esbuild %s %s %s in %v", task.pkg.String(), task.target, nodeEnv, time.Now().Sub(start))
+	buildStageDuration.ObserveSince(start, task.stage, task.target)
 
 	task.stage = "copy-dts"
-	task.handleDTS(esm)
+	task.handleDTS(ctx, esm)
 
 	dbErr := db.Put(
 		task.ID(),
@@ -679,12 +868,14 @@ esbuild:
 	)
 	if dbErr != nil {
 		log.Errorf("db: %v", dbErr)
+	} else if err := indexBuild(task); err != nil {
+		log.Errorf("index build %s: %v", task.ID(), err)
 	}
 
 	return
 }
 
-func (task *buildTask) handleDTS(esm *ESM) {
+func (task *buildTask) handleDTS(ctx context.Context, esm *ESM) {
 	name := task.pkg.name
 	submodule := task.pkg.submodule
 
@@ -705,11 +896,15 @@ func (task *buildTask) handleDTS(esm *ESM) {
 
 	if strings.HasSuffix(dts, ".d.ts") && !strings.HasSuffix(dts, "...d.ts") {
 		start := time.Now()
+		dtsCtx, cancel := context.WithTimeout(ctx, buildTimeouts.DTS)
 		err := CopyDTS(
+			dtsCtx,
 			task.wd,
-			task.resolvePrefix(),
+			task.getResolvePrefix(false),
 			dts,
 		)
+		cancel()
+		buildStageDuration.ObserveSince(start, "copy-dts", task.target)
 		if err != nil && os.IsExist(err) {
 			log.Errorf("copyDTS(%s): %v", dts, err)
 			return
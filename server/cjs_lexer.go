@@ -1,242 +1,600 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
+	"regexp"
 	"strings"
+
+	"github.com/ije/esbuild-internal/js_ast"
+	"github.com/ije/esbuild-internal/js_lexer"
+	"github.com/ije/esbuild-internal/js_parser"
+	"github.com/ije/esbuild-internal/logger"
+	"github.com/ije/gox/utils"
 )
 
-var cjsLexerServerPort = uint16(8088)
-var cjsModuleLexerVersion = "1.2.2"
+var regIdentifier = regexp.MustCompile(`^[a-zA-Z_\$][a-zA-Z0-9_\$]*$`)
+
+var reservedWords = map[string]bool{
+	"abstract": true, "arguments": true, "await": true, "boolean": true,
+	"break": true, "byte": true, "case": true, "catch": true,
+	"char": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true,
+	"double": true, "else": true, "enum": true, "eval": true,
+	"export": true, "extends": true, "false": true, "final": true,
+	"finally": true, "float": true, "for": true, "function": true,
+	"goto": true, "if": true, "implements": true, "import": true,
+	"in": true, "instanceof": true, "int": true, "interface": true,
+	"let": true, "long": true, "native": true, "new": true,
+	"null": true, "package": true, "private": true, "protected": true,
+	"public": true, "return": true, "short": true, "static": true,
+	"super": true, "switch": true, "synchronized": true, "this": true,
+	"throw": true, "throws": true, "transient": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true,
+	"volatile": true, "while": true, "with": true, "yield": true,
+	"__esModule": true,
+}
 
 type cjsModuleLexerResult struct {
 	Exports []string `json:"exports"`
 	Error   string   `json:"error"`
 }
 
-func parseCJSModuleExports(buildDir string, importPath string, nodeEnv string) (ret cjsModuleLexerResult, err error) {
-	url := fmt.Sprintf("http://0.0.0.0:%d", cjsLexerServerPort)
-	req, err := http.NewRequest("GET", url, nil)
+// parseCJSModuleExports finds the exports of a commonjs module, the reexports
+// (`module.exports = require('...')` etc.) are followed recursively.
+func parseCJSModuleExports(ctx context.Context, buildDir string, importPath string, nodeEnv string) (ret cjsModuleLexerResult, err error) {
+	entry, err := resolveCJSModule(buildDir, buildDir, importPath)
 	if err != nil {
+		ret.Error = err.Error()
+		err = nil
 		return
 	}
 
-	req.Header.Add("build-dir", buildDir)
-	req.Header.Add("import-path", importPath)
-	req.Header.Add("node-env", nodeEnv)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	exports := []string{}
+
+	// handle entry ends with '.json'
+	if strings.HasSuffix(entry, ".json") {
+		var mod map[string]interface{}
+		if utils.ParseJSONFile(entry, &mod) == nil {
+			for key := range mod {
+				exports = append(exports, key)
+			}
+		}
+		ret.Exports = verifyExports(exports)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		err = errors.New(resp.Status)
-		return
+	paths := []string{entry}
+	visited := newStringSet()
+	for len(paths) > 0 {
+		currentPath := paths[len(paths)-1]
+		paths = paths[:len(paths)-1]
+		if visited.Has(currentPath) {
+			continue
+		}
+		visited.Add(currentPath)
+
+		lexer, e := lexCJSModule(currentPath, nodeEnv)
+		if e != nil {
+			ret.Error = e.Error()
+			return
+		}
+		exports = append(exports, lexer.exports...)
+		for _, reexport := range lexer.reexports {
+			if !strings.HasSuffix(reexport, ".json") {
+				p, e := resolveCJSModule(buildDir, path.Dir(currentPath), reexport)
+				if e != nil {
+					ret.Error = e.Error()
+					return
+				}
+				paths = append(paths, p)
+			}
+		}
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&ret)
+	// the workaround when the lexer didn't get any exports
+	if len(exports) == 0 {
+		exports, err = requireModuleExports(ctx, buildDir, entry, nodeEnv)
+		if err != nil {
+			ret.Error = err.Error()
+			err = nil
+			return
+		}
+	}
+
+	ret.Exports = verifyExports(exports)
 	return
 }
 
-/** use a cjs-module-lexer http server instead of child process */
-func startCJSLexerServer(pidFile string, isDev bool) (err error) {
-	wd := path.Join(os.TempDir(), fmt.Sprintf("esmd-%d-cjs-module-lexer-%s", VERSION, cjsModuleLexerVersion))
-	ensureDir(wd)
+// requireModuleExports evaluates the module in nodejs to get the exports, it only
+// works when the nodejs is installed.
+func requireModuleExports(ctx context.Context, buildDir string, entry string, nodeEnv string) (exports []string, err error) {
+	if _, e := exec.LookPath("node"); e != nil {
+		return
+	}
 
-	// install cjs-module-lexer
-	cmd := exec.Command("yarn", "add", fmt.Sprintf("cjs-module-lexer@%s", cjsModuleLexerVersion), "enhanced-resolve")
-	cmd.Dir = wd
-	output, err := cmd.CombinedOutput()
+	js := fmt.Sprintf(`
+		const mod = require(%s)
+		const exports = []
+		if ((typeof mod === 'object' && mod !== null && !Array.isArray(mod)) || typeof mod === 'function') {
+			for (const key of Object.keys(mod)) {
+				if (typeof key === 'string' && key !== '') {
+					exports.push(key)
+				}
+			}
+		}
+		process.stdout.write(JSON.stringify(exports))
+	`, string(utils.MustEncodeJSON(entry)))
+	cmd := exec.Command("node", "-e", js)
+	cmd.Dir = buildDir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("NODE_ENV=%s", nodeEnv))
+	output, err := commandOutput(ctx, cmd)
 	if err != nil {
-		err = fmt.Errorf("install cjs-module-lexer: %s", string(output))
+		if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+			a := strings.Split(strings.TrimSpace(string(e.Stderr)), "\n")
+			err = errors.New(a[len(a)-1])
+		}
 		return
 	}
+	err = json.Unmarshal(output, &exports)
+	return
+}
 
-	errBuf := bytes.NewBuffer(nil)
-	jsBuf := bytes.NewBufferString(fmt.Sprintf(`
-		const fs = require('fs')
-		const { dirname, join } = require('path')
-		const http = require('http')
-		const { promisify } = require('util')
-		const cjsLexer = require('cjs-module-lexer')
-		const enhancedResolve = require('enhanced-resolve')
-
-		const identRegexp = /^[a-zA-Z_\$][a-zA-Z0-9_\$]+$/
-		const resolve = promisify(enhancedResolve.create({
-			mainFields: ['browser', 'module', 'main']
-		}))
-		const reservedWords = new Set([
-			'abstract', 'arguments', 'await', 'boolean',
-			'break', 'byte', 'case', 'catch',
-			'char', 'class', 'const', 'continue',
-			'debugger', 'default', 'delete', 'do',
-			'double', 'else', 'enum', 'eval',
-			'export', 'extends', 'false', 'final',
-			'finally', 'float', 'for', 'function',
-			'goto', 'if', 'implements', 'import',
-			'in', 'instanceof', 'int', 'interface',
-			'let', 'long', 'native', 'new',
-			'null', 'package', 'private', 'protected',
-			'public', 'return', 'short', 'static',
-			'super', 'switch', 'synchronized', 'this',
-			'throw', 'throws', 'transient', 'true',
-			'try', 'typeof', 'var', 'void',
-			'volatile', 'while', 'with', 'yield',
-			'__esModule'
-		])
-
-		let cjsLexerReady = false
-
-		function isObject(v) {
-			return typeof v === 'object' && v !== null && !Array.isArray(v)
-		}
-
-		function verifyExports(exports) {
-			return Array.from(new Set(exports.filter(name => identRegexp.test(name) && !reservedWords.has(name))))
-		}
-
-		async function getExports (buildDir, importPath, nodeEnv = 'production') {
-			process.env.NODE_ENV = nodeEnv
-
-			if (!cjsLexerReady) {
-				await cjsLexer.init()
-				cjsLexerReady = true
-			}
-
-			const entry = await resolve(buildDir, importPath)
-			const exports = []
-
-			/* handle entry ends with '.json' */
-			if (entry.endsWith('.json')) {
-				try {
-					const content = fs.readFileSync(entry).toString()
-					const mod = JSON.parse(content)
-					if (isObject(mod)) {
-						exports.push(...Object.keys(mod))
-					}
-					return { 
-						exports: verifyExports(exports) 
-					}
-				} catch(e) {
-					return { error: e.message }
+func verifyExports(exports []string) []string {
+	set := newStringSet()
+	a := []string{}
+	for _, name := range exports {
+		if regIdentifier.MatchString(name) && !reservedWords[name] && !set.Has(name) {
+			set.Add(name)
+			a = append(a, name)
+		}
+	}
+	return a
+}
+
+// resolveCJSModule resolves the module specifier like nodejs with the main
+// fields `browser`, `module` and `main`.
+func resolveCJSModule(buildDir string, dir string, specifier string) (string, error) {
+	if isLocalImport(specifier) {
+		if strings.HasPrefix(specifier, "/") {
+			dir = ""
+		}
+		p, ok := resolveCJSFile(path.Join(dir, specifier))
+		if ok {
+			return p, nil
+		}
+	} else {
+		for d := dir; ; d = path.Dir(d) {
+			if path.Base(d) != "node_modules" {
+				p, ok := resolveCJSFile(path.Join(d, "node_modules", specifier))
+				if ok {
+					return p, nil
 				}
 			}
+			if d == buildDir || d == "/" || d == "." || !strings.HasPrefix(d, buildDir) {
+				break
+			}
+		}
+	}
+	return "", fmt.Errorf("Cannot find module '%s' from '%s'", specifier, dir)
+}
 
-			/* the below code was stolen from https://github.com/evanw/esbuild/issues/442#issuecomment-739340295 */
-			try {
-				const paths = []
-				paths.push(entry)
-				while (paths.length > 0) {
-					const currentPath = paths.pop()
-					const code = fs.readFileSync(currentPath).toString()
-					const results = cjsLexer.parse(code)
-					exports.push(...results.exports)
-					for (const reexport of results.reexports) {
-						if (!reexport.endsWith('.json')) {
-							paths.push(await resolve(dirname(currentPath), reexport))
-						}
-					}
-				}
-			} catch(e) {
-				return { error: e.message }
-			}
-
-			/* the workaround when the cjsLexer didn't get any exports */
-			if (exports.length === 0) {
-				try {
-					const entry = await resolve(buildDir, importPath)
-					const mod = require(entry) 
-					if (isObject(mod) || typeof mod === 'function') {
-						for (const key of Object.keys(mod)) {
-							if (typeof key === 'string' && key !== '') {
-								exports.push(key)
-							}
+func resolveCJSFile(p string) (string, bool) {
+	if fileExists(p) {
+		return p, true
+	}
+	for _, ext := range []string{".js", ".cjs", ".json"} {
+		if fileExists(p + ext) {
+			return p + ext, true
+		}
+	}
+	if dirExists(p) {
+		packageFile := path.Join(p, "package.json")
+		if fileExists(packageFile) {
+			var m map[string]interface{}
+			if utils.ParseJSONFile(packageFile, &m) == nil {
+				for _, field := range []string{"browser", "module", "main"} {
+					if s, ok := m[field].(string); ok && s != "" {
+						if f, ok := resolveCJSFile(path.Join(p, s)); ok {
+							return f, true
 						}
 					}
-				} catch(e) {
-					return { error: e.message }
 				}
 			}
+		}
+		for _, name := range []string{"index.js", "index.json"} {
+			if fileExists(path.Join(p, name)) {
+				return path.Join(p, name), true
+			}
+		}
+	}
+	return "", false
+}
 
-			return { 
-				exports: verifyExports(exports)
+// a commonjs lexer based on the esbuild js parser, it finds the patterns like:
+//
+//	exports.foo = ...
+//	module.exports.foo = ...
+//	Object.defineProperty(exports, 'foo', ...)
+//	module.exports = { foo, bar: ..., ...require('./baz') }
+//	module.exports = require('./foo')
+//	__exportStar(require('./foo'), exports)
+//	Object.keys(_foo).forEach(...)
+type cjsLexer struct {
+	ast       js_ast.AST
+	nodeEnv   string
+	exports   []string
+	reexports []string
+	// the local bindings that are tracked to resolve `module.exports = foo`
+	requires map[js_ast.Ref]string
+	objects  map[js_ast.Ref]*js_ast.EObject
+	assigns  map[js_ast.Ref][]string
+	aliases  map[js_ast.Ref]bool
+}
+
+func lexCJSModule(filename string, nodeEnv string) (lexer *cjsLexer, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug)
+	ast, pass := js_parser.Parse(log, logger.Source{
+		KeyPath:    logger.Path{Text: filename},
+		PrettyPath: filename,
+		Contents:   string(data),
+	}, js_parser.Options{})
+	if !pass {
+		for _, msg := range log.Done() {
+			if msg.Kind == logger.Error {
+				return nil, fmt.Errorf("%s: %s", path.Base(filename), msg.Data.Text)
 			}
 		}
+		return nil, fmt.Errorf("%s: syntax error", path.Base(filename))
+	}
+	if ast.ExportKeyword.Len > 0 || ast.ImportKeyword.Len > 0 {
+		return nil, errors.New("Unexpected export statement in CJS module")
+	}
+
+	lexer = &cjsLexer{
+		ast:      ast,
+		nodeEnv:  nodeEnv,
+		requires: map[js_ast.Ref]string{},
+		objects:  map[js_ast.Ref]*js_ast.EObject{},
+		assigns:  map[js_ast.Ref][]string{},
+		aliases:  map[js_ast.Ref]bool{},
+	}
+	for _, part := range ast.Parts {
+		lexer.walkStmts(part.Stmts)
+	}
+	for ref := range lexer.aliases {
+		lexer.exports = append(lexer.exports, lexer.assigns[ref]...)
+		if obj, ok := lexer.objects[ref]; ok {
+			lexer.exportObject(obj)
+		}
+		if specifier, ok := lexer.requires[ref]; ok {
+			lexer.reexports = append(lexer.reexports, specifier)
+		}
+	}
+	return
+}
+
+func (l *cjsLexer) name(ref js_ast.Ref) string {
+	if int(ref.InnerIndex) < len(l.ast.Symbols) {
+		return l.ast.Symbols[ref.InnerIndex].OriginalName
+	}
+	return ""
+}
+
+func (l *cjsLexer) walkStmts(stmts []js_ast.Stmt) {
+	for _, stmt := range stmts {
+		l.walkStmt(stmt)
+	}
+}
 
-		const server = http.createServer(async function (req, resp) {
-			const buildDir = req.headers['build-dir']
-			const importPath = req.headers['import-path']
-			const nodeEnv = req.headers['node-env']
-			if (!buildDir || !importPath) {
-				resp.write('Bad request')
-				resp.end()
-				return
+func (l *cjsLexer) walkStmt(stmt js_ast.Stmt) {
+	switch s := stmt.Data.(type) {
+	case *js_ast.SExpr:
+		l.walkExpr(s.Value)
+	case *js_ast.SLocal:
+		for _, decl := range s.Decls {
+			if decl.ValueOrNil.Data != nil {
+				if b, ok := decl.Binding.Data.(*js_ast.BIdentifier); ok {
+					l.bind(b.Ref, decl.ValueOrNil)
+				}
+				l.walkExpr(decl.ValueOrNil)
 			}
-			try {
-				const ret = await getExports(buildDir, importPath, nodeEnv)
-				resp.write(JSON.stringify(ret))
-			} catch(e) {
-				resp.write(JSON.stringify({ error: e.message }))
+		}
+	case *js_ast.SIf:
+		switch l.checkNodeEnv(s.Test) {
+		case 1:
+			l.walkStmt(s.Yes)
+		case 0:
+			if s.NoOrNil.Data != nil {
+				l.walkStmt(s.NoOrNil)
 			}
-			resp.end()
-		})
-
-		server.on('error', (e) => {
-			if (e.code === 'EADDRINUSE') {
-				console.error('EADDRINUSE')
-				process.exit(1)
+		default:
+			l.walkStmt(s.Yes)
+			if s.NoOrNil.Data != nil {
+				l.walkStmt(s.NoOrNil)
 			}
-		})
+		}
+	case *js_ast.SBlock:
+		l.walkStmts(s.Stmts)
+	case *js_ast.STry:
+		l.walkStmts(s.Body)
+		if s.Catch != nil {
+			l.walkStmts(s.Catch.Body)
+		}
+		if s.Finally != nil {
+			l.walkStmts(s.Finally.Stmts)
+		}
+	case *js_ast.SFunction:
+		l.walkStmts(s.Fn.Body.Stmts)
+	case *js_ast.SReturn:
+		if s.ValueOrNil.Data != nil {
+			l.walkExpr(s.ValueOrNil)
+		}
+	}
+}
 
-		server.listen(%d, () => {
-			if (process.env.NODE_ENV === 'development') {
-				console.log('[debug] cjs lexer server ready on http://localhost:%d')
+func (l *cjsLexer) walkExpr(expr js_ast.Expr) {
+	switch e := expr.Data.(type) {
+	case *js_ast.EBinary:
+		switch e.Op {
+		case js_ast.BinOpAssign:
+			l.assign(e.Left, e.Right)
+			l.walkExpr(e.Right)
+		case js_ast.BinOpComma, js_ast.BinOpLogicalAnd, js_ast.BinOpLogicalOr:
+			l.walkExpr(e.Left)
+			l.walkExpr(e.Right)
+		}
+	case *js_ast.EIf:
+		switch l.checkNodeEnv(e.Test) {
+		case 1:
+			l.walkExpr(e.Yes)
+		case 0:
+			l.walkExpr(e.No)
+		default:
+			l.walkExpr(e.Yes)
+			l.walkExpr(e.No)
+		}
+	case *js_ast.ECall:
+		l.call(e)
+		l.walkExpr(e.Target)
+		for _, arg := range e.Args {
+			l.walkExpr(arg)
+		}
+	case *js_ast.EUnary:
+		l.walkExpr(e.Value)
+	case *js_ast.EFunction:
+		l.walkStmts(e.Fn.Body.Stmts)
+	case *js_ast.EArrow:
+		l.walkStmts(e.Body.Stmts)
+	}
+}
+
+// bind tracks the local binding `var foo = ...`
+func (l *cjsLexer) bind(ref js_ast.Ref, value js_ast.Expr) {
+	if specifier, ok := l.requireSpecifier(value); ok {
+		l.requires[ref] = specifier
+		return
+	}
+	switch v := value.Data.(type) {
+	case *js_ast.EObject:
+		l.objects[ref] = v
+	case *js_ast.EBinary:
+		// var foo = module.exports = {...}
+		if v.Op == js_ast.BinOpAssign && l.isModuleExports(v.Left) {
+			l.aliases[ref] = true
+		}
+	default:
+		if l.isExports(value) || l.isModuleExports(value) {
+			l.aliases[ref] = true
+		}
+	}
+}
+
+func (l *cjsLexer) assign(left js_ast.Expr, right js_ast.Expr) {
+	switch t := left.Data.(type) {
+	case *js_ast.EIdentifier:
+		l.bind(t.Ref, right)
+	case *js_ast.EDot:
+		if l.isModuleExports(left) {
+			l.exportValue(right)
+		} else if l.isExports(t.Target) || l.isModuleExports(t.Target) {
+			l.exports = append(l.exports, t.Name)
+		} else if id, ok := t.Target.Data.(*js_ast.EIdentifier); ok {
+			l.assigns[id.Ref] = append(l.assigns[id.Ref], t.Name)
+		}
+	case *js_ast.EIndex:
+		if s, ok := t.Index.Data.(*js_ast.EString); ok {
+			name := js_lexer.UTF16ToString(s.Value)
+			if l.isExports(t.Target) || l.isModuleExports(t.Target) {
+				l.exports = append(l.exports, name)
+			} else if id, ok := t.Target.Data.(*js_ast.EIdentifier); ok {
+				l.assigns[id.Ref] = append(l.assigns[id.Ref], name)
 			}
-		})
-	`, cjsLexerServerPort, cjsLexerServerPort))
+		}
+	}
+}
 
-	// kill previous node process if exists
-	if data, err := ioutil.ReadFile(pidFile); err == nil {
-		if i, err := strconv.Atoi(string(data)); err == nil {
-			if p, err := os.FindProcess(i); err == nil {
-				p.Kill()
+// exportValue handles `module.exports = ...`
+func (l *cjsLexer) exportValue(value js_ast.Expr) {
+	if specifier, ok := l.requireSpecifier(value); ok {
+		l.reexports = append(l.reexports, specifier)
+		return
+	}
+	switch v := value.Data.(type) {
+	case *js_ast.EObject:
+		l.exportObject(v)
+	case *js_ast.EIdentifier:
+		l.aliases[v.Ref] = true
+	case *js_ast.EBinary:
+		// module.exports = foo = {...}
+		if v.Op == js_ast.BinOpAssign {
+			if id, ok := v.Left.Data.(*js_ast.EIdentifier); ok {
+				l.aliases[id.Ref] = true
 			}
+			l.exportValue(v.Right)
 		}
 	}
+}
 
-	cmd = exec.Command("node")
-	cmd.Stdin = jsBuf
-	cmd.Dir = wd
-	cmd.Stderr = errBuf
-	env := "production"
-	if isDev {
-		env = "development"
-		cmd.Stdout = os.Stdout
+func (l *cjsLexer) exportObject(obj *js_ast.EObject) {
+	for _, p := range obj.Properties {
+		if p.Kind == js_ast.PropertySpread {
+			if specifier, ok := l.requireSpecifier(p.ValueOrNil); ok {
+				l.reexports = append(l.reexports, specifier)
+			}
+			continue
+		}
+		if s, ok := p.Key.Data.(*js_ast.EString); ok && !p.IsComputed {
+			l.exports = append(l.exports, js_lexer.UTF16ToString(s.Value))
+		}
 	}
-	cmd.Env = append(os.Environ(), fmt.Sprintf(`NODE_ENV=%s`, env))
+}
 
-	err = cmd.Start()
-	if err != nil {
+func (l *cjsLexer) call(e *js_ast.ECall) {
+	var callee string
+	var calleeObject string
+	switch t := e.Target.Data.(type) {
+	case *js_ast.EIdentifier:
+		callee = l.name(t.Ref)
+	case *js_ast.EDot:
+		callee = t.Name
+		if id, ok := t.Target.Data.(*js_ast.EIdentifier); ok {
+			calleeObject = l.name(id.Ref)
+		}
+		// Object.keys(_foo).forEach(function (key) { ... exports[key] = _foo[key] ... })
+		if callee == "forEach" {
+			if c, ok := t.Target.Data.(*js_ast.ECall); ok && len(c.Args) == 1 {
+				if d, ok := c.Target.Data.(*js_ast.EDot); ok && d.Name == "keys" && l.isIdentifier(d.Target, "Object") {
+					if specifier, ok := l.requireSpecifier(c.Args[0]); ok {
+						l.reexports = append(l.reexports, specifier)
+					}
+				}
+			}
+			return
+		}
+	default:
 		return
 	}
 
-	// store node process pid
-	ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	switch {
+	// Object.defineProperty(exports, 'foo', {...})
+	case callee == "defineProperty" && calleeObject == "Object" && len(e.Args) >= 2:
+		if s, ok := e.Args[1].Data.(*js_ast.EString); ok {
+			name := js_lexer.UTF16ToString(s.Value)
+			if l.isExports(e.Args[0]) || l.isModuleExports(e.Args[0]) {
+				l.exports = append(l.exports, name)
+			} else if id, ok := e.Args[0].Data.(*js_ast.EIdentifier); ok {
+				l.assigns[id.Ref] = append(l.assigns[id.Ref], name)
+			}
+		}
 
-	// wait the process to exit
-	cmd.Wait()
+	// Object.assign(module.exports, {...}, require('./foo'))
+	case callee == "assign" && calleeObject == "Object" && len(e.Args) >= 2:
+		if l.isExports(e.Args[0]) || l.isModuleExports(e.Args[0]) {
+			for _, arg := range e.Args[1:] {
+				l.exportValue(arg)
+			}
+		}
 
-	if errBuf.Len() > 0 {
-		err = errors.New(strings.TrimSpace(errBuf.String()))
+	// __exportStar(require('./foo'), exports), __export(require('./foo')) or __export(exports, {...})
+	case strings.HasSuffix(callee, "__exportStar") || strings.HasSuffix(callee, "__export"):
+		if len(e.Args) > 0 {
+			if specifier, ok := l.requireSpecifier(e.Args[0]); ok {
+				l.reexports = append(l.reexports, specifier)
+			} else if len(e.Args) == 2 && (l.isExports(e.Args[0]) || l.isModuleExports(e.Args[0])) {
+				if obj, ok := e.Args[1].Data.(*js_ast.EObject); ok {
+					l.exportObject(obj)
+				}
+			}
+		}
 	}
-	return
+}
+
+// requireSpecifier returns the specifier of `require('...')`, the local binding
+// of a require call and the require call wrapped by interop helpers like
+// `__importStar(require('...'))`.
+func (l *cjsLexer) requireSpecifier(expr js_ast.Expr) (string, bool) {
+	switch e := expr.Data.(type) {
+	case *js_ast.ECall:
+		if len(e.Args) != 1 {
+			return "", false
+		}
+		if l.isIdentifier(e.Target, "require") {
+			if s, ok := e.Args[0].Data.(*js_ast.EString); ok {
+				return js_lexer.UTF16ToString(s.Value), true
+			}
+			return "", false
+		}
+		if c, ok := e.Args[0].Data.(*js_ast.ECall); ok && l.isIdentifier(c.Target, "require") {
+			return l.requireSpecifier(e.Args[0])
+		}
+	case *js_ast.EIdentifier:
+		specifier, ok := l.requires[e.Ref]
+		return specifier, ok
+	}
+	return "", false
+}
+
+func (l *cjsLexer) isIdentifier(expr js_ast.Expr, name string) bool {
+	id, ok := expr.Data.(*js_ast.EIdentifier)
+	return ok && l.name(id.Ref) == name
+}
+
+func (l *cjsLexer) isExports(expr js_ast.Expr) bool {
+	id, ok := expr.Data.(*js_ast.EIdentifier)
+	return ok && (l.name(id.Ref) == "exports" || l.aliases[id.Ref])
+}
+
+func (l *cjsLexer) isModuleExports(expr js_ast.Expr) bool {
+	d, ok := expr.Data.(*js_ast.EDot)
+	return ok && d.Name == "exports" && l.isIdentifier(d.Target, "module")
+}
+
+// checkNodeEnv checks the condition like `process.env.NODE_ENV === 'production'`,
+// returns 1 if it's true, 0 if it's false, or -1 if it's not a NODE_ENV check.
+func (l *cjsLexer) checkNodeEnv(test js_ast.Expr) int {
+	e, ok := test.Data.(*js_ast.EBinary)
+	if !ok {
+		return -1
+	}
+	var eq bool
+	switch e.Op {
+	case js_ast.BinOpStrictEq, js_ast.BinOpLooseEq:
+		eq = true
+	case js_ast.BinOpStrictNe, js_ast.BinOpLooseNe:
+		eq = false
+	default:
+		return -1
+	}
+	left, right := e.Left, e.Right
+	if _, ok := left.Data.(*js_ast.EString); ok {
+		left, right = right, left
+	}
+	s, ok := right.Data.(*js_ast.EString)
+	if !ok {
+		return -1
+	}
+	d, ok := left.Data.(*js_ast.EDot)
+	if !ok || d.Name != "NODE_ENV" {
+		return -1
+	}
+	d, ok = d.Target.Data.(*js_ast.EDot)
+	if !ok || d.Name != "env" || !l.isIdentifier(d.Target, "process") {
+		return -1
+	}
+	if (js_lexer.UTF16ToString(s.Value) == l.nodeEnv) == eq {
+		return 1
+	}
+	return 0
 }
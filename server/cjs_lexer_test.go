@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseCJSModuleExports(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-cjs-lexer")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	files := map[string]string{
+		"node_modules/foo/package.json": `{"name":"foo","main":"lib/index.js"}`,
+		"node_modules/foo/lib/index.js": strings.Join([]string{
+			`"use strict";`,
+			`Object.defineProperty(exports, "__esModule", { value: true });`,
+			`exports.a = 1;`,
+			`exports["b"] = 2;`,
+			`module.exports.c = 3;`,
+			`Object.defineProperty(exports, "d", { enumerable: true, get: function () { return 4; } });`,
+			`__exportStar(require("./star"), exports);`,
+			`var _bar = require("bar");`,
+			`Object.keys(_bar).forEach(function (key) { exports[key] = _bar[key]; });`,
+		}, "\n"),
+		"node_modules/foo/lib/star.js": `exports.e = 5;`,
+		"node_modules/bar/index.js":    `module.exports = { f: 6, g, ...require("./h") };`,
+		"node_modules/bar/h.js":        `module.exports = function h() {}; module.exports.h = 7;`,
+		"node_modules/env/index.js": strings.Join([]string{
+			`if (process.env.NODE_ENV === "production") {`,
+			`  module.exports = require("./prod.js");`,
+			`} else {`,
+			`  module.exports = require("./dev.js");`,
+			`}`,
+		}, "\n"),
+		"node_modules/env/prod.js": `exports.prod = true;`,
+		"node_modules/env/dev.js":  `exports.dev = true;`,
+		"node_modules/alias/index.js": strings.Join([]string{
+			`function alias() {}`,
+			`alias.version = "1.0.0";`,
+			`alias.parse = function () {};`,
+			`module.exports = alias;`,
+		}, "\n"),
+		"node_modules/esm/index.js": `export const foo = "bar";`,
+	}
+	for name, content := range files {
+		filename := path.Join(testDir, name)
+		ensureDir(path.Dir(filename))
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		importPath string
+		nodeEnv    string
+		exports    []string
+		err        string
+	}{
+		{"foo", "production", []string{"a", "b", "c", "d", "e", "f", "g", "h"}, ""},
+		{"env", "production", []string{"prod"}, ""},
+		{"env", "development", []string{"dev"}, ""},
+		{"alias", "production", []string{"parse", "version"}, ""},
+		{"esm", "production", nil, "Unexpected export statement in CJS module"},
+	} {
+		ret, err := parseCJSModuleExports(context.Background(), testDir, c.importPath, c.nodeEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret.Error != c.err {
+			t.Fatalf("parse %s: unexpected error %q, should be %q", c.importPath, ret.Error, c.err)
+		}
+		sort.Strings(ret.Exports)
+		if strings.Join(ret.Exports, ",") != strings.Join(c.exports, ",") {
+			t.Fatalf("parse %s: unexpected exports %v, should be %v", c.importPath, ret.Exports, c.exports)
+		}
+	}
+}
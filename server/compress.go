@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+
+	"esm.sh/server/storage"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// the files that are smaller than the size are not compressed, same as `rex.AutoCompress`
+const minCompressSize = 1024
+
+// the content encodings of the precompressed variants in order of preference
+var precompressEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressFS stores the gzip and brotli variants along with the text files of the
+// `builds/` and `types/`, the variants are listed and deleted with the original file.
+type precompressFS struct {
+	storage.FS
+}
+
+// newPrecompressFS returns the precompressFS of the fs, it's a `storage.Walker` if the fs is.
+func newPrecompressFS(fs storage.FS) storage.FS {
+	p := &precompressFS{fs}
+	if _, ok := fs.(storage.Walker); ok {
+		return &precompressWalkerFS{p}
+	}
+	return p
+}
+
+// precompressWalkerFS is the precompressFS of a `storage.Walker`, the variants are skipped
+// like the `List`.
+type precompressWalkerFS struct {
+	*precompressFS
+}
+
+func (fs *precompressWalkerFS) Walk(prefix string, fn func(name string, size int64) bool) error {
+	return fs.FS.(storage.Walker).Walk(prefix, func(name string, size int64) bool {
+		return isPrecompressedVariant(name) || fn(name, size)
+	})
+}
+
+func (fs *precompressFS) WriteFile(name string, r io.Reader) (int64, error) {
+	if !shouldPrecompress(name) {
+		return fs.FS.WriteFile(name, r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), fs.WriteData(name, data)
+}
+
+func (fs *precompressFS) WriteData(name string, data []byte) error {
+	if !shouldPrecompress(name) {
+		return fs.FS.WriteData(name, data)
+	}
+	// the variants of the previous content are stale, they are deleted before the
+	// original file is rewritten, so they are never served with the new content
+	err := fs.deleteVariants(name)
+	if err == nil {
+		err = fs.FS.WriteData(name, data)
+	}
+	if err != nil || len(data) < minCompressSize {
+		return err
+	}
+	for _, enc := range precompressEncodings {
+		buf := bytes.NewBuffer(nil)
+		err = compressData(buf, enc.name, data)
+		if err != nil {
+			return err
+		}
+		err = fs.FS.WriteData(name+enc.ext, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *precompressFS) List(prefix string) ([]string, error) {
+	paths, err := fs.FS.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	a := paths[:0]
+	for _, name := range paths {
+		if !isPrecompressedVariant(name) {
+			a = append(a, name)
+		}
+	}
+	return a, nil
+}
+
+func (fs *precompressFS) Delete(name string) error {
+	err := fs.FS.Delete(name)
+	if err != nil || !shouldPrecompress(name) {
+		return err
+	}
+	return fs.deleteVariants(name)
+}
+
+func (fs *precompressFS) deleteVariants(name string) error {
+	for _, enc := range precompressEncodings {
+		err := fs.FS.Delete(name + enc.ext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shouldPrecompress(name string) bool {
+	if !strings.HasPrefix(name, "builds/") && !strings.HasPrefix(name, "types/") {
+		return false
+	}
+	switch path.Ext(name) {
+	case ".js", ".mjs", ".css", ".map", ".ts", ".json":
+		return true
+	}
+	return false
+}
+
+func isPrecompressedVariant(name string) bool {
+	for _, enc := range precompressEncodings {
+		if strings.HasSuffix(name, enc.ext) && shouldPrecompress(strings.TrimSuffix(name, enc.ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressData(w io.Writer, encoding string, data []byte) (err error) {
+	var cw io.WriteCloser
+	switch encoding {
+	case "br":
+		// the best compression (level 11) takes seconds for the large builds
+		cw = brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	case "gzip":
+		cw, err = gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return
+		}
+	}
+	_, err = cw.Write(data)
+	if err == nil {
+		err = cw.Close()
+	}
+	return
+}
+
+// acceptedEncodings returns the content encodings in the `Accept-Encoding` header
+func acceptedEncodings(ctx *rex.Context) map[string]bool {
+	encodings := map[string]bool{}
+	for _, p := range strings.Split(ctx.R.Header.Get("Accept-Encoding"), ",") {
+		name, params := utils.SplitByFirstByte(p, ';')
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+		encodings[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return encodings
+}
+
+// readStoredFile opens the stored file, or its precompressed variant if the client accepts it.
+// It returns the name for `rex.Content`, the variant name has no compressable extension so
+// `rex.AutoCompress` skips it.
+func readStoredFile(ctx *rex.Context, savePath string) (string, io.ReadSeekCloser, error) {
+	ctx.SetHeader("Vary", "Accept-Encoding")
+	if shouldPrecompress(savePath) {
+		accepted := acceptedEncodings(ctx)
+		for _, enc := range precompressEncodings {
+			if !accepted[enc.name] {
+				continue
+			}
+			r, err := fs.ReadFile(savePath + enc.ext)
+			if err == nil {
+				if ctx.W.Header().Get("Content-Type") == "" {
+					ctx.SetHeader("Content-Type", mime.TypeByExtension(path.Ext(savePath)))
+				}
+				ctx.SetHeader("Content-Encoding", enc.name)
+				return savePath + enc.ext, r, nil
+			}
+		}
+	}
+	r, err := fs.ReadFile(savePath)
+	return savePath, r, err
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ije/rex"
+)
+
+func TestPrecompressFS(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-precompress")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	localFS, err := storage.OpenFS("local:" + testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = newPrecompressFS(localFS)
+
+	code := strings.Repeat("export const foo = 'bar';\n", 100)
+	savePath := "builds/v53/foo@1.0.0/es2020/foo.js"
+	for name, content := range map[string]string{
+		savePath:                               code,
+		"builds/v53/foo@1.0.0/es2020/small.js": "export {}",
+		"raw/foo@1.0.0/index.js":               code,
+	} {
+		err = fs.WriteData(name, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := localFS.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{
+		savePath,
+		savePath + ".br",
+		savePath + ".gz",
+		"builds/v53/foo@1.0.0/es2020/small.js",
+		"raw/foo@1.0.0/index.js",
+	}) {
+		t.Fatalf("unexpected stored files %v", paths)
+	}
+	paths, err = fs.List("builds/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{savePath, "builds/v53/foo@1.0.0/es2020/small.js"}) {
+		t.Fatalf("the variants should not be listed: %v", paths)
+	}
+	paths = nil
+	err = storage.Walk(fs, "builds/", func(name string) bool {
+		paths = append(paths, name)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.(storage.Walker); !ok || !reflect.DeepEqual(paths, []string{savePath, "builds/v53/foo@1.0.0/es2020/small.js"}) {
+		t.Fatalf("the variants should not be walked: %v", paths)
+	}
+
+	api := &rex.APIHandler{}
+	api.Use(rex.AutoCompress(), func(ctx *rex.Context) interface{} {
+		name, r, err := readStoredFile(ctx, strings.TrimPrefix(ctx.Path.String(), "/"))
+		if err != nil {
+			return rex.Status(500, err.Error())
+		}
+		return rex.Content(name, time.Now(), r)
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	// disable the transparent decompression of the client
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, encoding := range []string{"br", "gzip", "gzip, br", ""} {
+		req, _ := http.NewRequest("GET", server.URL+"/"+savePath, nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		expected := encoding
+		if encoding == "gzip, br" {
+			expected = "br"
+		}
+		if resp.Header.Get("Content-Encoding") != expected {
+			t.Fatalf("unexpected encoding '%s' of '%s'", resp.Header.Get("Content-Encoding"), encoding)
+		}
+		if !strings.HasSuffix(strings.Split(resp.Header.Get("Content-Type"), ";")[0], "javascript") {
+			t.Fatalf("unexpected content type '%s'", resp.Header.Get("Content-Type"))
+		}
+		var data []byte
+		switch expected {
+		case "br":
+			data, err = ioutil.ReadAll(brotli.NewReader(resp.Body))
+		case "gzip":
+			gr, e := gzip.NewReader(resp.Body)
+			if e != nil {
+				t.Fatal(e)
+			}
+			data, err = ioutil.ReadAll(gr)
+		default:
+			data, err = ioutil.ReadAll(resp.Body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != code {
+			t.Fatalf("unexpected content of '%s'", encoding)
+		}
+	}
+
+	// the stale variants are deleted when the file is rewritten
+	err = fs.WriteData(savePath, []byte("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = localFS.List(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{savePath}) {
+		t.Fatalf("the stale variants should be deleted: %v", paths)
+	}
+	err = fs.WriteData(savePath, []byte(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(savePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = localFS.List("builds/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"builds/v53/foo@1.0.0/es2020/small.js"}) {
+		t.Fatalf("the variants should be deleted: %v", paths)
+	}
+}
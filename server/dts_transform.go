@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -11,11 +12,16 @@ import (
 	"github.com/ije/gox/utils"
 )
 
-func CopyDTS(wd string, resolvePrefix string, dts string) (err error) {
-	return copyDTS(wd, resolvePrefix, dts, newStringSet())
+func CopyDTS(ctx context.Context, wd string, resolvePrefix string, dts string) (err error) {
+	return copyDTS(ctx, wd, resolvePrefix, dts, newStringSet())
 }
 
-func copyDTS(wd string, resolvePrefix string, dts string, tracing *stringSet) (err error) {
+func copyDTS(ctx context.Context, wd string, resolvePrefix string, dts string, tracing *stringSet) (err error) {
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
 	// don't copy repeatly
 	if tracing.Has(resolvePrefix + dts) {
 		return
@@ -268,7 +274,7 @@ func copyDTS(wd string, resolvePrefix string, dts string, tracing *stringSet) (e
 				importDts = path.Join(path.Dir(dts), importDts)
 			}
 		}
-		err = copyDTS(wd, resolvePrefix, importDts, tracing)
+		err = copyDTS(ctx, wd, resolvePrefix, importDts, tracing)
 		if err != nil {
 			break
 		}
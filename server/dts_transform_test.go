@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -16,7 +17,13 @@ func TestCopyDTS(t *testing.T) {
 	os.RemoveAll(testDir)
 	ensureDir(testDir)
 
-	err := yarnAdd(testDir, "@types/react@17.0.0")
+	var err error
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: getNpmRegistry()}
+	err = npmInstall(context.Background(), testDir, "@types/react@17.0.0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,10 +109,6 @@ func TestCopyDTS(t *testing.T) {
 
 	cdnDomain = "cdn.esm.sh"
 
-	cache, err = storage.OpenCache("memory:main")
-	if err != nil {
-		t.Fatal(err)
-	}
 	fs, err = storage.OpenFS(fmt.Sprintf("localLRU:%s?maxCost=10mb", testDir))
 	if err != nil {
 		t.Fatal(err)
@@ -114,12 +117,8 @@ func TestCopyDTS(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	node, err = checkNode(testDir)
-	if err != nil {
-		log.Fatalf("check nodejs env: %v", err)
-	}
 
-	err = CopyDTS(testDir, "X-ESM/", "test/index.d.ts")
+	err = CopyDTS(context.Background(), testDir, "X-ESM/", "test/index.d.ts")
 	if err != nil && os.IsExist(err) {
 		t.Fatal(err)
 	}
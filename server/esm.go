@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/ije/esbuild-internal/js_ast"
@@ -22,9 +24,11 @@ type ESM struct {
 	Exports       []string `json:"exports"`
 	Dts           string   `json:"dts"`
 	PackageCSS    bool     `json:"packageCSS"`
+	Integrity     string   `json:"integrity,omitempty"`
+	Imports       []string `json:"imports,omitempty"`
 }
 
-func initESM(wd string, pkg pkg, checkExports bool, isDev bool) (esm *ESM, err error) {
+func initESM(ctx context.Context, wd string, pkg pkg, checkExports bool, isDev bool) (esm *ESM, err error) {
 	packageFile := path.Join(wd, "node_modules", pkg.name, "package.json")
 
 	var p NpmPackage
@@ -161,7 +165,7 @@ func initESM(wd string, pkg pkg, checkExports bool, isDev bool) (esm *ESM, err e
 		if isDev {
 			nodeEnv = "development"
 		}
-		ret, err := parseCJSModuleExports(wd, pkg.ImportPath(), nodeEnv)
+		ret, err := parseCJSModuleExports(ctx, wd, pkg.ImportPath(), nodeEnv)
 		if err != nil {
 			return nil, fmt.Errorf("parseCJSModuleExports: %v", err)
 		}
@@ -205,6 +209,38 @@ func findESM(id string) (esm *ESM, err error) {
 }
 
 func checkESM(wd string, packageName string, moduleSpecifier string) (resolveName string, exportDefault bool, err error) {
+	resolveName, filename := resolveESModule(wd, packageName, moduleSpecifier)
+	ast, pass, err := parseESModule(filename)
+	if err != nil {
+		return
+	}
+	if pass {
+		esm := ast.ExportsKind == js_ast.ExportsESM
+		if !esm {
+			err = errors.New("not a module")
+			return
+		}
+		_, exportDefault = ast.NamedExports["default"]
+	}
+	return
+}
+
+// getESModuleExports returns the named exports of the es module, the `complete` is false
+// if the module re-exports a package by `export * from "pkg"` that is not followed.
+func getESModuleExports(wd string, packageName string, moduleSpecifier string) (exports []string, complete bool, err error) {
+	_, filename := resolveESModule(wd, packageName, moduleSpecifier)
+	ast, pass, err := parseESModule(filename)
+	if err != nil || !pass {
+		return
+	}
+	names := newStringSet()
+	complete = collectESMExports(filename, ast, names, newStringSet())
+	exports = names.Values()
+	sort.Strings(exports)
+	return
+}
+
+func resolveESModule(wd string, packageName string, moduleSpecifier string) (resolveName string, filename string) {
 	pkgDir := path.Join(wd, "node_modules", packageName)
 	if dirExists(path.Join(pkgDir, moduleSpecifier)) {
 		f := path.Join(moduleSpecifier, "index.mjs")
@@ -213,31 +249,60 @@ func checkESM(wd string, packageName string, moduleSpecifier string) (resolveNam
 		}
 		moduleSpecifier = f
 	}
-	filename := path.Join(pkgDir, moduleSpecifier)
+	filename = path.Join(pkgDir, moduleSpecifier)
 	switch path.Ext(filename) {
 	case ".js", ".jsx", ".ts", ".tsx", ".mjs":
 	default:
 		filename += ".js"
 	}
+	return moduleSpecifier, filename
+}
+
+func parseESModule(filename string) (ast js_ast.AST, pass bool, err error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
 	}
 	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug)
-	ast, pass := js_parser.Parse(log, test.SourceForTest(string(data)), js_parser.Options{})
-	if pass {
-		esm := ast.ExportsKind == js_ast.ExportsESM
-		if !esm {
-			err = errors.New("not a module")
-			return
+	ast, pass = js_parser.Parse(log, test.SourceForTest(string(data)), js_parser.Options{})
+	return
+}
+
+// collectESMExports collects the named exports of the module, includes the
+// names of `export * from "./relative"`. It returns false if a star re-export
+// can't be followed, e.g. `export * from "pkg"`.
+func collectESMExports(filename string, ast js_ast.AST, names *stringSet, visited *stringSet) (complete bool) {
+	if visited.Has(filename) {
+		return true
+	}
+	visited.Add(filename)
+
+	for name := range ast.NamedExports {
+		if name != "default" {
+			names.Add(name)
 		}
-		for name := range ast.NamedExports {
-			if name == "default" {
-				exportDefault = true
+	}
+	complete = true
+	for _, index := range ast.ExportStarImportRecords {
+		specifier := ast.ImportRecords[index].Path.Text
+		if !strings.HasPrefix(specifier, "./") && !strings.HasPrefix(specifier, "../") {
+			complete = false
+			continue
+		}
+		followed := false
+		resolved := path.Join(path.Dir(filename), specifier)
+		for _, f := range []string{resolved, resolved + ".js", resolved + ".mjs", path.Join(resolved, "index.js"), path.Join(resolved, "index.mjs")} {
+			if fileExists(f) {
+				ast, pass, err := parseESModule(f)
+				if err == nil && pass {
+					followed = collectESMExports(f, ast, names, visited)
+				}
 				break
 			}
 		}
+		if !followed {
+			complete = false
+		}
 	}
-	resolveName = moduleSpecifier
 	return
 }
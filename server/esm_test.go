@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckESM(t *testing.T) {
+	wd := path.Join(os.TempDir(), "esmd-testing-check-esm")
+	os.RemoveAll(wd)
+	defer os.RemoveAll(wd)
+
+	pkgDir := path.Join(wd, "node_modules", "lib")
+	for filename, code := range map[string]string{
+		"index.js":      `export { default as a } from "./a.js"; export * from "./b"; export * from "dep"; export default 1;`,
+		"a.js":          `export default function a() {}`,
+		"b/index.js":    `export const b = 1; export function c() {}; export * from "../index.js"`,
+		"cjs/index.js":  `module.exports = {}`,
+		"nodefault.mjs": `export const d = 1`,
+		"local.js":      `export const e = 1; export * from "./c"; export * from "./local.js"`,
+		"c.js":          `export const f = 1`,
+		"package.json":  `{"name":"lib","version":"1.0.0"}`,
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, filename)))
+		err := ioutil.WriteFile(path.Join(pkgDir, filename), []byte(code), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolved, exportDefault, err := checkESM(wd, "lib", "index.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != "index.js" || !exportDefault {
+		t.Fatalf("unexpected resolved '%s' and exportDefault %v", resolved, exportDefault)
+	}
+
+	exports, complete, err := getESModuleExports(wd, "lib", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete || !reflect.DeepEqual(exports, []string{"a", "b", "c"}) {
+		t.Fatalf("unexpected exports [%s] and complete %v", strings.Join(exports, ","), complete)
+	}
+
+	exports, complete, err = getESModuleExports(wd, "lib", "local.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete || !reflect.DeepEqual(exports, []string{"e", "f"}) {
+		t.Fatalf("unexpected exports [%s] and complete %v", strings.Join(exports, ","), complete)
+	}
+
+	_, exportDefault, err = checkESM(wd, "lib", "nodefault.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exportDefault {
+		t.Fatalf("unexpected exportDefault %v", exportDefault)
+	}
+
+	_, _, err = checkESM(wd, "lib", "cjs")
+	if err == nil || err.Error() != "not a module" {
+		t.Fatalf("should be 'not a module' error, but %v", err)
+	}
+}
+
+func TestResolvePrefixWithExports(t *testing.T) {
+	task := &buildTask{
+		pkg:     pkg{name: "lodash-es", version: "4.17.21"},
+		deps:    pkgSlice{{name: "react", version: "17.0.2"}},
+		target:  "es2020",
+		exports: []string{"chunk", "debounce"},
+	}
+	s, err := atobUrl(strings.TrimSuffix(strings.TrimPrefix(task.resolvePrefix(), "X-"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "deps:react@17.0.2,exports:chunk,debounce" {
+		t.Fatalf("unexpected resolve prefix '%s'", s)
+	}
+	if strings.Contains(task.getImportPath(pkg{name: "lodash-es", version: "4.17.21", submodule: "chunk"}, true), task.resolvePrefix()) {
+		t.Fatal("the import path of sub-modules should not contain the `exports`")
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+const (
+	// the access times are flushed to the db in the interval
+	accessFlushInterval = time.Minute
+	// the access time is updated in the db once per the resolution
+	accessResolution = time.Hour
+	accessKeyPrefix  = "atime:"
+)
+
+var regVersionedStoragePath = regexp.MustCompile(`^(builds|types)/v(\d+)/`)
+
+// GCOptions defines the retention of the storage garbage collection
+type GCOptions struct {
+	// keep the builds of the last N build versions, 0 to keep all
+	KeepVersions int
+	// drop the files that are not accessed in the duration, 0 to keep all
+	MaxIdle time.Duration
+}
+
+// GCReport is the report of a garbage collection
+type GCReport struct {
+	StartTime time.Time `json:"startTime"`
+	Duration  float64   `json:"duration"`
+	Files     int       `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	Records   int       `json:"records"`
+	Errors    int       `json:"errors"`
+}
+
+// accessTracker records the access time of the stored files in memory, and flushes them
+// to the db in background. It's enabled by the idle gc only.
+type accessTracker struct {
+	enabled bool
+	lock    sync.Mutex
+	pending map[string]time.Time
+	flushed map[string]time.Time
+}
+
+var accessTimes = &accessTracker{
+	pending: map[string]time.Time{},
+	flushed: map[string]time.Time{},
+}
+
+// Touch records the access of the file
+func (a *accessTracker) Touch(name string) {
+	if !a.enabled {
+		return
+	}
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if t, ok := a.flushed[name]; ok && now.Sub(t) < accessResolution {
+		return
+	}
+	a.pending[name] = now
+}
+
+// Flush writes the pending access times to the db
+func (a *accessTracker) Flush() {
+	now := time.Now()
+	a.lock.Lock()
+	pending := a.pending
+	a.pending = map[string]time.Time{}
+	// the expired access times are loaded from the db when they are needed
+	for name, t := range a.flushed {
+		if now.Sub(t) >= accessResolution {
+			delete(a.flushed, name)
+		}
+	}
+	for name, t := range pending {
+		a.flushed[name] = t
+	}
+	a.lock.Unlock()
+
+	for name, t := range pending {
+		err := db.Put(accessKeyPrefix+name, storage.Store{"t": strconv.FormatInt(t.Unix(), 10)})
+		if err != nil {
+			log.Errorf("flush access time of %s: %v", name, err)
+		}
+	}
+}
+
+// Get returns the last access time of the file, or the zero time if it's unknown
+func (a *accessTracker) Get(name string) time.Time {
+	a.lock.Lock()
+	t, ok := a.pending[name]
+	if !ok {
+		t, ok = a.flushed[name]
+	}
+	a.lock.Unlock()
+	if ok {
+		return t
+	}
+
+	store, _, err := db.Get(accessKeyPrefix + name)
+	if err == nil {
+		if sec, err := strconv.ParseInt(store["t"], 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return time.Time{}
+}
+
+func (a *accessTracker) Forget(name string) {
+	a.lock.Lock()
+	delete(a.pending, name)
+	delete(a.flushed, name)
+	a.lock.Unlock()
+	db.Delete(accessKeyPrefix + name)
+}
+
+func (a *accessTracker) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		a.Flush()
+	}
+}
+
+var gcLock sync.Mutex
+var gcOptions GCOptions
+var lastGCReport *GCReport
+
+// the fs that leaves the unreferenced files, e.g. the blobs of the dedup fs
+var orphanCollector storage.OrphanCollector
+
+// runGC removes the builds of the superseded build versions and the idle files by the options.
+func runGC(options GCOptions) *GCReport {
+	gcLock.Lock()
+	defer gcLock.Unlock()
+
+	g := &gc{options: options, report: &GCReport{StartTime: time.Now()}}
+	accessTimes.Flush()
+
+	if options.KeepVersions > 0 {
+		for v := 1; v <= VERSION-options.KeepVersions; v++ {
+			for _, dir := range []string{"builds", "types"} {
+				g.walk(fmt.Sprintf("%s/v%d/", dir, v), func(name string) {
+					info, err := g.stat(name)
+					if err == nil {
+						g.deleteFiles(map[string]*storage.FileInfo{name: info})
+					}
+				})
+			}
+		}
+	}
+	if options.MaxIdle > 0 {
+		g.collectIdle()
+	}
+	if len(g.purgedBuilds) > 0 {
+		if err := unindexBuilds(g.purgedBuilds); err != nil {
+			log.Errorf("gc: unindex builds: %v", err)
+			g.report.Errors++
+		}
+	}
+	report := g.report
+	if orphanCollector != nil {
+		files, bytes, err := orphanCollector.CollectOrphans()
+		if err != nil {
+			log.Errorf("gc: collect orphans: %v", err)
+			report.Errors++
+		}
+		report.Files += files
+		report.Bytes += bytes
+	}
+
+	report.Duration = time.Now().Sub(report.StartTime).Seconds()
+	gcReclaimedBytesTotal.Add(float64(report.Bytes))
+	lastGCReport = report
+	log.Infof(
+		"gc: reclaimed %d files (%s) and %d db records in %.1fs, %d errors",
+		report.Files,
+		formatBytes(report.Bytes),
+		report.Records,
+		report.Duration,
+		report.Errors,
+	)
+	return report
+}
+
+// gc is a run of the garbage collection
+type gc struct {
+	options      GCOptions
+	report       *GCReport
+	purgedBuilds []string
+}
+
+// collectIdle removes the idle files of the kept build versions and the `raw/`. A build is
+// removed as a unit with its `.map` and `.css` when all of them are idle, and the `types/` of
+// a package version are kept while it has a build that is not idle.
+func (g *gc) collectIdle() {
+	activePkgs := map[string]bool{}
+	g.walk("builds/", func(name string) {
+		// the `.map` and `.css` files are removed with their build
+		if isSuperseded(name, g.options) || !strings.HasSuffix(name, ".js") {
+			return
+		}
+		files := map[string]*storage.FileInfo{}
+		idle := true
+		for _, filename := range []string{name, name + ".map", strings.TrimSuffix(name, ".js") + ".css"} {
+			info, err := g.stat(filename)
+			if err != nil {
+				if filename == name {
+					return
+				}
+				continue
+			}
+			files[filename] = info
+			idle = idle && isIdle(filename, info, g.options, g.report.StartTime)
+		}
+		if !idle {
+			activePkgs[storagePkgKey(name)] = true
+			return
+		}
+		g.deleteFiles(files)
+	})
+	for _, dir := range []string{"types/", "raw/"} {
+		g.walk(dir, func(name string) {
+			if isSuperseded(name, g.options) || (dir == "types/" && activePkgs[storagePkgKey(name)]) {
+				return
+			}
+			info, err := g.stat(name)
+			if err == nil && isIdle(name, info, g.options, g.report.StartTime) {
+				g.deleteFiles(map[string]*storage.FileInfo{name: info})
+			}
+		})
+	}
+}
+
+// walk calls the fn with the stored files that start with the prefix
+func (g *gc) walk(prefix string, fn func(name string)) {
+	err := storage.Walk(fs, prefix, func(name string) bool {
+		fn(name)
+		return true
+	})
+	if err != nil {
+		log.Errorf("gc: walk %s: %v", prefix, err)
+		g.report.Errors++
+	}
+}
+
+// stat returns the size and modtime of the file, the file is not read
+func (g *gc) stat(name string) (*storage.FileInfo, error) {
+	info, err := fs.Stat(name)
+	if err != nil && err != storage.ErrNotFound {
+		log.Errorf("gc: stat %s: %v", name, err)
+		g.report.Errors++
+	}
+	return info, err
+}
+
+// deleteFiles deletes the files, and the db records of the builds
+func (g *gc) deleteFiles(files map[string]*storage.FileInfo) {
+	for name, info := range files {
+		err := fs.Delete(name)
+		if err != nil {
+			log.Errorf("gc: delete %s: %v", name, err)
+			g.report.Errors++
+			continue
+		}
+		g.report.Files++
+		g.report.Bytes += info.Size
+		accessTimes.Forget(name)
+
+		if strings.HasPrefix(name, "builds/") && strings.HasSuffix(name, ".js") {
+			id := strings.TrimPrefix(name, "builds/")
+			// the builds that have no record are not counted, the `Delete` of a missing
+			// record returns nil too
+			_, _, err = db.Get(id)
+			if err == nil {
+				err = db.Delete(id)
+				if err == nil {
+					g.report.Records++
+				}
+			}
+			if err != nil && err != storage.ErrNotFound {
+				log.Errorf("gc: delete record %s: %v", id, err)
+				g.report.Errors++
+			}
+			g.purgedBuilds = append(g.purgedBuilds, id)
+		}
+	}
+}
+
+// storagePkgKey returns the build version and package of the stored file like
+// `builds/v53/react@17.0.2/es2020/react.js`, e.g. `v53/react@17.0.2`.
+func storagePkgKey(name string) string {
+	a := strings.SplitN(name, "/", 3)
+	if len(a) < 3 {
+		return ""
+	}
+	pkgName, version := splitBuildID(a[1] + "/" + a[2])
+	return fmt.Sprintf("%s/%s@%s", a[1], pkgName, version)
+}
+
+// isSuperseded checks whether the file belongs to a superseded build version
+func isSuperseded(name string, options GCOptions) bool {
+	if options.KeepVersions > 0 {
+		if m := regVersionedStoragePath.FindStringSubmatch(name); m != nil {
+			version, _ := strconv.Atoi(m[2])
+			return version <= VERSION-options.KeepVersions
+		}
+	}
+	return false
+}
+
+// isIdle checks whether the file is not accessed in the max idle duration, the modtime
+// is used if the access time is unknown
+func isIdle(name string, info *storage.FileInfo, options GCOptions, now time.Time) bool {
+	if options.MaxIdle > 0 {
+		atime := accessTimes.Get(name)
+		if atime.IsZero() || atime.Before(info.Modtime) {
+			atime = info.Modtime
+		}
+		return now.Sub(atime) > options.MaxIdle
+	}
+	return false
+}
+
+// startGC runs the garbage collection in the interval
+func startGC(options GCOptions, interval time.Duration) {
+	gcOptions = options
+	// the access times are not tracked without the idle gc
+	if options.MaxIdle > 0 {
+		accessTimes.enabled = true
+		go accessTimes.run(accessFlushInterval)
+	}
+	if options.KeepVersions <= 0 && options.MaxIdle <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			runGC(options)
+		}
+	}()
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestRunGC(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-gc")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	var err error
+	fs, err = storage.OpenFS("local:" + path.Join(testDir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	oldID := fmt.Sprintf("v%d/react@17.0.2/es2020/react.js", VERSION-2)
+	prevID := fmt.Sprintf("v%d/react@17.0.2/es2020/react.js", VERSION-1)
+	currentID := fmt.Sprintf("v%d/react@17.0.2/es2020/react.js", VERSION)
+	for _, id := range []string{oldID, prevID, currentID} {
+		err = db.Put(id, storage.Store{"esm": "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.WriteData(path.Join("builds", id), []byte("export {}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the companions of the builds, and a build that has no record
+	prevMap := path.Join("builds", prevID+".map")
+	prevCSS := path.Join("builds", strings.TrimSuffix(prevID, ".js")+".css")
+	currentMap := path.Join("builds", currentID+".map")
+	for _, name := range []string{
+		fmt.Sprintf("types/v%d/react@17.0.2/index.d.ts", VERSION-2),
+		fmt.Sprintf("types/v%d/react@17.0.2/index.d.ts", VERSION),
+		"raw/react@17.0.2/package.json",
+		prevMap,
+		prevCSS,
+		currentMap,
+		fmt.Sprintf("builds/v%d/vue@3.2.0/es2020/vue.js", VERSION-2),
+	} {
+		err = fs.WriteData(name, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := runGC(GCOptions{KeepVersions: 2})
+	if report.Files != 3 || report.Records != 1 || report.Bytes != int64(len("export {}")+len("{}")*2) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for id, kept := range map[string]bool{oldID: false, prevID: true, currentID: true} {
+		exists, _, _ := fs.Exists(path.Join("builds", id))
+		_, _, err := db.Get(id)
+		if exists != kept || (err == nil) != kept {
+			t.Fatalf("unexpected gc of %s", id)
+		}
+	}
+
+	// the files are idle except the accessed build, its `.map` and the types of the package
+	// are kept with it
+	idleTime := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{path.Join("builds", prevID), prevMap, prevCSS, path.Join("builds", currentID), currentMap, "raw/react@17.0.2/package.json", fmt.Sprintf("types/v%d/react@17.0.2/index.d.ts", VERSION)} {
+		err = os.Chtimes(path.Join(testDir, "storage", name), idleTime, idleTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	accessTimes.Touch(path.Join("builds", currentID))
+	if !accessTimes.Get(path.Join("builds", currentID)).IsZero() {
+		t.Fatal("the access times should not be tracked without the idle gc")
+	}
+	accessTimes.enabled = true
+	defer func() { accessTimes.enabled = false }()
+	accessTimes.Touch(path.Join("builds", currentID))
+	report = runGC(GCOptions{KeepVersions: 2, MaxIdle: 24 * time.Hour})
+	if report.Files != 4 || report.Records != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	paths, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{path.Join("builds", currentID), currentMap, fmt.Sprintf("types/v%d/react@17.0.2/index.d.ts", VERSION)}) {
+		t.Fatalf("unexpected files after gc %v", paths)
+	}
+	if lastGCReport != report {
+		t.Fatal("the last report should be kept")
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// ImportMap defines an import map, see https://github.com/WICG/import-maps
+type ImportMap struct {
+	Imports map[string]string            `json:"imports"`
+	Scopes  map[string]map[string]string `json:"scopes,omitempty"`
+}
+
+// importMap generates an import map for the `pkgs` query, e.g. `/importmap.json?pkgs=react@17,react-dom@17`.
+// Every package is built with the other packages as `deps`, so the shared dependencies resolve
+// to the same module.
+func importMap(ctx *rex.Context) interface{} {
+	pkgs := pkgSlice{}
+	for _, p := range strings.Split(ctx.Form.Value("pkgs"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			m, err := parsePkg(p)
+			if err != nil {
+				if strings.HasSuffix(err.Error(), "not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(400, fmt.Sprintf("Invalid pkgs query: %v", err))
+			}
+			pkgs = append(pkgs, *m)
+		}
+	}
+	if len(pkgs) == 0 {
+		return rex.Status(400, "Missing pkgs query")
+	}
+
+	// pin the requested packages and the `deps` query, the requested packages take precedence
+	pinned := pkgSlice{}
+	for _, m := range pkgs {
+		for _, p := range pinned {
+			if p.name == m.name && p.version != m.version {
+				return rex.Status(400, fmt.Sprintf("Conflicting versions of '%s': %s, %s", m.name, p.version, m.version))
+			}
+		}
+		if !pinned.Has(m.name) {
+			pinned = append(pinned, pkg{name: m.name, version: m.version})
+		}
+	}
+	for _, p := range strings.Split(ctx.Form.Value("deps"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			m, err := parsePkg(p)
+			if err != nil {
+				// the missing dependencies are ignored like the `deps` query of modules
+				if strings.HasSuffix(err.Error(), "not found") {
+					continue
+				}
+				return rex.Status(400, fmt.Sprintf("Invalid deps query: %v", err))
+			}
+			if !pinned.Has(m.name) {
+				pinned = append(pinned, pkg{name: m.name, version: m.version})
+			}
+		}
+	}
+
+	alias := map[string]string{}
+	for _, p := range strings.Split(ctx.Form.Value("alias"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			name, to := utils.SplitByFirstByte(p, ':')
+			name = strings.TrimSpace(name)
+			to = strings.TrimSpace(to)
+			if name != "" && to != "" {
+				alias[name] = to
+			}
+		}
+	}
+
+	target := getBuildTarget(ctx)
+	isDev := !ctx.Form.IsNil("dev")
+	sourcemap := !ctx.Form.IsNil("sourcemap")
+	origin := getOrigin()
+	buildsScope := fmt.Sprintf("%sv%d/", origin, VERSION)
+
+	im := ImportMap{
+		Imports: map[string]string{},
+		Scopes:  map[string]map[string]string{buildsScope: {}},
+	}
+	for _, m := range pkgs {
+		deps := pkgSlice{}
+		for _, p := range pinned {
+			if p.name != m.name {
+				deps = append(deps, p)
+			}
+		}
+		task := &buildTask{
+			stage:     "init",
+			pkg:       m,
+			deps:      deps,
+			alias:     alias,
+			target:    target,
+			isDev:     isDev,
+			sourcemap: sourcemap,
+		}
+		url := origin + task.ID()
+		im.Imports[m.ImportPath()] = url
+
+		// other builds import the pinned packages without the resolve prefix,
+		// redirect them to the build with deps
+		if key := origin + strings.TrimPrefix(task.getImportPath(m, false), "/"); key != url {
+			im.Scopes[buildsScope][key] = url
+		}
+
+		// warm up the build, the module is built on demand anyway
+		if _, err := findESM(task.ID()); err != nil {
+			buildQueue.Add(task, PriorityBackground)
+		}
+	}
+
+	if len(im.Scopes[buildsScope]) == 0 {
+		im.Scopes = nil
+	}
+
+	ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", refreshDuration))
+	ctx.SetHeader("Content-Type", "application/importmap+json; charset=utf-8")
+	return utils.MustEncodeJSON(im)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/rex"
+)
+
+func TestImportMap(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-importmap")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	var err error
+	cache, err = storage.OpenCache("memory:importmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err = storage.OpenFS("local:" + path.Join(testDir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	node = &Node{npmRegistry: registry.URL + "/"}
+	npmCacheDir = path.Join(testDir, "cache")
+	defer func(domain string) { cdnDomain = domain }(cdnDomain)
+	cdnDomain = ""
+
+	// the builds are queued but never run
+	defer func(q *BuildQueue) { buildQueue = q }(buildQueue)
+	buildQueue = newBuildQueue(0)
+
+	registry.publish("react", "16.14.0", nil, map[string]string{"index.js": ""})
+	registry.publish("react", "17.0.2", nil, map[string]string{"index.js": ""})
+	registry.publish("react-dom", "17.0.2", map[string]string{"react": "17.0.2"}, map[string]string{"index.js": ""})
+
+	api := &rex.APIHandler{}
+	api.Use(importMap)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	get := func(query string) (int, []byte) {
+		resp, err := http.Get(server.URL + "/importmap.json?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+
+	status, data := get("pkgs=react@17,react-dom@17&deps=missing@1&target=es2020")
+	if status != 200 {
+		t.Fatalf("unexpected status %d: %s", status, data)
+	}
+	var im ImportMap
+	err = json.Unmarshal(data, &im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	react := pkg{name: "react", version: "17.0.2"}
+	reactDOM := pkg{name: "react-dom", version: "17.0.2"}
+	reactURL := "/" + (&buildTask{pkg: react, deps: pkgSlice{reactDOM}, target: "es2020"}).ID()
+	reactDOMURL := "/" + (&buildTask{pkg: reactDOM, deps: pkgSlice{react}, target: "es2020"}).ID()
+	expected := ImportMap{
+		Imports: map[string]string{
+			"react":     reactURL,
+			"react-dom": reactDOMURL,
+		},
+		Scopes: map[string]map[string]string{
+			fmt.Sprintf("/v%d/", VERSION): {
+				fmt.Sprintf("/v%d/react@17.0.2/es2020/react.js", VERSION):         reactURL,
+				fmt.Sprintf("/v%d/react-dom@17.0.2/es2020/react-dom.js", VERSION): reactDOMURL,
+			},
+		},
+	}
+	if !reflect.DeepEqual(im, expected) {
+		t.Fatalf("unexpected import map %s", data)
+	}
+	if buildQueue.Len() != 2 {
+		t.Fatalf("the builds should be queued, but %d", buildQueue.Len())
+	}
+
+	for query, expected := range map[string]int{
+		"":                                 400,
+		"pkgs=missing":                     404,
+		"pkgs=react@17,react@16":           400,
+		"pkgs=react@15":                    404,
+		"pkgs=react@17.0.2,react@17":       200,
+		"pkgs=react&deps=Invalid%20Name@1": 400,
+	} {
+		status, data := get(query)
+		if status != expected {
+			t.Fatalf("unexpected status %d of '%s': %s", status, query, data)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/rex"
+)
+
+// computeIntegrity returns the sha384 digest of the data in SRI format,
+// see https://www.w3.org/TR/SRI/
+func computeIntegrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// getBuildIntegrity returns the integrity and the build imports of a build by the id,
+// e.g. `v50/react@17.0.2/es2020/react.js`
+func getBuildIntegrity(id string) (integrity string, imports []string, err error) {
+	// embedded polyfills like `/v50/node_process.js`
+	if a := strings.Split(id, "/"); len(a) == 2 && a[0] == fmt.Sprintf("v%d", VERSION) {
+		data, e := embedFS.ReadFile("embed/polyfills/" + a[1])
+		if e == nil {
+			integrity = computeIntegrity(data)
+			return
+		}
+	}
+
+	esm, err := findESM(id)
+	if err != nil {
+		return
+	}
+	integrity = esm.Integrity
+	imports = esm.Imports
+
+	// the records of previous builds have no integrity
+	if integrity == "" {
+		r, e := fs.ReadFile(path.Join("builds", id))
+		if e != nil {
+			err = e
+			return
+		}
+		defer r.Close()
+		data, e := ioutil.ReadAll(r)
+		if e != nil {
+			err = e
+			return
+		}
+		integrity = computeIntegrity(data)
+	}
+	return
+}
+
+// integrityManifest lists the integrity of the build and all of its transitive build imports,
+// the manifest is compatible with the `integrity` field of import maps.
+func integrityManifest(ctx *rex.Context, id string) interface{} {
+	integrity, err := getIntegrityManifest(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return rex.Status(404, "Build not found, it may be in building, please try later")
+		}
+		return rex.Status(500, err.Error())
+	}
+
+	ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+	return map[string]interface{}{
+		"integrity": integrity,
+	}
+}
+
+func getIntegrityManifest(id string) (map[string]string, error) {
+	origin := getOrigin()
+	integrity := map[string]string{}
+	queue := []string{id}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		url := origin + id
+		if _, ok := integrity[url]; ok {
+			continue
+		}
+		value, imports, err := getBuildIntegrity(id)
+		if err != nil {
+			return nil, err
+		}
+		integrity[url] = value
+		for _, importPath := range imports {
+			queue = append(queue, strings.TrimPrefix(importPath, "/"))
+		}
+	}
+	return integrity, nil
+}
+
+// setIntegrityHeader sets the `X-Integrity` header of the response
+func setIntegrityHeader(ctx *rex.Context, integrity string) {
+	if integrity != "" {
+		ctx.SetHeader("X-Integrity", integrity)
+		ctx.AddHeader("Access-Control-Expose-Headers", "X-Integrity")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+)
+
+func TestIntegrityManifest(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-integrity")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	var err error
+	fs, err = storage.OpenFS("local:" + path.Join(testDir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if s := computeIntegrity(nil); s != "sha384-OLBgp1GsljhM2TJ+sbHjaiH9txEUvgdDTAzHv2P24donTt6/529l+9Ua0vFImLlb" {
+		t.Fatalf("unexpected integrity '%s'", s)
+	}
+
+	a := fmt.Sprintf("v%d/a@1.0.0/es2020/a.js", VERSION)
+	b := fmt.Sprintf("v%d/b@1.0.0/es2020/b.js", VERSION)
+	builds := map[string]string{
+		a: fmt.Sprintf(`import "/%s";`, b),
+		b: fmt.Sprintf(`import "/%s";`, a),
+	}
+	for id, code := range builds {
+		err = fs.WriteData(path.Join("builds", id), []byte(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		esm := &ESM{NpmPackage: &NpmPackage{}}
+		// the record of `b` has no integrity like the previous builds
+		if id == a {
+			esm.Integrity = computeIntegrity([]byte(code))
+			esm.Imports = []string{"/" + b}
+		} else {
+			esm.Imports = []string{"/" + a}
+		}
+		err = db.Put(id, storage.Store{"esm": string(utils.MustEncodeJSON(esm))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	integrity, err := getIntegrityManifest(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(integrity) != 2 {
+		t.Fatalf("unexpected manifest %v", integrity)
+	}
+	for id, code := range builds {
+		if integrity["/"+id] != computeIntegrity([]byte(code)) {
+			t.Fatalf("unexpected integrity of '%s': %s", id, integrity["/"+id])
+		}
+	}
+
+	_, err = getIntegrityManifest(fmt.Sprintf("v%d/c@1.0.0/es2020/c.js", VERSION))
+	if err != storage.ErrNotFound {
+		t.Fatalf("should be not found error, but %v", err)
+	}
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// the histogram buckets in seconds
+var (
+	latencyBuckets  = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 900}
+)
+
+var (
+	buildsTotal = newCounterVec(
+		"esmd_builds_total",
+		"The number of the finished builds.",
+		"target", "result",
+	)
+	buildFailuresTotal = newCounterVec(
+		"esmd_build_failures_total",
+		"The number of the failed builds by the stage.",
+		"stage", "target",
+	)
+	buildDuration = newHistogramVec(
+		"esmd_build_duration_seconds",
+		"The duration of the builds.",
+		durationBuckets,
+		"target",
+	)
+	buildStageDuration = newHistogramVec(
+		"esmd_build_stage_duration_seconds",
+		"The duration of the build stages.",
+		durationBuckets,
+		"stage", "target",
+	)
+	buildQueueTasks = newGaugeFunc(
+		"esmd_build_queue_tasks",
+		"The number of the tasks in the build queue.",
+		"state",
+		func() map[string]float64 {
+			buildQueue.lock.RLock()
+			defer buildQueue.lock.RUnlock()
+			running := len(buildQueue.processes)
+			return map[string]float64{
+				"queued":  float64(buildQueue.list.Len() - running),
+				"running": float64(running),
+			}
+		},
+	)
+	buildQueueWait = newHistogramVec(
+		"esmd_build_queue_wait_seconds",
+		"The wait time of the tasks in the build queue.",
+		durationBuckets,
+		"priority",
+	)
+	npmInstallDuration = newHistogramVec(
+		"esmd_npm_install_duration_seconds",
+		"The duration of the npm installs.",
+		durationBuckets,
+		"result",
+	)
+	npmRegistryFetchDuration = newHistogramVec(
+		"esmd_npm_registry_fetch_duration_seconds",
+		"The latency of the npm registry fetches.",
+		latencyBuckets,
+		"result",
+	)
+	cacheRequestsTotal = newCounterVec(
+		"esmd_cache_requests_total",
+		"The number of the cache reads.",
+		"result",
+	)
+	fsReadBytesTotal = newCounterVec(
+		"esmd_fs_read_bytes_total",
+		"The bytes read from the file system.",
+		"driver",
+	)
+	fsWriteBytesTotal = newCounterVec(
+		"esmd_fs_write_bytes_total",
+		"The bytes written to the file system.",
+		"driver",
+	)
+	gcReclaimedBytesTotal = newCounterVec(
+		"esmd_gc_reclaimed_bytes_total",
+		"The bytes reclaimed by the storage garbage collection.",
+	)
+	httpResponsesTotal = newCounterVec(
+		"esmd_http_responses_total",
+		"The number of the http responses by the route class.",
+		"route", "code",
+	)
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+func register(m metric) {
+	metrics = append(metrics, m)
+}
+
+// metricsHandle returns the handle of the `/metrics`, the requests must have the
+// `Authorization: Bearer <token>` header if the token is not empty.
+func metricsHandle(token string) rex.Handle {
+	return func(ctx *rex.Context) interface{} {
+		if ctx.Path.String() != "/metrics" {
+			return nil
+		}
+		if token != "" && !checkBearerToken(ctx, token) {
+			return rex.Status(http.StatusUnauthorized, "unauthorized")
+		}
+		buf := bytes.NewBuffer(nil)
+		writeMetrics(buf)
+		ctx.SetHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ctx.SetHeader("Cache-Control", "no-cache")
+		return buf.Bytes()
+	}
+}
+
+// writeMetrics writes the metrics in the prometheus text format
+func writeMetrics(w io.Writer) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type counterVec struct {
+	lock   sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	register(c)
+	return c
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince observes the duration since the start time in seconds
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Now().Sub(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// gaugeFunc is a gauge that is computed when the metrics are collected
+type gaugeFunc struct {
+	name  string
+	help  string
+	label string
+	fn    func() map[string]float64
+}
+
+func newGaugeFunc(name string, help string, label string, fn func() map[string]float64) *gaugeFunc {
+	g := &gaugeFunc{
+		name:  name,
+		help:  help,
+		label: label,
+		fn:    fn,
+	}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := map[string]float64{}
+	for value, v := range g.fn() {
+		values[formatLabels([]string{g.label}, []string{value})] = v
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, key, formatFloat(values[key]))
+	}
+}
+
+func formatLabels(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	buf := bytes.NewBufferString("{")
+	for i, label := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(buf, `%s="%s"`, label, escapeLabelValue(value))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func withLabel(labels string, label string, value string) string {
+	if labels == "" {
+		return fmt.Sprintf(`{%s="%s"}`, label, value)
+	}
+	return fmt.Sprintf(`%s,%s="%s"}`, strings.TrimSuffix(labels, "}"), label, value)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricResult returns the `result` label of the error
+func metricResult(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// routeClass returns the class of the request path for the http metrics
+func routeClass(pathname string) string {
+	switch {
+	case pathname == "/" || pathname == "/status.json" || pathname == "/metrics" || pathname == "/importmap.json" || pathname == "/error.js":
+		return "other"
+	case strings.HasPrefix(pathname, "/embed/") || strings.HasPrefix(pathname, "/favicon.") || strings.HasPrefix(pathname, "/_admin/"):
+		return "other"
+	case regBuildVersionPath.MatchString(pathname):
+		if strings.HasSuffix(pathname, ".d.ts") {
+			return "types"
+		}
+		return "builds"
+	case len(strings.Split(pathname, "/")) > 2 && path.Ext(pathname) != "" && path.Ext(pathname) != ".js":
+		return "raw"
+	}
+	return "entry"
+}
+
+// metricsHandler records the status codes of the responses by the route class
+type metricsHandler struct {
+	http.Handler
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mw := &metricsResponseWriter{ResponseWriter: w}
+	h.Handler.ServeHTTP(mw, r)
+	if mw.status == 0 {
+		// nothing is written
+		mw.status = 200
+	}
+	httpResponsesTotal.Inc(routeClass(utils.CleanPath(r.URL.Path)), strconv.Itoa(mw.status))
+}
+
+// metricsResponseWriter records the status code of the response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends the buffered data to the client.
+func (w *metricsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection.
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not implement the http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+// metricsFS records the read and written bytes of a `storage.FS`
+type metricsFS struct {
+	storage.FS
+	driver string
+}
+
+// newMetricsFS returns the metricsFS of the fs, it's a `storage.Walker` if the fs is.
+func newMetricsFS(fs storage.FS, driver string) storage.FS {
+	m := &metricsFS{fs, driver}
+	if _, ok := fs.(storage.Walker); ok {
+		return &metricsWalkerFS{m}
+	}
+	return m
+}
+
+// metricsWalkerFS is the metricsFS of a `storage.Walker`
+type metricsWalkerFS struct {
+	*metricsFS
+}
+
+func (fs *metricsWalkerFS) Walk(prefix string, fn func(name string, size int64) bool) error {
+	return fs.FS.(storage.Walker).Walk(prefix, fn)
+}
+
+func (fs *metricsFS) ReadFile(path string) (content io.ReadSeekCloser, err error) {
+	content, err = fs.FS.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return &metricsReader{content, fs.driver}, nil
+}
+
+func (fs *metricsFS) WriteFile(path string, r io.Reader) (written int64, err error) {
+	written, err = fs.FS.WriteFile(path, r)
+	fsWriteBytesTotal.Add(float64(written), fs.driver)
+	return
+}
+
+func (fs *metricsFS) WriteData(path string, data []byte) (err error) {
+	err = fs.FS.WriteData(path, data)
+	if err == nil {
+		fsWriteBytesTotal.Add(float64(len(data)), fs.driver)
+	}
+	return
+}
+
+type metricsReader struct {
+	io.ReadSeekCloser
+	driver string
+}
+
+func (r *metricsReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadSeekCloser.Read(p)
+	if n > 0 {
+		fsReadBytesTotal.Add(float64(n), r.driver)
+	}
+	return
+}
+
+// metricsCache records the hits and misses of a `storage.Cache`
+type metricsCache struct {
+	storage.Cache
+}
+
+func (c *metricsCache) Get(key string) (value []byte, err error) {
+	value, err = c.Cache.Get(key)
+	if err == nil {
+		cacheRequestsTotal.Inc("hit")
+	} else if err == storage.ErrNotFound || err == storage.ErrExpired {
+		cacheRequestsTotal.Inc("miss")
+	}
+	return
+}
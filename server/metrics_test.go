@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ije/rex"
+)
+
+func TestMetrics(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Test.", labels: []string{"route", "code"}, values: map[string]float64{}}
+	c.Inc("builds", "200")
+	c.Inc("builds", "200")
+	c.Add(3, "raw", "404")
+	h := &histogramVec{name: "test_seconds", help: "Test.", labels: []string{"target"}, buckets: []float64{1, 5}, values: map[string]*histogram{}}
+	h.Observe(0.5, "es2020")
+	h.Observe(2, "es2020")
+	h.Observe(10, "es2020")
+
+	buf := bytes.NewBuffer(nil)
+	c.write(buf)
+	h.write(buf)
+	expected := strings.Join([]string{
+		`# HELP test_total Test.`,
+		`# TYPE test_total counter`,
+		`test_total{route="builds",code="200"} 2`,
+		`test_total{route="raw",code="404"} 3`,
+		`# HELP test_seconds Test.`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{target="es2020",le="1"} 1`,
+		`test_seconds_bucket{target="es2020",le="5"} 2`,
+		`test_seconds_bucket{target="es2020",le="+Inf"} 3`,
+		`test_seconds_sum{target="es2020"} 12.5`,
+		`test_seconds_count{target="es2020"} 3`,
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s", buf.String())
+	}
+
+	for pathname, class := range map[string]string{
+		"/":                                   "other",
+		"/metrics":                            "other",
+		"/react@17.0.2":                       "entry",
+		"/react@17.0.2/jsx-runtime":           "entry",
+		"/v53/react@17.0.2/es2020/react.js":   "builds",
+		"/v53/react@17.0.2/index.d.ts":        "types",
+		"/bootstrap@5.1.0/dist/bootstrap.css": "raw",
+	} {
+		if c := routeClass(pathname); c != class {
+			t.Fatalf("the class of '%s' should be '%s', but '%s'", pathname, class, c)
+		}
+	}
+
+	api := &rex.APIHandler{}
+	api.Use(rex.AutoCompress(), func(ctx *rex.Context) interface{} {
+		switch ctx.Path.String() {
+		case "/v53/react@17.0.2/es2020/react.js":
+			return strings.Repeat("export default 1;", 100)
+		case "/react@17.0.2":
+			return rex.Redirect("/v53/react@17.0.2/es2020/react.js", 302)
+		case "/react@17.0.2/missing.css":
+			return rex.Status(404, "not found")
+		}
+		return errors.New("error")
+	})
+	server := httptest.NewServer(&metricsHandler{api})
+	defer server.Close()
+
+	client := &http.Client{
+		// keep the compressed body and the redirects
+		Transport:     &http.Transport{DisableCompression: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for pathname, labels := range map[string]string{
+		"/v53/react@17.0.2/es2020/react.js": `{route="builds",code="200"}`,
+		"/react@17.0.2":                     `{route="entry",code="302"}`,
+		"/react@17.0.2/missing.css":         `{route="raw",code="404"}`,
+		"/status.json":                      `{route="other",code="500"}`,
+	} {
+		req, _ := http.NewRequest("GET", server.URL+pathname, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if pathname == "/v53/react@17.0.2/es2020/react.js" && resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatal("the response should be compressed")
+		}
+		httpResponsesTotal.lock.Lock()
+		v := httpResponsesTotal.values[labels]
+		httpResponsesTotal.lock.Unlock()
+		if v != 1 {
+			t.Fatalf("the response of '%s' should be recorded as %s, but %v", pathname, labels, v)
+		}
+	}
+
+	// the handlers can flush the response through the writer
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = &metricsResponseWriter{ResponseWriter: rec}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("the response writer should be a http.Flusher")
+	}
+	flusher.Flush()
+	if !rec.Flushed {
+		t.Fatal("the response should be flushed")
+	}
+
+	// the metrics are served without the admin token, the metrics token is optional
+	for token, cases := range map[string]map[string]int{
+		"":        {"": 200, "Bearer wrong": 200},
+		"metrics": {"": 401, "Bearer wrong": 401, "Bearer metrics": 200},
+	} {
+		metricsAPI := &rex.APIHandler{}
+		metricsAPI.Use(metricsHandle(token), admin("secret"))
+		metricsServer := httptest.NewServer(metricsAPI)
+		for auth, status := range cases {
+			req, _ := http.NewRequest("GET", metricsServer.URL+"/metrics", nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Fatalf("the status of '%s' with the token '%s' should be %d, but %d", auth, token, status, resp.StatusCode)
+			}
+		}
+		metricsServer.Close()
+	}
+}
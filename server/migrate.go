@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+// log the progress of a migration every N items
+const migrateProgressInterval = 1000
+
+// MigrateReport is the report of a storage migration
+type MigrateReport struct {
+	Copied  int64
+	Skipped int64
+	Failed  int64
+	Bytes   int64
+}
+
+func (r *MigrateReport) String() string {
+	return fmt.Sprintf("%d copied (%s), %d skipped, %d failed", r.Copied, formatBytes(r.Bytes), r.Skipped, r.Failed)
+}
+
+// Migrate runs the `esmd migrate` command that copies the files and db records between
+// the storages, the items that are identical in the destination are skipped, so an
+// interrupted migration can be resumed by running the command again.
+func Migrate(args []string) {
+	var (
+		fromFS  string
+		toFS    string
+		fromDB  string
+		toDB    string
+		workers int
+	)
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&fromFS, "from-fs", "", "the source file system connection Url")
+	flags.StringVar(&toFS, "to-fs", "", "the destination file system connection Url")
+	flags.StringVar(&fromDB, "from-db", "", "the source database connection Url")
+	flags.StringVar(&toDB, "to-db", "", "the destination database connection Url")
+	flags.IntVar(&workers, "workers", 8, "the number of the concurrent copies")
+	flags.Parse(args)
+
+	if (fromFS == "") != (toFS == "") || (fromDB == "") != (toDB == "") || (fromFS == "" && fromDB == "") {
+		fmt.Println("usage: esmd migrate [--from-fs URL --to-fs URL] [--from-db URL --to-db URL] [--workers N]")
+		os.Exit(2)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	failed := false
+	if fromFS != "" {
+		if fromFS == toFS {
+			log.Fatal("migrate fs: the source and destination are the same")
+		}
+		src, err := storage.OpenFS(fromFS)
+		if err != nil {
+			log.Fatalf("init storage(fs,%s): %v", storage.RedactConfigUrl(fromFS), err)
+		}
+		dst, err := storage.OpenFS(toFS)
+		if err != nil {
+			log.Fatalf("init storage(fs,%s): %v", storage.RedactConfigUrl(toFS), err)
+		}
+		start := time.Now()
+		report, err := migrateFS(src, dst, workers)
+		if err != nil {
+			log.Fatalf("migrate fs: %v", err)
+		}
+		// the `tiered` fs with `write=back` flushes the copies when it's closed
+		for _, fs := range []storage.FS{src, dst} {
+			if closer, ok := fs.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					log.Errorf("migrate fs: %v", err)
+					failed = true
+				}
+			}
+		}
+		log.Infof("migrate fs: %s in %v", report, time.Since(start))
+		failed = failed || report.Failed > 0
+	}
+	if fromDB != "" {
+		if fromDB == toDB {
+			log.Fatal("migrate db: the source and destination are the same")
+		}
+		src, err := storage.OpenDB(fromDB)
+		if err != nil {
+			log.Fatalf("init storage(db,%s): %v", storage.RedactConfigUrl(fromDB), err)
+		}
+		defer src.Close()
+		dst, err := storage.OpenDB(toDB)
+		if err != nil {
+			log.Fatalf("init storage(db,%s): %v", storage.RedactConfigUrl(toDB), err)
+		}
+		defer dst.Close()
+		start := time.Now()
+		report, err := migrateDB(src, dst, workers)
+		if err != nil {
+			log.Fatalf("migrate db: %v", err)
+		}
+		log.Infof("migrate db: %s in %v", report, time.Since(start))
+		failed = failed || report.Failed > 0
+	}
+	log.FlushBuffer()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// migrateFS copies the files of the src to the dst, and verifies the checksums of the copies.
+// The paths are streamed to the workers, they are not loaded into memory if the src is a
+// `storage.Walker`.
+func migrateFS(src storage.FS, dst storage.FS, workers int) (*MigrateReport, error) {
+	report := &MigrateReport{}
+	err := runMigrateWorkers(workers, "fs", func(run func(job func())) error {
+		return storage.Walk(src, "", func(name string) bool {
+			run(func() {
+				skipped, n, err := migrateFile(src, dst, name)
+				if err != nil {
+					log.Errorf("migrate %s: %v", name, err)
+					atomic.AddInt64(&report.Failed, 1)
+				} else if skipped {
+					atomic.AddInt64(&report.Skipped, 1)
+				} else {
+					atomic.AddInt64(&report.Copied, 1)
+					atomic.AddInt64(&report.Bytes, n)
+				}
+			})
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// migrateFile copies the file unless the dst has the same size and stored hash, the files
+// without the stored hash are always copied.
+func migrateFile(src storage.FS, dst storage.FS, name string) (skipped bool, n int64, err error) {
+	info, err := src.Stat(name)
+	if err != nil {
+		return
+	}
+	if dstInfo, err := dst.Stat(name); err == nil && dstInfo.Size == info.Size && info.Hash != "" && dstInfo.Hash == info.Hash {
+		return true, 0, nil
+	}
+
+	r, err := src.ReadFile(name)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err = dst.WriteFile(name, io.TeeReader(r, hash))
+	if err != nil {
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if info.Hash != "" && sum != info.Hash {
+		err = fmt.Errorf("source checksum mismatch: %s != %s", sum, info.Hash)
+		return
+	}
+	dstInfo, err := dst.Stat(name)
+	if err != nil {
+		return
+	}
+	if dstInfo.Size != n {
+		err = fmt.Errorf("destination size mismatch: %d != %d", dstInfo.Size, n)
+	} else if dstInfo.Hash != "" && dstInfo.Hash != sum {
+		err = fmt.Errorf("destination checksum mismatch: %s != %s", dstInfo.Hash, sum)
+	}
+	return
+}
+
+// migrateDB copies the records of the src to the dst, the records are streamed to the workers
+// by the scan. The different records of the dst are replaced.
+func migrateDB(src storage.DB, dst storage.DB, workers int) (*MigrateReport, error) {
+	report := &MigrateReport{}
+	err := runMigrateWorkers(workers, "db", func(run func(job func())) error {
+		return src.Scan("", func(id string, store storage.Store) bool {
+			run(func() {
+				if current, _, err := dst.Get(id); err == nil && reflect.DeepEqual(current, store) {
+					atomic.AddInt64(&report.Skipped, 1)
+					return
+				}
+				// `Put` merges the keys, the record is replaced to be an exact copy
+				err := dst.Update(func(tx storage.DBTx) error {
+					err := tx.Delete(id)
+					if err != nil {
+						return err
+					}
+					return tx.Put(id, store)
+				})
+				if err != nil {
+					log.Errorf("migrate record %s: %v", id, err)
+					atomic.AddInt64(&report.Failed, 1)
+					return
+				}
+				atomic.AddInt64(&report.Copied, 1)
+			})
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// runMigrateWorkers runs the jobs that are sent by the walk in the workers, the walk is
+// blocked until a worker is free.
+func runMigrateWorkers(workers int, name string, walk func(run func(job func())) error) error {
+	var wg sync.WaitGroup
+	var done int64
+	c := make(chan func())
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range c {
+				job()
+				if d := atomic.AddInt64(&done, 1); d%migrateProgressInterval == 0 {
+					log.Infof("migrate %s: %d done", name, d)
+				}
+			}
+		}()
+	}
+	err := walk(func(job func()) {
+		c <- job
+	})
+	close(c)
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"esm.sh/server/storage"
+)
+
+func TestMigrate(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-migrate")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+
+	srcFS, err := storage.OpenFS("local:" + path.Join(testDir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstFS, err := storage.OpenFS("local:" + path.Join(testDir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDB, err := storage.OpenDB("postdb:" + path.Join(testDir, "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcDB.Close()
+	dstDB, err := storage.OpenDB("bolt:" + path.Join(testDir, "b.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dstDB.Close()
+
+	files := map[string]string{
+		"builds/v53/react@17.0.2/es2020/react.js": "export default React",
+		"types/v53/react@17.0.2/index.d.ts":       "export {}",
+		"raw/react@17.0.2/package.json":           `{"name":"react"}`,
+	}
+	for name, content := range files {
+		err = srcFS.WriteData(name, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = srcDB.Put(name, storage.Store{"content": content})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := migrateFS(srcFS, dstFS, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 3 || report.Failed != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	report, err = migrateDB(srcDB, dstDB, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 3 || report.Failed != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	for name, content := range files {
+		r, err := dstFS.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != content {
+			t.Fatalf("unexpected content of %s: %s", name, data)
+		}
+		store, _, err := dstDB.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(store, storage.Store{"content": content}) {
+			t.Fatalf("unexpected record of %s: %v", name, store)
+		}
+	}
+
+	// resume after the destination file is changed
+	err = dstFS.WriteData("raw/react@17.0.2/package.json", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = migrateFS(srcFS, dstFS, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 1 || report.Skipped != 2 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	// the extra keys of the destination record are removed, and the rerun settles
+	err = dstDB.Put("raw/react@17.0.2/package.json", storage.Store{"extra": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = migrateDB(srcDB, dstDB, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 1 || report.Skipped != 2 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	store, _, err := dstDB.Get("raw/react@17.0.2/package.json")
+	if err != nil || !reflect.DeepEqual(store, storage.Store{"content": `{"name":"react"}`}) {
+		t.Fatalf("the record should be replaced, but %v %v", store, err)
+	}
+	report, err = migrateDB(srcDB, dstDB, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 0 || report.Skipped != 3 {
+		t.Fatalf("unexpected report %s", report)
+	}
+}
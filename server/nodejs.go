@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,7 +12,6 @@ import (
 	"os/exec"
 	"path"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -131,16 +131,25 @@ type NpmPackageRecords struct {
 
 // NpmPackage defines the package.json of npm
 type NpmPackage struct {
-	Name             string            `json:"name"`
-	Version          string            `json:"version"`
-	Main             string            `json:"main,omitempty"`
-	Module           string            `json:"module,omitempty"`
-	Type             string            `json:"type,omitempty"`
-	Types            string            `json:"types,omitempty"`
-	Typings          string            `json:"typings,omitempty"`
-	Dependencies     map[string]string `json:"dependencies,omitempty"`
-	PeerDependencies map[string]string `json:"peerDependencies,omitempty"`
-	DefinedExports   interface{}       `json:"exports,omitempty"`
+	Name                 string            `json:"name"`
+	Version              string            `json:"version"`
+	Main                 string            `json:"main,omitempty"`
+	Module               string            `json:"module,omitempty"`
+	Type                 string            `json:"type,omitempty"`
+	Types                string            `json:"types,omitempty"`
+	Typings              string            `json:"typings,omitempty"`
+	Dependencies         map[string]string `json:"dependencies,omitempty"`
+	PeerDependencies     map[string]string `json:"peerDependencies,omitempty"`
+	OptionalDependencies map[string]string `json:"optionalDependencies,omitempty"`
+	DefinedExports       interface{}       `json:"exports,omitempty"`
+	Dist                 *NpmPackageDist   `json:"dist,omitempty"`
+}
+
+// NpmPackageDist defines the tarball info of a npm package
+type NpmPackageDist struct {
+	Tarball   string `json:"tarball"`
+	Shasum    string `json:"shasum,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
 }
 
 // Node defines the nodejs info
@@ -181,28 +190,21 @@ CheckNodejs:
 
 	node = &Node{
 		version:     version,
-		npmRegistry: "https://registry.npmjs.org/",
+		npmRegistry: getNpmRegistry(),
 	}
+	return
+}
 
+// getNpmRegistry returns the npm registry from the `NPM_REGISTRY` env or the npm config
+func getNpmRegistry() string {
+	if registry := os.Getenv("NPM_REGISTRY"); registry != "" {
+		return strings.TrimRight(registry, "/") + "/"
+	}
 	output, err := exec.Command("npm", "config", "get", "registry").CombinedOutput()
 	if err == nil {
-		node.npmRegistry = strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
-	}
-
-CheckYarn:
-	output, err = exec.Command("yarn", "-v").CombinedOutput()
-	if err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			output, err = exec.Command("npm", "install", "yarn", "-g").CombinedOutput()
-			if err != nil {
-				err = errors.New("install yarn: " + strings.TrimSpace(string(output)))
-				return
-			}
-			goto CheckYarn
-		}
-		err = errors.New("bad yarn version")
+		return strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
 	}
-	return
+	return "https://registry.npmjs.org/"
 }
 
 func getPackageInfo(wd string, name string, version string) (info NpmPackage, submodule string, formPackageJSON bool, err error) {
@@ -255,7 +257,55 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackage, su
 
 func cachePackageInfo(name string, version string) (info NpmPackage, err error) {
 	start := time.Now()
-	resp, err := httpClient.Get(node.npmRegistry + name)
+	h, err := fetchPackageRecords(context.Background(), name)
+	if err != nil {
+		return
+	}
+
+	info, ok := resolvePackageVersion(h, version)
+	if !ok {
+		err = fmt.Errorf("npm: version '%s' not found", version)
+		return
+	}
+
+	log.Debugf("get npm package(%s@%s) info from %s in %v", name, info.Version, node.npmRegistry, time.Now().Sub(start))
+
+	isFullVersion := regFullVersion.MatchString(version)
+
+	// cache data
+	var ttl time.Duration = 0
+	if !isFullVersion {
+		ttl = refreshDuration * time.Second
+	}
+	cache.Set(
+		fmt.Sprintf("npm:%s@%s", name, version),
+		utils.MustEncodeJSON(info),
+		ttl,
+	)
+	return
+}
+
+// fetchPackageRecords fetches the version records of a package from the npm registry,
+// the records are cached for the `refreshDuration`.
+func fetchPackageRecords(ctx context.Context, name string) (h *NpmPackageRecords, err error) {
+	cacheKey := "npm-records:" + name
+	if data, e := cache.Get(cacheKey); e == nil {
+		h = &NpmPackageRecords{}
+		if json.Unmarshal(data, h) == nil {
+			return
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		npmRegistryFetchDuration.ObserveSince(start, metricResult(err))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", node.npmRegistry+name, nil)
+	if err != nil {
+		return
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return
 	}
@@ -279,86 +329,66 @@ func cachePackageInfo(name string, version string) (info NpmPackage, err error)
 		return
 	}
 
-	var h NpmPackageRecords
-	err = json.Unmarshal(data, &h)
-	if err != nil {
+	h = &NpmPackageRecords{}
+	err = json.Unmarshal(data, h)
+	if err == nil {
+		// cache the parsed records only, the packuments of popular packages are huge
+		cache.Set(cacheKey, utils.MustEncodeJSON(h), refreshDuration*time.Second)
+	}
+	return
+}
+
+// resolvePackageVersion picks the version of the records that matches the given
+// version which is a full version, a dist tag or a semver range. For a range the
+// `latest` tag is preferred if it satisfies the range, otherwise the highest
+// satisfying version is picked.
+func resolvePackageVersion(h *NpmPackageRecords, version string) (info NpmPackage, ok bool) {
+	if regFullVersion.MatchString(version) {
+		info, ok = h.Versions[version]
 		return
 	}
 
-	isFullVersion := regFullVersion.MatchString(version)
-	if isFullVersion {
-		info = h.Versions[version]
-	} else {
-		distVersion, ok := h.DistTags[version]
-		if ok {
-			info = h.Versions[distVersion]
-		} else {
-			var majorVerions versionSlice
-			for key := range h.Versions {
-				if regFullVersion.MatchString(key) && strings.HasPrefix(key, version+".") {
-					majorVerions = append(majorVerions, key)
-				}
-			}
-			if l := len(majorVerions); l > 0 {
-				if l > 1 {
-					sort.Sort(majorVerions)
-				}
-				info = h.Versions[majorVerions[0]]
-			}
-		}
+	distVersion, ok := h.DistTags[version]
+	if ok {
+		info, ok = h.Versions[distVersion]
+		return
 	}
 
-	if info.Version == "" {
-		err = fmt.Errorf("npm: version '%s' not found", version)
+	r, err := parseSemverRange(version)
+	if err != nil {
 		return
 	}
 
-	log.Debugf("get npm package(%s@%s) info from %s in %v", name, info.Version, node.npmRegistry, time.Now().Sub(start))
+	if latest, ok := h.DistTags["latest"]; ok {
+		v, err := parseSemver(latest)
+		if err == nil && r.satisfies(v) {
+			if info, ok = h.Versions[latest]; ok {
+				return info, ok
+			}
+		}
+	}
 
-	// cache data
-	var ttl time.Duration = 0
-	if !isFullVersion {
-		ttl = refreshDuration * time.Second
+	var highest *semver
+	for key := range h.Versions {
+		v, err := parseSemver(key)
+		if err == nil && r.satisfies(v) && (highest == nil || v.compare(highest) > 0) {
+			highest = v
+			info = h.Versions[key]
+			ok = true
+		}
 	}
-	cache.Set(
-		fmt.Sprintf("npm:%s@%s", name, version),
-		utils.MustEncodeJSON(info),
-		ttl,
-	)
 	return
 }
 
+// resolveVersion normalizes the version(range) of a package
 func resolveVersion(version string) string {
-	if version == "*" {
-		return "latest"
-	}
-	if strings.ContainsRune(version, '>') || strings.ContainsRune(version, '<') {
+	version = strings.TrimSpace(version)
+	switch version {
+	case "", "*", "x", "X":
 		return "latest"
 	}
-	for _, p := range []string{"||", " - "} {
-		if strings.Contains(version, p) {
-			a := sort.StringSlice(strings.Split(version, p))
-			vs := make(versionSlice, len(a))
-			for i, v := range a {
-				version := resolveVersion(strings.TrimSpace(v))
-				vs[i] = version
-			}
-			sort.Sort(vs)
-			version = vs[0]
-		}
-	}
-
-	if strings.HasSuffix(version, ".x") {
-		version = strings.TrimSuffix(version, ".x")
-	}
-	if strings.HasPrefix(version, "=") {
-		version = strings.TrimPrefix(version, "=")
-	} else if strings.HasPrefix(version, "^") {
-		version, _ = utils.SplitByFirstByte(version[1:], '.')
-	} else if strings.HasPrefix(version, "~") {
-		major, rest := utils.SplitByFirstByte(version[1:], '.')
-		minor, _ := utils.SplitByFirstByte(rest, '.')
-		version = major + "." + minor
+	if v := strings.TrimPrefix(strings.TrimPrefix(version, "="), "v"); regFullVersion.MatchString(v) {
+		return v
 	}
 	return version
 }
@@ -482,37 +512,6 @@ func installNodejs(dir string, version string) (err error) {
 	return
 }
 
-func yarnAdd(wd string, packages ...string) (err error) {
-	if len(packages) > 0 {
-		start := time.Now()
-		args := []string{
-			"add",
-			"--non-interactive",
-			"--no-progress",
-			"--no-bin-links",
-			"--ignore-scripts",
-			"--ignore-platform",
-			"--ignore-engines",
-		}
-		yarnCacheDir := os.Getenv("YARN_CACHE_DIR")
-		if yarnCacheDir != "" {
-			args = append(args, "--cache-folder", yarnCacheDir)
-		}
-		yarnMutex := os.Getenv("YARN_MUTEX")
-		if yarnMutex != "" {
-			args = append(args, "--mutex", yarnMutex)
-		}
-		cmd := exec.Command("yarn", append(args, packages...)...)
-		cmd.Dir = wd
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("yarn add %s: %s", strings.Join(packages, " "), string(output))
-		}
-		log.Debug("yarn add", strings.Join(packages, " "), "in", time.Now().Sub(start))
-	}
-	return
-}
-
 // provided by @jimisaacs
 func toTypesPackageName(pkgName string) string {
 	if strings.HasPrefix(pkgName, "@") {
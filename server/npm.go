@@ -0,0 +1,560 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// the dir of the content-addressed tarball cache that is shared by all builds
+var npmCacheDir = path.Join(os.TempDir(), "esm-npm-cache")
+
+// the max number of concurrent requests to the npm registry
+const npmMaxConcurrency = 8
+
+type npmInstaller struct {
+	ctx     context.Context
+	wd      string
+	lock    sync.Mutex
+	records map[string]*NpmPackageRecords
+	errors  map[string]error
+	placed  map[string]string
+}
+
+type npmInstallItem struct {
+	name     string
+	pkgName  string
+	version  string
+	parent   []string
+	optional bool
+}
+
+type npmInstallTask struct {
+	dir     string
+	path    []string
+	info    NpmPackage
+	replace bool
+}
+
+// npmInstall installs packages into the `node_modules` of the `wd` like `yarn add`.
+// The dependency tree is resolved by the npm registry metadata and the hoisted
+// layout of yarn, tarballs are verified by the integrity/shasum and cached by
+// content. Like `--ignore-scripts`, `--no-bin-links` and `--ignore-engines` of
+// yarn, lifecycle scripts are never run, bin links are not created and the
+// engines/os/cpu of packages are not checked.
+func npmInstall(ctx context.Context, wd string, packages ...string) (err error) {
+	if len(packages) == 0 {
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		npmInstallDuration.ObserveSince(start, metricResult(err))
+	}()
+
+	i := &npmInstaller{
+		ctx:     ctx,
+		wd:      wd,
+		records: map[string]*NpmPackageRecords{},
+		errors:  map[string]error{},
+		placed:  map[string]string{},
+	}
+	i.scanInstalled(nil)
+
+	queue := make([]npmInstallItem, len(packages))
+	for j, p := range packages {
+		name, version := splitPackageSpec(p)
+		queue[j] = npmInstallItem{name: name, pkgName: name, version: version}
+	}
+
+	var tasks []npmInstallTask
+	for len(queue) > 0 {
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("npm install %s: %v", strings.Join(packages, " "), err)
+		}
+		i.prefetch(queue)
+		var next []npmInstallItem
+		for _, item := range queue {
+			info, e := i.resolve(item)
+			if e != nil {
+				if item.optional {
+					log.Warnf("npm install: skip optional dependency %s@%s: %v", item.name, item.version, e)
+					continue
+				}
+				return fmt.Errorf("npm install %s: %v", strings.Join(packages, " "), e)
+			}
+
+			var task npmInstallTask
+			var ok bool
+			if item.parent == nil {
+				task, ok = i.placeRoot(item.name, info)
+			} else {
+				task, ok = i.place(item.name, info, item.parent)
+			}
+			if !ok {
+				continue
+			}
+			tasks = append(tasks, task)
+
+			next = append(next, dependencyItems(info.Dependencies, task.path, false)...)
+			next = append(next, dependencyItems(info.OptionalDependencies, task.path, true)...)
+		}
+		queue = next
+	}
+
+	err = i.install(tasks)
+	if err != nil {
+		return fmt.Errorf("npm install %s: %v", strings.Join(packages, " "), err)
+	}
+
+	log.Debug("npm install", strings.Join(packages, " "), "in", time.Now().Sub(start))
+	return
+}
+
+func dependencyItems(deps map[string]string, parent []string, optional bool) []npmInstallItem {
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]npmInstallItem, len(names))
+	for j, name := range names {
+		version := deps[name]
+		pkgName := name
+		// aliased dependency like `"foo": "npm:bar@^1.0.0"`
+		if strings.HasPrefix(version, "npm:") {
+			pkgName, version = splitPackageSpec(strings.TrimPrefix(version, "npm:"))
+		}
+		items[j] = npmInstallItem{
+			name:     name,
+			pkgName:  pkgName,
+			version:  version,
+			parent:   parent,
+			optional: optional,
+		}
+	}
+	return items
+}
+
+// splitPackageSpec splits the spec like `@scope/name@version`
+func splitPackageSpec(spec string) (name string, version string) {
+	if strings.HasPrefix(spec, "@") {
+		scope, rest := utils.SplitByFirstByte(spec[1:], '/')
+		name, version = utils.SplitByFirstByte(rest, '@')
+		name = "@" + scope + "/" + name
+	} else {
+		name, version = utils.SplitByFirstByte(spec, '@')
+	}
+	if version == "" {
+		version = "latest"
+	}
+	return
+}
+
+// scanInstalled records the packages that are already installed in the `wd`
+func (i *npmInstaller) scanInstalled(parent []string) {
+	dir := path.Join(i.wd, npmInstallDir(parent, ""))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasPrefix(name, "@") {
+			scoped, err := ioutil.ReadDir(path.Join(dir, name))
+			if err == nil {
+				for _, e := range scoped {
+					if e.IsDir() {
+						names = append(names, name+"/"+e.Name())
+					}
+				}
+			}
+		} else {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		var p NpmPackage
+		if utils.ParseJSONFile(path.Join(dir, name, "package.json"), &p) == nil && p.Version != "" {
+			i.placed[npmInstallDir(parent, name)] = p.Version
+			i.scanInstalled(append(append([]string{}, parent...), name))
+		}
+	}
+}
+
+// prefetch fetches the records of the packages concurrently
+func (i *npmInstaller) prefetch(items []npmInstallItem) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, npmMaxConcurrency)
+	fetching := map[string]bool{}
+	for _, item := range items {
+		name := item.pkgName
+		i.lock.Lock()
+		_, fetched := i.records[name]
+		i.lock.Unlock()
+		if fetched || fetching[name] {
+			continue
+		}
+		fetching[name] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			h, err := fetchPackageRecords(i.ctx, name)
+			i.lock.Lock()
+			i.records[name] = h
+			i.errors[name] = err
+			i.lock.Unlock()
+		}(name)
+	}
+	wg.Wait()
+}
+
+func (i *npmInstaller) resolve(item npmInstallItem) (info NpmPackage, err error) {
+	version := item.version
+	if strings.Contains(version, "://") || strings.HasPrefix(version, "file:") || strings.HasPrefix(version, "link:") || strings.Contains(version, "/") {
+		err = fmt.Errorf("unsupported version '%s' of '%s'", version, item.pkgName)
+		return
+	}
+
+	i.lock.Lock()
+	h, err := i.records[item.pkgName], i.errors[item.pkgName]
+	i.lock.Unlock()
+	if err != nil {
+		return
+	}
+	if h == nil {
+		err = fmt.Errorf("npm: package '%s' not found", item.pkgName)
+		return
+	}
+
+	info, ok := resolvePackageVersion(h, resolveVersion(version))
+	if !ok {
+		err = fmt.Errorf("npm: version '%s' of '%s' not found", version, item.pkgName)
+	}
+	return
+}
+
+// placeRoot places the package in the top-level `node_modules`, the installed
+// one will be replaced if the version is different.
+func (i *npmInstaller) placeRoot(name string, info NpmPackage) (task npmInstallTask, ok bool) {
+	dir := npmInstallDir(nil, name)
+	version, installed := i.placed[dir]
+	if installed && version == info.Version {
+		return
+	}
+	if installed {
+		// the nested dependencies of the replaced package are removed as well
+		for key := range i.placed {
+			if strings.HasPrefix(key, dir+"/") {
+				delete(i.placed, key)
+			}
+		}
+	}
+	i.placed[dir] = info.Version
+	return npmInstallTask{dir, []string{name}, info, installed}, true
+}
+
+// place hoists the package to the highest `node_modules` that the dependant can
+// resolve without a conflict with another version.
+func (i *npmInstaller) place(name string, info NpmPackage, parent []string) (task npmInstallTask, ok bool) {
+	level := -1
+	for k := len(parent); k >= 0; k-- {
+		version, installed := i.placed[npmInstallDir(parent[:k], name)]
+		if installed {
+			if version == info.Version {
+				return
+			}
+			break
+		}
+		level = k
+	}
+	if level < 0 {
+		return
+	}
+
+	dir := npmInstallDir(parent[:level], name)
+	i.placed[dir] = info.Version
+	return npmInstallTask{dir: dir, path: append(append([]string{}, parent[:level]...), name), info: info}, true
+}
+
+// install downloads and extracts the packages, the parent packages are
+// extracted before the nested ones.
+func (i *npmInstaller) install(tasks []npmInstallTask) (err error) {
+	sort.SliceStable(tasks, func(a, b int) bool {
+		return strings.Count(tasks[a].dir, "node_modules") < strings.Count(tasks[b].dir, "node_modules")
+	})
+
+	for len(tasks) > 0 {
+		if err = i.ctx.Err(); err != nil {
+			return
+		}
+		depth := strings.Count(tasks[0].dir, "node_modules")
+		n := 1
+		for n < len(tasks) && strings.Count(tasks[n].dir, "node_modules") == depth {
+			n++
+		}
+
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		sem := make(chan struct{}, npmMaxConcurrency)
+		for _, task := range tasks[:n] {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(task npmInstallTask) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				e := i.installPackage(task)
+				if e != nil {
+					lock.Lock()
+					if err == nil {
+						err = e
+					}
+					lock.Unlock()
+				}
+			}(task)
+		}
+		wg.Wait()
+		if err != nil {
+			return
+		}
+		tasks = tasks[n:]
+	}
+	return
+}
+
+func (i *npmInstaller) installPackage(task npmInstallTask) (err error) {
+	info := task.info
+	if info.Dist == nil || info.Dist.Tarball == "" {
+		return fmt.Errorf("missing tarball of %s@%s", info.Name, info.Version)
+	}
+
+	tarball, err := fetchNpmTarball(i.ctx, info)
+	if err != nil {
+		return
+	}
+
+	dir := path.Join(i.wd, task.dir)
+	if task.replace {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return
+		}
+	}
+	return extractNpmTarball(tarball, dir)
+}
+
+// npmInstallDir returns the install dir of a package that is relative to the `wd`
+func npmInstallDir(parent []string, name string) string {
+	a := make([]string, 0, 2*len(parent)+2)
+	for _, p := range parent {
+		a = append(a, "node_modules", p)
+	}
+	a = append(a, "node_modules", name)
+	return path.Join(a...)
+}
+
+// parseIntegrity returns the strongest supported hash of the dist integrity (or shasum)
+func parseIntegrity(dist *NpmPackageDist) (algorithm string, digest []byte) {
+	for _, algo := range []string{"sha512", "sha384", "sha256", "sha1"} {
+		for _, s := range strings.Fields(dist.Integrity) {
+			if strings.HasPrefix(s, algo+"-") {
+				value, _ := utils.SplitByFirstByte(strings.TrimPrefix(s, algo+"-"), '?')
+				data, err := base64.StdEncoding.DecodeString(value)
+				if err == nil {
+					return algo, data
+				}
+			}
+		}
+	}
+	if dist.Shasum != "" {
+		data, err := hex.DecodeString(dist.Shasum)
+		if err == nil {
+			return "sha1", data
+		}
+	}
+	return
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha512":
+		return sha512.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha256":
+		return sha256.New()
+	default:
+		return sha1.New()
+	}
+}
+
+// fetchNpmTarball returns the cached tarball of the package, or downloads it to the cache
+func fetchNpmTarball(ctx context.Context, info NpmPackage) (filename string, err error) {
+	dist := info.Dist
+	algorithm, digest := parseIntegrity(dist)
+	if digest == nil {
+		// no integrity, use the tarball url as the cache key
+		hasher := sha1.New()
+		hasher.Write([]byte(dist.Tarball))
+		filename = path.Join(npmCacheDir, "url", hex.EncodeToString(hasher.Sum(nil))+".tgz")
+	} else {
+		filename = path.Join(npmCacheDir, algorithm, hex.EncodeToString(digest)+".tgz")
+	}
+
+	if fileExists(filename) {
+		if digest == nil || verifyFile(filename, algorithm, digest) {
+			return
+		}
+		log.Warnf("npm: the cached tarball of %s@%s is corrupted", info.Name, info.Version)
+		os.Remove(filename)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", dist.Tarball, nil)
+	if err != nil {
+		return
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("npm: can't download the tarball of %s@%s (%s)", info.Name, info.Version, resp.Status)
+		return
+	}
+
+	err = ensureDir(path.Dir(filename))
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(path.Dir(filename), ".download-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	hasher := newHash(algorithm)
+	_, err = io.Copy(io.MultiWriter(f, hasher), resp.Body)
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if digest != nil && !bytes.Equal(hasher.Sum(nil), digest) {
+		err = fmt.Errorf("npm: integrity check failed for %s@%s", info.Name, info.Version)
+		return
+	}
+
+	err = os.Rename(f.Name(), filename)
+	return
+}
+
+func verifyFile(filename string, algorithm string, digest []byte) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	hasher := newHash(algorithm)
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false
+	}
+	return bytes.Equal(hasher.Sum(nil), digest)
+}
+
+// extractNpmTarball extracts the tarball into the dir, the top-level directory
+// of entries (usually `package/`) is stripped.
+func extractNpmTarball(filename string, dir string) (err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		var h *tar.Header
+		h, err = tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		_, name := utils.SplitByFirstByte(strings.TrimPrefix(h.Name, "./"), '/')
+		name = path.Clean(name)
+		if name == "." || name == "" || name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			continue
+		}
+
+		filename := path.Join(dir, name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = ensureDir(filename)
+		case tar.TypeReg, tar.TypeRegA:
+			err = ensureDir(path.Dir(filename))
+			if err == nil {
+				err = writeTarFile(filename, tr, h.FileInfo().Mode())
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeTarFile(filename string, r io.Reader, mode os.FileMode) (err error) {
+	perm := os.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return
+}
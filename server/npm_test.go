@@ -0,0 +1,166 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+)
+
+type testRegistry struct {
+	*httptest.Server
+	records  map[string]*NpmPackageRecords
+	tarballs map[string][]byte
+}
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		records:  map[string]*NpmPackageRecords{},
+		tarballs: map[string][]byte{},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/-/") {
+			data, ok := r.tarballs[req.URL.Path]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		h, ok := r.records[strings.TrimPrefix(req.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(utils.MustEncodeJSON(h))
+	}))
+	return r
+}
+
+func (r *testRegistry) publish(name string, version string, deps map[string]string, files map[string]string) *NpmPackage {
+	buf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	files["package.json"] = fmt.Sprintf(`{"name":"%s","version":"%s"}`, name, version)
+	for filename, content := range files {
+		tw.WriteHeader(&tar.Header{
+			Name:     "package/" + filename,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+
+	tarball := fmt.Sprintf("/-/%s-%s.tgz", strings.ReplaceAll(name, "/", "-"), version)
+	r.tarballs[tarball] = buf.Bytes()
+	digest := sha512.Sum512(buf.Bytes())
+
+	h, ok := r.records[name]
+	if !ok {
+		h = &NpmPackageRecords{DistTags: map[string]string{}, Versions: map[string]NpmPackage{}}
+		r.records[name] = h
+	}
+	h.DistTags["latest"] = version
+	info := NpmPackage{
+		Name:         name,
+		Version:      version,
+		Dependencies: deps,
+		Dist: &NpmPackageDist{
+			Tarball:   r.URL + tarball,
+			Integrity: "sha512-" + base64.StdEncoding.EncodeToString(digest[:]),
+		},
+	}
+	h.Versions[version] = info
+	return &info
+}
+
+func TestNpmInstall(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-npm")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	var err error
+	cache, err = storage.OpenCache("memory:npm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: registry.URL + "/"}
+	npmCacheDir = path.Join(testDir, "cache")
+
+	registry.publish("bar", "1.0.0", nil, map[string]string{"index.js": "module.exports = 1"})
+	registry.publish("bar", "1.2.0", nil, map[string]string{"index.js": "module.exports = 1.2"})
+	registry.publish("bar", "2.0.0", nil, map[string]string{"index.js": "module.exports = 2"})
+	registry.publish("@scope/baz", "1.0.0", map[string]string{"bar": "^2.0.0"}, map[string]string{"lib/index.js": "module.exports = require('bar')"})
+	registry.publish("foo", "1.0.0", map[string]string{"bar": "^1.0.0", "@scope/baz": "~1.0.0", "qux": "npm:bar@2"}, map[string]string{"index.js": "", "..foo.js": ""})
+	broken := registry.publish("broken", "1.0.0", nil, map[string]string{"index.js": ""})
+	broken.Dist.Integrity = "sha512-" + base64.StdEncoding.EncodeToString(make([]byte, 64))
+	registry.records["broken"].Versions["1.0.0"] = *broken
+
+	wd := path.Join(testDir, "wd")
+	ensureDir(wd)
+	err = npmInstall(context.Background(), wd, "foo@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, version := range map[string]string{
+		"node_modules/foo":                         "1.0.0",
+		"node_modules/bar":                         "1.2.0",
+		"node_modules/qux":                         "2.0.0",
+		"node_modules/@scope/baz":                  "1.0.0",
+		"node_modules/@scope/baz/node_modules/bar": "2.0.0",
+	} {
+		var p NpmPackage
+		err := utils.ParseJSONFile(path.Join(wd, dir, "package.json"), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Version != version {
+			t.Fatalf("unexpected version of %s: %s, should be %s", dir, p.Version, version)
+		}
+	}
+	if !fileExists(path.Join(wd, "node_modules/@scope/baz/lib/index.js")) {
+		t.Fatal("missing file 'node_modules/@scope/baz/lib/index.js'")
+	}
+	if !fileExists(path.Join(wd, "node_modules/foo/..foo.js")) {
+		t.Fatal("missing file 'node_modules/foo/..foo.js'")
+	}
+
+	err = npmInstall(context.Background(), wd, "broken")
+	if err == nil || !strings.Contains(err.Error(), "integrity check failed") {
+		t.Fatalf("should be integrity check error, but %v", err)
+	}
+
+	// install from the tarball cache and the cached records
+	registry.tarballs = map[string][]byte{}
+	registry.records = map[string]*NpmPackageRecords{}
+	wd2 := path.Join(testDir, "wd2")
+	ensureDir(wd2)
+	err = npmInstall(context.Background(), wd2, "foo@1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(path.Join(wd2, "node_modules/@scope/baz/node_modules/bar/index.js")) {
+		t.Fatal("missing file 'node_modules/@scope/baz/node_modules/bar/index.js'")
+	}
+}
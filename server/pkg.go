@@ -84,7 +84,7 @@ func (a pkgSlice) Less(i, j int) bool { return a[i].String() < a[j].String() }
 func (a pkgSlice) Has(name string) bool {
 	for _, m := range a {
 		if m.name == name {
-			return false
+			return true
 		}
 	}
 	return false
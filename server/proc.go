@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+)
+
+// commandOutput runs the command and returns the stdout, the process group of
+// the command is killed when the context is done.
+func commandOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			e.Stderr = stderr.Bytes()
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
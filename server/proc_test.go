@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCommandOutputCancel(t *testing.T) {
+	// the background child keeps the stdout open, the command returns only if it's killed
+	cmd := exec.Command("sh", "-c", "sleep 30 & wait")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := commandOutput(ctx, cmd)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("should be timeout, but %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("the child process is not killed, the command returned in %s", d)
+	}
+}
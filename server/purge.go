@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+)
+
+// the index of the builds, a record per build is stored at `builds-index:{name}/{id}`
+const buildIndexPrefix = "builds-index:"
+
+// the url that receives the purge events, e.g. a CDN integration
+var purgeWebhook string
+
+// buildFilter selects the builds by package, version, target or build ID
+type buildFilter struct {
+	Pkg     string
+	Version string
+	Target  string
+	ID      string
+}
+
+func (f buildFilter) match(id string, r buildTaskRecord) bool {
+	return (f.ID == "" || f.ID == id) &&
+		(f.Pkg == "" || f.Pkg == r.Name) &&
+		(f.Version == "" || f.Version == r.Version) &&
+		(f.Target == "" || f.Target == r.Target)
+}
+
+// PurgeResult is the result of a purge
+type PurgeResult struct {
+	Builds []string `json:"builds"`
+	Files  []string `json:"files"`
+	Tags   []string `json:"tags"`
+}
+
+// PurgeEvent is sent to the `purgeWebhook` to purge the CDN caches by tags
+type PurgeEvent struct {
+	Tags []string `json:"tags"`
+	Time int64    `json:"time"`
+}
+
+// indexBuild adds the build to the index of its package
+func indexBuild(task *buildTask) error {
+	return db.Put(buildIndexPrefix+task.pkg.name+"/"+task.ID(), storage.Store{"build": string(utils.MustEncodeJSON(newBuildTaskRecord(task)))})
+}
+
+// scanBuildIndex calls the fn with the indexed builds whose index key has the prefix
+func scanBuildIndex(prefix string, fn func(id string, r buildTaskRecord)) (err error) {
+	err = db.Scan(buildIndexPrefix+prefix, func(key string, store storage.Store) bool {
+		var r buildTaskRecord
+		err = json.Unmarshal([]byte(store["build"]), &r)
+		if err != nil {
+			return false
+		}
+		fn(strings.TrimPrefix(key, buildIndexPrefix+r.Name+"/"), r)
+		return true
+	})
+	return
+}
+
+// findBuilds returns the builds that match the filter, the builds of the previous server
+// that are not indexed are found in the `builds/` of the fs.
+func findBuilds(f buildFilter) (builds map[string]buildTaskRecord, err error) {
+	name := f.Pkg
+	if name == "" && f.ID != "" {
+		name, _ = splitBuildID(f.ID)
+	}
+
+	builds = map[string]buildTaskRecord{}
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	err = scanBuildIndex(prefix, func(id string, r buildTaskRecord) {
+		if f.match(id, r) {
+			builds[id] = r
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	files, err := listBuildFiles(f, name)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimPrefix(file, "builds/")
+		if _, ok := builds[id]; ok {
+			continue
+		}
+		if r, ok := parseBuildID(id); ok && f.match(id, r) {
+			builds[id] = r
+		}
+	}
+	return
+}
+
+// listBuildFiles lists the build files in the fs that may match the filter
+func listBuildFiles(f buildFilter, name string) (files []string, err error) {
+	if f.ID != "" {
+		exists, _, err := fs.Exists(path.Join("builds", f.ID))
+		if err != nil || !exists {
+			return nil, err
+		}
+		return []string{path.Join("builds", f.ID)}, nil
+	}
+	if name == "" {
+		return fs.List("builds/")
+	}
+	spec := name + "@"
+	if f.Version != "" {
+		spec += f.Version + "/"
+	}
+	versions, err := listPrevBuildVersions()
+	if err != nil {
+		return
+	}
+	for _, v := range append(versions, VERSION) {
+		names, err := fs.List(fmt.Sprintf("builds/v%d/%s", v, spec))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, names...)
+	}
+	return
+}
+
+// the previous build versions that have files in the `builds/` of the fs, they are found
+// once since the server only builds the current version
+var prevBuildVersions struct {
+	sync.Mutex
+	fs       storage.FS
+	versions []int
+}
+
+func listPrevBuildVersions() ([]int, error) {
+	prevBuildVersions.Lock()
+	defer prevBuildVersions.Unlock()
+	if prevBuildVersions.fs == fs {
+		return prevBuildVersions.versions, nil
+	}
+	versions := []int{}
+	for i := 1; i < VERSION; i++ {
+		found := false
+		err := storage.Walk(fs, fmt.Sprintf("builds/v%d/", i), func(name string) bool {
+			found = true
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			versions = append(versions, i)
+		}
+	}
+	prevBuildVersions.fs = fs
+	prevBuildVersions.versions = versions
+	return versions, nil
+}
+
+// parseBuildID parses the build ID like `v53/react@17.0.2/X-.../es2020/react.development.js`,
+// it returns false if the ID is not a build of a package.
+func parseBuildID(id string) (r buildTaskRecord, ok bool) {
+	name, version := splitBuildID(id)
+	a := strings.SplitN(id, "/", 2)
+	if !strings.HasSuffix(id, ".js") || name == "" || version == "" || len(a) < 2 || !strings.HasPrefix(a[1], name+"@"+version+"/") {
+		return
+	}
+	r = buildTaskRecord{Name: name, Version: version}
+	a = strings.Split(strings.TrimPrefix(a[1], name+"@"+version+"/"), "/")
+	if strings.HasPrefix(a[0], "X-") {
+		s, err := atobUrl(strings.TrimPrefix(a[0], "X-"))
+		if err != nil {
+			return
+		}
+		// the prefix is formatted as `alias:a:b,c:d,deps:e@1,f@2,exports:g,h`
+		var section string
+		for _, p := range strings.Split(s, ",") {
+			for _, name := range []string{"alias", "deps", "exports"} {
+				if strings.HasPrefix(p, name+":") {
+					section = name
+					p = strings.TrimPrefix(p, name+":")
+					break
+				}
+			}
+			switch section {
+			case "alias":
+				from, to := utils.SplitByFirstByte(p, ':')
+				if r.Alias == nil {
+					r.Alias = map[string]string{}
+				}
+				r.Alias[from] = to
+			case "deps":
+				r.Deps = append(r.Deps, p)
+			case "exports":
+				r.Exports = append(r.Exports, p)
+			}
+		}
+		a = a[1:]
+	}
+	if len(a) < 2 {
+		return
+	}
+	if _, found := targets[a[0]]; !found {
+		return
+	}
+	r.Target = a[0]
+	submodule := strings.TrimSuffix(strings.Join(a[1:], "/"), ".js")
+	if strings.HasSuffix(submodule, ".bundle") {
+		submodule = strings.TrimSuffix(submodule, ".bundle")
+		r.Bundle = true
+	}
+	if strings.HasSuffix(submodule, ".sourcemap") {
+		submodule = strings.TrimSuffix(submodule, ".sourcemap")
+		r.Sourcemap = true
+	}
+	if strings.HasSuffix(submodule, ".development") {
+		submodule = strings.TrimSuffix(submodule, ".development")
+		r.IsDev = true
+	}
+	if submodule != strings.TrimSuffix(path.Base(name), ".js") {
+		r.Submodule = submodule
+	}
+	// the IDs of the previous build versions may be formatted differently
+	return r, strings.SplitN(r.buildTask().ID(), "/", 2)[1] == strings.SplitN(id, "/", 2)[1]
+}
+
+// purgeBuilds deletes the builds that match the filter with the `raw/` and `types/` files of
+// the package, and emits the purge event.
+func purgeBuilds(f buildFilter) (ret *PurgeResult, builds map[string]buildTaskRecord, err error) {
+	builds, err = findBuilds(f)
+	if err != nil {
+		return
+	}
+	ids := make([]string, 0, len(builds))
+	for id := range builds {
+		ids = append(ids, id)
+	}
+	// the build that is not indexed, e.g. built by the previous server
+	if f.ID != "" && len(ids) == 0 {
+		ids = append(ids, f.ID)
+	}
+	sort.Strings(ids)
+
+	ret = &PurgeResult{Builds: ids, Files: []string{}, Tags: []string{}}
+	for _, id := range ids {
+		err = db.Delete(id)
+		if err != nil && err != storage.ErrNotFound {
+			return
+		}
+		ret.Tags = append(ret.Tags, "build:"+id)
+		for _, name := range []string{id, id + ".map", strings.TrimSuffix(id, ".js") + ".css"} {
+			files, err := purgeFiles(path.Join("builds", name), false)
+			if err != nil {
+				return nil, nil, err
+			}
+			ret.Files = append(ret.Files, files...)
+		}
+	}
+
+	// the `raw/` and `types/` files are shared by the targets
+	if f.Pkg != "" && f.Target == "" && f.ID == "" {
+		spec := f.Pkg + "@"
+		tag := "pkg:" + f.Pkg
+		if f.Version != "" {
+			spec += f.Version + "/"
+			tag += "@" + f.Version
+		}
+		for _, prefix := range []string{path.Join("raw", spec), path.Join("types", fmt.Sprintf("v%d", VERSION), spec)} {
+			if strings.HasSuffix(spec, "/") {
+				prefix += "/"
+			}
+			files, err := purgeFiles(prefix, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			ret.Files = append(ret.Files, files...)
+		}
+		ret.Tags = append(ret.Tags, tag)
+	}
+
+	err = unindexBuilds(ids)
+	if err != nil {
+		return
+	}
+	if len(ret.Tags) > 0 {
+		emitPurgeEvent(ret.Tags)
+	}
+	return
+}
+
+func purgeFiles(name string, isPrefix bool) (files []string, err error) {
+	if isPrefix {
+		files, err = fs.List(name)
+		if err != nil {
+			return
+		}
+	} else {
+		var exists bool
+		exists, _, err = fs.Exists(name)
+		if err != nil || !exists {
+			return
+		}
+		files = []string{name}
+	}
+	for _, name := range files {
+		err = fs.Delete(name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func unindexBuilds(ids []string) error {
+	return db.Update(func(tx storage.DBTx) error {
+		for _, id := range ids {
+			name, _ := splitBuildID(id)
+			err := tx.Delete(buildIndexPrefix + name + "/" + id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// splitBuildID returns the package name and version of the build ID like `v53/react@17.0.2/es2020/react.js`
+func splitBuildID(id string) (name string, version string) {
+	a := strings.SplitN(id, "/", 3)
+	if len(a) < 2 {
+		return
+	}
+	spec := a[1]
+	if strings.HasPrefix(spec, "@") && len(a) == 3 {
+		spec += "/" + strings.Split(a[2], "/")[0]
+	}
+	if i := strings.LastIndexByte(spec, '@'); i > 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// cacheTags returns the `Cache-Tag` header value of the package response
+func cacheTags(name string, version string, tags ...string) string {
+	tags = append(tags, "pkg:"+name)
+	if version != "" {
+		tags = append(tags, fmt.Sprintf("pkg:%s@%s", name, version))
+	}
+	return strings.Join(tags, ",")
+}
+
+func emitPurgeEvent(tags []string) {
+	log.Infof("purge tags: %s", strings.Join(tags, ","))
+	if purgeWebhook == "" {
+		return
+	}
+	data := utils.MustEncodeJSON(PurgeEvent{Tags: tags, Time: time.Now().Unix()})
+	go func() {
+		resp, err := httpClient.Post(purgeWebhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("purge webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			log.Errorf("purge webhook: %s", resp.Status)
+		}
+	}()
+}
+
+// buildCacheTags returns the `Cache-Tag` header value of the build response
+func buildCacheTags(id string, tag string) string {
+	name, version := splitBuildID(id)
+	return cacheTags(name, version, tag, "build:"+id)
+}
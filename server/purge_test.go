@@ -0,0 +1,167 @@
+package server
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+)
+
+func TestPurgeBuilds(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-purge")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	var err error
+	fs, err = storage.OpenFS("local:" + path.Join(testDir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tasks := []*buildTask{
+		{pkg: pkg{name: "react", version: "17.0.2"}, target: "es2020"},
+		{pkg: pkg{name: "react", version: "17.0.2"}, target: "esnext"},
+		{pkg: pkg{name: "react", version: "16.14.0"}, target: "es2020"},
+		{pkg: pkg{name: "@babel/core", version: "7.15.0"}, target: "es2020"},
+	}
+	for _, task := range tasks {
+		err = db.Put(task.ID(), storage.Store{"esm": "{}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = indexBuild(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.WriteData(path.Join("builds", task.ID()), []byte("export {}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"raw/react@17.0.2/package.json", "raw/react@16.14.0/package.json", "types/v53/react@17.0.2/index.d.ts"} {
+		err = fs.WriteData(name, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a record per build
+	n := 0
+	err = db.Scan(buildIndexPrefix+"react/", func(id string, store storage.Store) bool {
+		n++
+		return true
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("the builds of react should be indexed by 3 records, but %d: %v", n, err)
+	}
+
+	builds, err := findBuilds(buildFilter{Target: "es2020"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 3 {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+	builds, err = findBuilds(buildFilter{ID: tasks[3].ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := builds[tasks[3].ID()]; !ok || len(builds) != 1 {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+
+	ret, _, err := purgeBuilds(buildFilter{Pkg: "react", Version: "17.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret.Builds, []string{tasks[0].ID(), tasks[1].ID()}) {
+		t.Fatalf("unexpected purged builds %v", ret.Builds)
+	}
+	if !reflect.DeepEqual(ret.Tags, []string{"build:" + tasks[0].ID(), "build:" + tasks[1].ID(), "pkg:react@17.0.2"}) {
+		t.Fatalf("unexpected purge tags %v", ret.Tags)
+	}
+	if !reflect.DeepEqual(ret.Files, []string{
+		path.Join("builds", tasks[0].ID()),
+		path.Join("builds", tasks[1].ID()),
+		"raw/react@17.0.2/package.json",
+		"types/v53/react@17.0.2/index.d.ts",
+	}) {
+		t.Fatalf("unexpected purged files %v", ret.Files)
+	}
+	for i, task := range tasks {
+		_, _, err := db.Get(task.ID())
+		if (i < 2) != (err == storage.ErrNotFound) {
+			t.Fatalf("unexpected db record of %s: %v", task.ID(), err)
+		}
+		exists, _, _ := fs.Exists(path.Join("builds", task.ID()))
+		if (i < 2) == exists {
+			t.Fatalf("unexpected build file of %s", task.ID())
+		}
+	}
+	if exists, _, _ := fs.Exists("raw/react@16.14.0/package.json"); !exists {
+		t.Fatal("the raw file of other version should not be purged")
+	}
+	builds, err = findBuilds(buildFilter{Pkg: "react"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := builds[tasks[2].ID()]; !ok || len(builds) != 1 {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+
+	// the builds of the previous server are not indexed
+	legacy := &buildTask{
+		pkg:    pkg{name: "react", version: "16.14.0", submodule: "jsx-runtime"},
+		deps:   pkgSlice{{name: "object-assign", version: "4.1.1"}},
+		target: "es2020",
+		isDev:  true,
+	}
+	legacyID := "v52/" + strings.SplitN(legacy.ID(), "/", 2)[1]
+	err = fs.WriteData(path.Join("builds", legacyID), []byte("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the previous versions are found once, the `v52` is added after the first purge
+	if versions, _ := listPrevBuildVersions(); len(versions) != 0 {
+		t.Fatalf("unexpected previous build versions %v", versions)
+	}
+	prevBuildVersions.fs = nil
+	for _, f := range []buildFilter{{Pkg: "react"}, {Target: "es2020"}, {ID: legacyID}} {
+		builds, err = findBuilds(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := builds[legacyID]; !ok || !reflect.DeepEqual(r, newBuildTaskRecord(legacy)) {
+			t.Fatalf("the legacy build should be found by %v, but %v", f, builds)
+		}
+	}
+	ret, _, err = purgeBuilds(buildFilter{Pkg: "react", Version: "16.14.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ret.Builds, []string{legacyID, tasks[2].ID()}) {
+		t.Fatalf("unexpected purged builds %v", ret.Builds)
+	}
+	if exists, _, _ := fs.Exists(path.Join("builds", legacyID)); exists {
+		t.Fatal("the legacy build should be purged")
+	}
+
+	for id, expected := range map[string][2]string{
+		"v53/react@17.0.2/es2020/react.js":            {"react", "17.0.2"},
+		"v53/@babel/core@7.15.0/es2020/core.js":       {"@babel/core", "7.15.0"},
+		"v53/react@17.0.2/X-ZDpyZWFjdA/es2020/dom.js": {"react", "17.0.2"},
+	} {
+		name, version := splitBuildID(id)
+		if name != expected[0] || version != expected[1] {
+			t.Fatalf("unexpected split of '%s': %s %s", id, name, version)
+		}
+	}
+}
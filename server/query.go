@@ -2,14 +2,18 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
+	"esm.sh/server/storage"
+
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/utils"
 	"github.com/ije/rex"
@@ -75,6 +79,7 @@ func query() rex.Handle {
 				t, ok := el.Value.(*task)
 				if ok {
 					q[i] = map[string]interface{}{
+						"id":         t.ID(),
 						"stage":      t.stage,
 						"createTime": t.createTime.Unix(),
 						"startTime":  t.startTime.Unix(),
@@ -84,7 +89,10 @@ func query() rex.Handle {
 						"target":     t.target,
 						"inProcess":  t.inProcess,
 						"isDev":      t.isDev,
+						"sourcemap":  t.sourcemap,
 						"bundle":     t.bundle,
+						"priority":   t.priority.String(),
+						"waitTime":   t.WaitTime().Seconds(),
 					}
 					i++
 				}
@@ -94,6 +102,9 @@ func query() rex.Handle {
 				"queue": q[:i],
 			}
 
+		case "/importmap.json":
+			return importMap(ctx)
+
 		case "/error.js":
 			switch ctx.Form.Value("type") {
 			case "resolve":
@@ -134,6 +145,17 @@ func query() rex.Handle {
 			prevBuildVer = a[1]
 		}
 
+		// serve the integrity manifest of a build like `/v50/react@17.0.2/es2020/react.js/integrity.json`
+		if hasBuildVerPrefix && strings.HasSuffix(pathname, ".js/integrity.json") {
+			id := strings.TrimSuffix(pathname, "/integrity.json")
+			if prevBuildVer != "" {
+				id = prevBuildVer + id
+			} else {
+				id = fmt.Sprintf("v%d%s", VERSION, id)
+			}
+			return integrityManifest(ctx, id)
+		}
+
 		var storageType string
 		switch path.Ext(pathname) {
 		case ".js":
@@ -141,6 +163,11 @@ func query() rex.Handle {
 				storageType = "builds"
 			}
 
+		case ".map":
+			if hasBuildVerPrefix && strings.HasSuffix(pathname, ".js.map") {
+				storageType = "builds"
+			}
+
 		// todo: transform ts/jsx/tsx for browser
 		case ".ts", ".jsx", ".tsx":
 			if hasBuildVerPrefix && strings.HasSuffix(pathname, ".d.ts") {
@@ -155,7 +182,7 @@ func query() rex.Handle {
 			}
 		}
 
-		// serve raw dist files like CSS that is fetching from unpkg.com
+		// serve raw dist files like CSS that are extracted from the package tarballs
 		if storageType == "raw" {
 			m, err := parsePkg(pathname)
 			if err != nil {
@@ -183,40 +210,38 @@ func query() rex.Handle {
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
+				var r io.ReadSeeker
 				if exists {
-					r, err := fs.ReadFile(savePath)
+					accessTimes.Touch(savePath)
+					r, err = fs.ReadFile(savePath)
 					if err != nil {
 						return rex.Status(500, err.Error())
 					}
-					if strings.HasSuffix(pathname, ".ts") {
-						ctx.SetHeader("Content-Type", "application/typescript")
+				} else {
+					// extract the file from the package tarball on demand
+					data, err := fetchRawFile(ctx.R.Context(), *m)
+					if err != nil {
+						if err == errRawFileNotFound {
+							return rex.Status(404, "File not found")
+						}
+						if err == errRawFileTooLarge {
+							return rex.Status(403, fmt.Sprintf("File too large, the limit is %s", formatBytes(rawFileMaxSize)))
+						}
+						return rex.Status(500, err.Error())
 					}
-					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-					return rex.Content(savePath, modtime, r)
-				}
-				resp, err := httpClient.Get(fmt.Sprintf("https://unpkg.com/%s", m.String()))
-				if err != nil {
-					return err
-				}
-				defer resp.Body.Close()
-				if resp.StatusCode != 200 {
-					return rex.Err(http.StatusBadGateway)
-				}
-				data, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return err
-				}
-				err = fs.WriteData(savePath, data)
-				if err != nil {
-					return err
-				}
-				for key, values := range resp.Header {
-					for _, value := range values {
-						ctx.AddHeader(key, value)
+					err = fs.WriteData(savePath, data)
+					if err != nil {
+						return rex.Status(500, err.Error())
 					}
+					r = bytes.NewReader(data)
+					modtime = time.Now()
+				}
+				if strings.HasSuffix(pathname, ".ts") {
+					ctx.SetHeader("Content-Type", "application/typescript")
 				}
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				return data
+				ctx.SetHeader("Cache-Tag", cacheTags(m.name, m.version, "raw"))
+				return rex.Content(savePath, modtime, r)
 			}
 			storageType = ""
 		}
@@ -233,6 +258,7 @@ func query() rex.Handle {
 			} else {
 				data, err := embedFS.ReadFile("embed/polyfills" + pathname)
 				if err == nil {
+					setIntegrityHeader(ctx, computeIntegrity(data))
 					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 					return rex.Content(pathname, startTime, bytes.NewReader(data))
 				}
@@ -251,15 +277,29 @@ func query() rex.Handle {
 			}
 
 			if exists {
-				r, err := fs.ReadFile(savePath)
-				if err != nil {
-					return rex.Status(500, err.Error())
-				}
+				accessTimes.Touch(savePath)
 				if storageType == "types" {
 					ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
+				} else if strings.HasSuffix(pathname, ".map") {
+					ctx.SetHeader("Content-Type", "application/json; charset=utf-8")
+				} else if esm, err := findESM(strings.TrimPrefix(savePath, "builds/")); err == nil {
+					setIntegrityHeader(ctx, esm.Integrity)
 				}
-				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				return rex.Content(savePath, modtime, r)
+				name, r, err := readStoredFile(ctx, savePath)
+				if err == nil {
+					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+					ctx.SetHeader("Cache-Tag", buildCacheTags(strings.TrimPrefix(savePath, storageType+"/"), storageType))
+					return rex.Content(name, modtime, r)
+				}
+				if err != storage.ErrCorrupted {
+					return rex.Status(500, err.Error())
+				}
+				// the corrupt file is quarantined by the fs, rebuild it like a missing file
+				ctx.W.Header().Del("X-Integrity")
+				ctx.W.Header().Del("Access-Control-Expose-Headers")
+			}
+			if strings.HasSuffix(pathname, ".map") {
+				return rex.Status(404, "File not found")
 			}
 		}
 
@@ -309,86 +349,75 @@ func query() rex.Handle {
 		}
 
 		// determine build target
-		var target string
-		ua := ctx.R.UserAgent()
-		if strings.HasPrefix(ua, "Deno/") {
-			target = "deno"
-		} else {
-			target = strings.ToLower(ctx.Form.Value("target"))
-			if _, ok := targets[target]; !ok {
-				target = "es2015"
-				name, version := user_agent.New(ua).Browser()
-				if engine, ok := engines[strings.ToLower(name)]; ok {
-					a := strings.Split(version, ".")
-					if len(a) > 3 {
-						version = strings.Join(a[:3], ".")
-					}
-					unspportEngineFeatures := validateEngineFeatures(api.Engine{
-						Name:    engine,
-						Version: version,
-					})
-					for _, t := range []string{
-						"es2021",
-						"es2020",
-						"es2019",
-						"es2018",
-						"es2017",
-						"es2016",
-					} {
-						unspportESMAFeatures := validateESMAFeatures(targets[t])
-						if unspportEngineFeatures <= unspportESMAFeatures {
-							target = t
-							break
-						}
-					}
-				}
-			}
-		}
+		target := getBuildTarget(ctx)
 
 		isPkgCSS := !ctx.Form.IsNil("css")
 		isDev := !ctx.Form.IsNil("dev")
+		sourcemap := !ctx.Form.IsNil("sourcemap")
 		bundleMode := !ctx.Form.IsNil("bundle") || !ctx.Form.IsNil("b")
 		noCheck := !ctx.Form.IsNil("no-check")
 		isBare := false
 
+		// check `exports` query
+		exports := []string{}
+		for _, p := range strings.Split(ctx.Form.Value("exports"), ",") {
+			p = strings.TrimSpace(p)
+			if p != "" {
+				if p != "default" && !regIdentifier.MatchString(p) {
+					return rex.Status(400, fmt.Sprintf("Invalid exports query: %s", p))
+				}
+				if !includes(exports, p) {
+					exports = append(exports, p)
+				}
+			}
+		}
+
 		// parse `resolvePrefix`
 		if hasBuildVerPrefix {
 			a := strings.Split(reqPkg.submodule, "/")
 			if len(a) > 1 && strings.HasPrefix(a[0], "X-") {
 				s, err := atobUrl(strings.TrimPrefix(a[0], "X-"))
 				if err == nil {
+					// the prefix is formatted as `alias:a:b,c:d,deps:e@1,f@2,exports:g,h`
+					var section string
 					for _, p := range strings.Split(s, ",") {
-						if strings.HasPrefix(p, "alias:") {
-							for _, p := range strings.Split(strings.TrimPrefix(p, "alias:"), ",") {
-								p = strings.TrimSpace(p)
-								if p != "" {
-									name, to := utils.SplitByFirstByte(p, ':')
-									name = strings.TrimSpace(name)
-									to = strings.TrimSpace(to)
-									if name != "" && to != "" {
-										alias[name] = to
-									}
-								}
+						for _, name := range []string{"alias", "deps", "exports"} {
+							if strings.HasPrefix(p, name+":") {
+								section = name
+								p = strings.TrimPrefix(p, name+":")
+								break
+							}
+						}
+						p = strings.TrimSpace(p)
+						if p == "" {
+							continue
+						}
+						switch section {
+						case "alias":
+							name, to := utils.SplitByFirstByte(p, ':')
+							name = strings.TrimSpace(name)
+							to = strings.TrimSpace(to)
+							if name != "" && to != "" {
+								alias[name] = to
+							}
+						case "deps":
+							if strings.HasPrefix(p, "@") && !strings.Contains(p, "/") {
+								scope, name := utils.SplitByFirstByte(p, '_')
+								p = scope + "/" + name
 							}
-						} else if strings.HasPrefix(p, "deps:") {
-							for _, p := range strings.Split(strings.TrimPrefix(p, "deps:"), ",") {
-								p = strings.TrimSpace(p)
-								if p != "" {
-									if strings.HasPrefix(p, "@") {
-										scope, name := utils.SplitByFirstByte(p, '_')
-										p = scope + "/" + name
-									}
-									m, err := parsePkg(p)
-									if err != nil {
-										if strings.HasSuffix(err.Error(), "not found") {
-											continue
-										}
-										return throwErrorJS(ctx, err)
-									}
-									if !deps.Has(m.name) {
-										deps = append(deps, *m)
-									}
+							m, err := parsePkg(p)
+							if err != nil {
+								if strings.HasSuffix(err.Error(), "not found") {
+									continue
 								}
+								return throwErrorJS(ctx, err)
+							}
+							if !deps.Has(m.name) {
+								deps = append(deps, *m)
+							}
+						case "exports":
+							if !includes(exports, p) {
+								exports = append(exports, p)
 							}
 						}
 					}
@@ -397,6 +426,8 @@ func query() rex.Handle {
 			}
 		}
 
+		sort.Strings(exports)
+
 		// check whether it is `bare` mode, this is for CDN fetching
 		if hasBuildVerPrefix && endsWith(pathname, ".js") {
 			a := strings.Split(reqPkg.submodule, "/")
@@ -407,6 +438,10 @@ func query() rex.Handle {
 						submodule = strings.TrimSuffix(submodule, ".bundle")
 						bundleMode = true
 					}
+					if endsWith(submodule, ".sourcemap") {
+						submodule = strings.TrimSuffix(submodule, ".sourcemap")
+						sourcemap = true
+					}
 					if endsWith(submodule, ".development") {
 						submodule = strings.TrimSuffix(submodule, ".development")
 						isDev = true
@@ -454,7 +489,7 @@ func query() rex.Handle {
 				return rex.Status(500, err.Error())
 			}
 			if !exists {
-				c := buildQueue.Add(task)
+				c := buildQueue.Add(task, PriorityInteractive)
 				select {
 				case output := <-c.C:
 					if output.err != nil {
@@ -464,31 +499,39 @@ func query() rex.Handle {
 						savePath = path.Join("types", output.esm.Dts)
 						exists = true
 					}
-				case <-time.After(time.Minute):
+				case <-ctx.R.Context().Done():
+					// the client is gone, the task is canceled if nobody else waits for it
 					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "canceled")
+				case <-time.After(time.Minute):
+					// keep the consumer to finish the task for the later requests
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try later!")
 				}
 			}
 			if !exists {
 				return rex.Status(404, "File not found")
 			}
-			r, err := fs.ReadFile(savePath)
+			accessTimes.Touch(savePath)
+			ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
+			name, r, err := readStoredFile(ctx, savePath)
 			if err != nil {
 				return rex.Status(500, err.Error())
 			}
-			ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
 			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-			return rex.Content(savePath, modtime, r)
+			ctx.SetHeader("Cache-Tag", cacheTags(reqPkg.name, reqPkg.version, "types"))
+			return rex.Content(name, modtime, r)
 		}
 
 		task := &buildTask{
-			stage:  "init",
-			pkg:    *reqPkg,
-			deps:   deps,
-			alias:  alias,
-			target: target,
-			isDev:  isDev,
-			bundle: bundleMode,
+			stage:     "init",
+			pkg:       *reqPkg,
+			deps:      deps,
+			alias:     alias,
+			target:    target,
+			isDev:     isDev,
+			sourcemap: sourcemap,
+			bundle:    bundleMode,
+			exports:   exports,
 		}
 		taskID := task.ID()
 		esm, err := findESM(taskID)
@@ -509,17 +552,24 @@ func query() rex.Handle {
 			// or wait the current build task for 60 seconds
 			if err == nil {
 				// todo: maybe don't build
-				buildQueue.Add(task)
+				buildQueue.Add(task, PriorityBackground)
 			} else {
-				c := buildQueue.Add(task)
+				c := buildQueue.Add(task, PriorityInteractive)
 				select {
 				case output := <-c.C:
 					if output.err != nil {
+						if errors.Is(output.err, errUnknownExport) {
+							return rex.Status(400, output.err.Error())
+						}
 						return throwErrorJS(ctx, output.err)
 					}
 					esm = output.esm
-				case <-time.After(time.Minute):
+				case <-ctx.R.Context().Done():
+					// the client is gone, the task is canceled if nobody else waits for it
 					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "canceled")
+				case <-time.After(time.Minute):
+					// keep the consumer to finish the task for the later requests
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try later!")
 				}
 			}
@@ -554,21 +604,19 @@ func query() rex.Handle {
 			if !exists {
 				return rex.Status(404, "File not found")
 			}
-			r, err := fs.ReadFile(savePath)
+			accessTimes.Touch(savePath)
+			name, r, err := readStoredFile(ctx, savePath)
 			if err != nil {
 				return rex.Status(500, err.Error())
 			}
+			setIntegrityHeader(ctx, esm.Integrity)
 			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-			return rex.Content(savePath, modtime, r)
+			ctx.SetHeader("Cache-Tag", buildCacheTags(taskID, "builds"))
+			return rex.Content(name, modtime, r)
 		}
 
 		buf := bytes.NewBuffer(nil)
-		origin := "/"
-		if cdnDomain == "localhost" || strings.HasPrefix(cdnDomain, "localhost:") {
-			origin = fmt.Sprintf("http://%s/", cdnDomain)
-		} else if cdnDomain != "" {
-			origin = fmt.Sprintf("https://%s/", cdnDomain)
-		}
+		origin := getOrigin()
 
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, "\n")
 		fmt.Fprintf(buf, `export * from "%s%s";%s`, origin, taskID, "\n")
@@ -591,13 +639,65 @@ func query() rex.Handle {
 			ctx.SetHeader("X-TypeScript-Types", value)
 			ctx.SetHeader("Access-Control-Expose-Headers", "X-TypeScript-Types")
 		}
-		ctx.SetHeader("Cache-Tag", "entry")
+		setIntegrityHeader(ctx, computeIntegrity(buf.Bytes()))
+		ctx.SetHeader("Cache-Tag", cacheTags(reqPkg.name, reqPkg.version, "entry"))
 		ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", refreshDuration))
 		ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
 		return buf
 	}
 }
 
+// getBuildTarget returns the build target by the `target` query or the user agent
+func getBuildTarget(ctx *rex.Context) string {
+	ua := ctx.R.UserAgent()
+	if strings.HasPrefix(ua, "Deno/") {
+		return "deno"
+	}
+
+	target := strings.ToLower(ctx.Form.Value("target"))
+	if _, ok := targets[target]; ok {
+		return target
+	}
+
+	target = "es2015"
+	name, version := user_agent.New(ua).Browser()
+	if engine, ok := engines[strings.ToLower(name)]; ok {
+		a := strings.Split(version, ".")
+		if len(a) > 3 {
+			version = strings.Join(a[:3], ".")
+		}
+		unspportEngineFeatures := validateEngineFeatures(api.Engine{
+			Name:    engine,
+			Version: version,
+		})
+		for _, t := range []string{
+			"es2021",
+			"es2020",
+			"es2019",
+			"es2018",
+			"es2017",
+			"es2016",
+		} {
+			unspportESMAFeatures := validateESMAFeatures(targets[t])
+			if unspportEngineFeatures <= unspportESMAFeatures {
+				target = t
+				break
+			}
+		}
+	}
+	return target
+}
+
+// getOrigin returns the origin of the CDN, or "/" if the `cdnDomain` is not set
+func getOrigin() string {
+	if cdnDomain == "localhost" || strings.HasPrefix(cdnDomain, "localhost:") {
+		return fmt.Sprintf("http://%s/", cdnDomain)
+	} else if cdnDomain != "" {
+		return fmt.Sprintf("https://%s/", cdnDomain)
+	}
+	return "/"
+}
+
 func throwErrorJS(ctx *rex.Context, err error) interface{} {
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, "/* esm.sh - error */\n")
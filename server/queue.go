@@ -2,9 +2,14 @@ package server
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"esm.sh/server/storage"
 )
 
 // A Queue for esbuild
@@ -14,6 +19,35 @@ type BuildQueue struct {
 	tasks        map[string]*task
 	processes    []*task
 	maxProcesses int
+	db           storage.DB
+	shared       SharedQueue
+}
+
+// BuildPriority defines the priority class of a build task, the lower value runs first.
+type BuildPriority int
+
+const (
+	// PriorityInteractive is for the requests waiting for the build
+	PriorityInteractive BuildPriority = iota
+	// PriorityBackground is for the rebuilds in background, e.g. the previous build version fallback
+	PriorityBackground
+	// PriorityPrefetch is for the dependency pre-builds
+	PriorityPrefetch
+)
+
+// a waiting task is promoted one priority class per `priorityAging`, that prevents starvation
+const priorityAging = 30 * time.Second
+
+func (p BuildPriority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBackground:
+		return "background"
+	case PriorityPrefetch:
+		return "prefetch"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
 }
 
 type BuildQueueConsumer struct {
@@ -25,31 +59,88 @@ type BuildOutput struct {
 	err error
 }
 
+// errBuildCanceled is returned to the consumers of a canceled task
+var errBuildCanceled = errors.New("build canceled")
+
 type task struct {
 	*buildTask
+	ctx        context.Context
+	cancel     context.CancelFunc
 	inProcess  bool
 	el         *list.Element
 	createTime time.Time
 	startTime  time.Time
 	consumers  []*BuildQueueConsumer
+	attempts   int
+	priority   BuildPriority
+}
+
+// effectivePriority returns the priority promoted by the wait time
+func (t *task) effectivePriority(now time.Time) BuildPriority {
+	return agedPriority(t.priority, t.createTime, now)
+}
+
+func agedPriority(priority BuildPriority, createTime time.Time, now time.Time) BuildPriority {
+	p := priority - BuildPriority(now.Sub(createTime)/priorityAging)
+	if p < PriorityInteractive {
+		return PriorityInteractive
+	}
+	return p
+}
+
+// WaitTime returns the duration that the task waited in the queue
+func (t *task) WaitTime() time.Duration {
+	if t.inProcess {
+		return t.startTime.Sub(t.createTime)
+	}
+	return time.Now().Sub(t.createTime)
+}
+
+// fairnessKey returns the key to share the processes fairly, the packages of
+// a scope (monorepo) share the same key.
+func (t *task) fairnessKey() string {
+	if strings.HasPrefix(t.pkg.name, "@") {
+		return strings.Split(t.pkg.name, "/")[0]
+	}
+	return t.pkg.name
 }
 
-func (t *task) run() BuildOutput {
+func (t *task) run() (output BuildOutput) {
+	ctx, cancel := context.WithTimeout(t.ctx, buildTimeouts.Total)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		buildsTotal.Inc(t.target, metricResult(output.err))
+		buildDuration.ObserveSince(start, t.target)
+		if output.err != nil {
+			buildFailuresTotal.Inc(t.stage, t.target)
+		}
+	}()
+
 	c := make(chan BuildOutput, 1)
 	go func(c chan BuildOutput) {
-		esm, err := t.Build()
+		esm, err := t.Build(ctx)
 		c <- BuildOutput{esm, err}
 	}(c)
 
-	var output BuildOutput
 	select {
 	case output = <-c:
 		if output.err != nil {
 			log.Errorf("buildESM: %v", output.err)
 		}
-	case <-time.After(15 * time.Minute):
-		output = BuildOutput{err: fmt.Errorf("build timeout")}
-		log.Errorf("buildESM(%s): timeout", t.ID())
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			output = BuildOutput{err: fmt.Errorf("build timeout")}
+			log.Errorf("buildESM(%s): timeout", t.ID())
+		} else {
+			output = BuildOutput{err: errBuildCanceled}
+			log.Warnf("buildESM(%s): canceled", t.ID())
+		}
+		// wait for the build goroutine to exit at the next check of the context, the child
+		// processes are killed by the context. The slot is not released before that, or the
+		// next task may write the same files.
+		<-c
 	}
 
 	return output
@@ -72,13 +163,21 @@ func (q *BuildQueue) Len() int {
 	return q.list.Len()
 }
 
-// Add adds a new build task.
-func (q *BuildQueue) Add(build *buildTask) *BuildQueueConsumer {
+// Add adds a new build task with the priority, the priority of an existing task is
+// raised if the new one is higher.
+func (q *BuildQueue) Add(build *buildTask, priority BuildPriority) *BuildQueueConsumer {
+	return q.add(build, priority, 0)
+}
+
+func (q *BuildQueue) add(build *buildTask, priority BuildPriority, attempts int) *BuildQueueConsumer {
 	c := &BuildQueueConsumer{make(chan BuildOutput, 1)}
 	q.lock.Lock()
 	t, ok := q.tasks[build.ID()]
 	if ok {
 		t.consumers = append(t.consumers, c)
+		if priority < t.priority {
+			t.priority = priority
+		}
 	}
 	q.lock.Unlock()
 
@@ -86,50 +185,175 @@ func (q *BuildQueue) Add(build *buildTask) *BuildQueueConsumer {
 		return c
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	t = &task{
 		buildTask:  build,
+		ctx:        ctx,
+		cancel:     cancel,
 		createTime: time.Now(),
 		consumers:  []*BuildQueueConsumer{c},
+		attempts:   attempts,
+		priority:   priority,
 	}
 	q.lock.Lock()
 	t.el = q.list.PushBack(t)
 	q.tasks[build.ID()] = t
 	q.lock.Unlock()
 
+	if q.shared != nil {
+		q.lock.Lock()
+		t.inProcess = true
+		q.lock.Unlock()
+		go q.watch(t)
+		return c
+	}
+
+	q.saveState(t, taskQueued)
 	q.next()
 
 	return c
 }
 
-func (q *BuildQueue) RemoveConsumer(task *buildTask, c *BuildQueueConsumer) {
+// UseSharedQueue makes the queue enqueue the tasks into the shared queue instead of building
+// them locally, the tasks are built by the workers.
+func (q *BuildQueue) UseSharedQueue(shared SharedQueue) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	q.shared = shared
+}
+
+// watch waits for the task that is built by the workers of the shared queue.
+func (q *BuildQueue) watch(t *task) {
+	t.startTime = time.Now()
+	output := q.waitShared(t)
+
+	q.lock.Lock()
+	q.list.Remove(t.el)
+	delete(q.tasks, t.ID())
+	q.lock.Unlock()
+
+	log.Debugf(
+		"BuildQueue(%s,%s) done by workers in %s",
+		t.pkg.String(),
+		t.target,
+		time.Now().Sub(t.startTime),
+	)
+
+	for _, c := range t.consumers {
+		c.C <- output
+	}
+}
+
+func (q *BuildQueue) waitShared(t *task) BuildOutput {
+	record := newBuildTaskRecord(t.buildTask)
+	_, err := q.shared.Enqueue(record, t.priority)
+	if err != nil {
+		return BuildOutput{err: fmt.Errorf("enqueue shared task: %v", err)}
+	}
+
+	ticker := time.NewTicker(sharedQueuePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return BuildOutput{err: errBuildCanceled}
+		case <-ticker.C:
+		}
+
+		st, err := q.shared.State(t.ID())
+		if err == storage.ErrNotFound {
+			esm, err := findESM(t.ID())
+			if err == nil {
+				return BuildOutput{esm: esm}
+			}
+			// the task is dropped, enqueue it again
+			st = &SharedTask{State: taskQueued}
+		} else if err != nil {
+			log.Errorf("shared task %s: %v", t.ID(), err)
+			continue
+		}
+
+		switch st.State {
+		case taskFailed:
+			// the error of the worker is a message, the unknown export error is wrapped again
+			if msg := strings.TrimPrefix(st.Error, errUnknownExport.Error()); msg != st.Error {
+				return BuildOutput{err: fmt.Errorf("%w%s", errUnknownExport, msg)}
+			}
+			return BuildOutput{err: errors.New(st.Error)}
+		case taskQueued:
+			// keep the task in the index, and raise the priority for the new consumers
+			q.lock.RLock()
+			priority := t.priority
+			q.lock.RUnlock()
+			_, err = q.shared.Enqueue(record, priority)
+			if err != nil {
+				log.Errorf("enqueue shared task %s: %v", t.ID(), err)
+			}
+		}
+		if time.Now().Sub(t.startTime) > 2*buildTimeouts.Total {
+			return BuildOutput{err: fmt.Errorf("build timeout")}
+		}
+	}
+}
+
+// RemoveConsumer detaches the consumer from the task, the task is canceled if it has no consumers.
+func (q *BuildQueue) RemoveConsumer(task *buildTask, c *BuildQueueConsumer) {
+	q.lock.Lock()
 	t, ok := q.tasks[task.ID()]
 	if ok {
 		consumers := make([]*BuildQueueConsumer, len(t.consumers))
 		i := 0
 		for _, _c := range t.consumers {
 			if _c != c {
-				consumers[i] = c
+				consumers[i] = _c
 				i++
 			}
 		}
 		t.consumers = consumers[0:i]
+		ok = i == 0
+	}
+	q.lock.Unlock()
+
+	if ok {
+		q.Cancel(task.ID())
 	}
 }
 
+// Cancel cancels the task by ID, a queued task is removed from the queue and a running
+// task is stopped. It returns false if the task is not found.
+func (q *BuildQueue) Cancel(id string) bool {
+	q.lock.Lock()
+	t, ok := q.tasks[id]
+	if !ok {
+		q.lock.Unlock()
+		return false
+	}
+	if t.inProcess {
+		q.lock.Unlock()
+		// the `wait` cleans up the task after the build exits
+		t.cancel()
+		return true
+	}
+	q.list.Remove(t.el)
+	delete(q.tasks, id)
+	q.lock.Unlock()
+
+	t.cancel()
+	q.saveState(t, taskFailed)
+	log.Debugf("BuildQueue(%s,%s) canceled", t.pkg.String(), t.target)
+
+	for _, c := range t.consumers {
+		c.C <- BuildOutput{err: errBuildCanceled}
+	}
+	return true
+}
+
 func (q *BuildQueue) next() {
 	var nextTask *task
 	q.lock.Lock()
 	if len(q.processes) < q.maxProcesses {
-		for el := q.list.Front(); el != nil; el = el.Next() {
-			t, ok := el.Value.(*task)
-			if ok && !t.inProcess {
-				nextTask = t
-				break
-			}
-		}
+		nextTask = q.pick(time.Now())
 	}
 	q.lock.Unlock()
 
@@ -139,16 +363,43 @@ func (q *BuildQueue) next() {
 
 	q.lock.Lock()
 	nextTask.inProcess = true
+	nextTask.attempts++
 	q.processes = append(q.processes, nextTask)
 	q.lock.Unlock()
 
+	q.saveState(nextTask, taskRunning)
 	go q.wait(nextTask)
 }
 
+// pick picks the next task by the effective priority, then the task of the package that has
+// fewer running processes, then the first added one. The caller must hold the lock.
+func (q *BuildQueue) pick(now time.Time) (nextTask *task) {
+	running := map[string]int{}
+	for _, t := range q.processes {
+		running[t.fairnessKey()]++
+	}
+	var priority BuildPriority
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*task)
+		if !ok || t.inProcess {
+			continue
+		}
+		p := t.effectivePriority(now)
+		if nextTask == nil || p < priority || (p == priority && running[t.fairnessKey()] < running[nextTask.fairnessKey()]) {
+			nextTask = t
+			priority = p
+		}
+	}
+	return
+}
+
 func (q *BuildQueue) wait(t *task) {
 	t.startTime = time.Now()
+	buildQueueWait.Observe(t.startTime.Sub(t.createTime).Seconds(), t.priority.String())
 
+	stopHeartbeat := q.startHeartbeat(t)
 	output := t.run()
+	stopHeartbeat()
 
 	q.lock.Lock()
 	a := make([]*task, len(q.processes))
@@ -164,6 +415,12 @@ func (q *BuildQueue) wait(t *task) {
 	delete(q.tasks, t.ID())
 	q.lock.Unlock()
 
+	if output.err != nil {
+		q.saveState(t, taskFailed)
+	} else {
+		q.saveState(t, taskDone)
+	}
+
 	log.Debugf(
 		"BuildQueue(%s,%s) done in %s",
 		t.pkg.String(),
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+)
+
+// the states of a persisted build task
+const (
+	taskQueued  = "queued"
+	taskRunning = "running"
+	taskDone    = "done"
+	taskFailed  = "failed"
+)
+
+const (
+	// the pending tasks are found by the prefix
+	queueRecordPrefix = "build-queue:"
+	// a running task updates its heartbeat in the interval
+	heartbeatInterval = 30 * time.Second
+	// a running task without heartbeat in the timeout is abandoned
+	abandonedTimeout = 3 * heartbeatInterval
+	// the abandoned task is marked as failed after max attempts
+	maxBuildAttempts = 3
+)
+
+var hostname, _ = os.Hostname()
+
+// buildTaskRecord is the persisted form of a `buildTask`
+type buildTaskRecord struct {
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Submodule string            `json:"submodule,omitempty"`
+	Alias     map[string]string `json:"alias,omitempty"`
+	Deps      []string          `json:"deps,omitempty"`
+	Target    string            `json:"target"`
+	Bundle    bool              `json:"bundle,omitempty"`
+	IsDev     bool              `json:"isDev,omitempty"`
+	Sourcemap bool              `json:"sourcemap,omitempty"`
+	Exports   []string          `json:"exports,omitempty"`
+}
+
+func newBuildTaskRecord(task *buildTask) buildTaskRecord {
+	deps := make([]string, len(task.deps))
+	for i, dep := range task.deps {
+		deps[i] = dep.name + "@" + dep.version
+	}
+	return buildTaskRecord{
+		Name:      task.pkg.name,
+		Version:   task.pkg.version,
+		Submodule: task.pkg.submodule,
+		Alias:     task.alias,
+		Deps:      deps,
+		Target:    task.target,
+		Bundle:    task.bundle,
+		IsDev:     task.isDev,
+		Sourcemap: task.sourcemap,
+		Exports:   task.exports,
+	}
+}
+
+func (r buildTaskRecord) buildTask() *buildTask {
+	deps := make(pkgSlice, len(r.Deps))
+	for i, dep := range r.Deps {
+		name, version := utils.SplitByLastByte(dep, '@')
+		deps[i] = pkg{name: name, version: version}
+	}
+	return &buildTask{
+		stage: "init",
+		pkg: pkg{
+			name:      r.Name,
+			version:   r.Version,
+			submodule: r.Submodule,
+		},
+		alias:     r.Alias,
+		deps:      deps,
+		target:    r.Target,
+		bundle:    r.Bundle,
+		isDev:     r.IsDev,
+		sourcemap: r.Sourcemap,
+		exports:   r.Exports,
+	}
+}
+
+// taskState is the persisted state of a build task
+type taskState struct {
+	task      buildTaskRecord
+	state     string
+	attempts  int
+	priority  BuildPriority
+	host      string
+	heartbeat time.Time
+}
+
+func (s *taskState) store() storage.Store {
+	return storage.Store{
+		"task":      string(utils.MustEncodeJSON(s.task)),
+		"state":     s.state,
+		"attempts":  strconv.Itoa(s.attempts),
+		"priority":  strconv.Itoa(int(s.priority)),
+		"host":      s.host,
+		"heartbeat": strconv.FormatInt(s.heartbeat.Unix(), 10),
+	}
+}
+
+func parseTaskState(store storage.Store) (s *taskState, err error) {
+	s = &taskState{
+		state: store["state"],
+		host:  store["host"],
+	}
+	err = json.Unmarshal([]byte(store["task"]), &s.task)
+	if err != nil {
+		return nil, err
+	}
+	s.attempts, _ = strconv.Atoi(store["attempts"])
+	if priority, e := strconv.Atoi(store["priority"]); e == nil {
+		s.priority = BuildPriority(priority)
+	} else {
+		s.priority = PriorityBackground
+	}
+	if sec, e := strconv.ParseInt(store["heartbeat"], 10, 64); e == nil {
+		s.heartbeat = time.Unix(sec, 0)
+	}
+	return
+}
+
+// abandoned checks whether the running task is abandoned mid-build, that is the server
+// of the same host has been restarted, or the heartbeat is timeout.
+func (s *taskState) abandoned() bool {
+	return s.state == taskRunning && (s.host == hostname || time.Now().Sub(s.heartbeat) > abandonedTimeout)
+}
+
+// Load enables the persistence of the queue and replays the pending tasks in the db.
+func (q *BuildQueue) Load(db storage.DB) (err error) {
+	q.lock.Lock()
+	q.db = db
+	q.lock.Unlock()
+
+	var states []*taskState
+	var ids, invalid []string
+	err = db.Scan(queueRecordPrefix, func(key string, store storage.Store) bool {
+		s, err := parseTaskState(store)
+		if err != nil {
+			log.Errorf("load task %s: %v", key, err)
+			invalid = append(invalid, key)
+			return true
+		}
+		states = append(states, s)
+		ids = append(ids, strings.TrimPrefix(key, queueRecordPrefix))
+		return true
+	})
+	if err != nil {
+		return
+	}
+	for _, key := range invalid {
+		db.Delete(key)
+	}
+
+	// replay the tasks in the order of the last update
+	replay := make([]int, 0, len(states))
+	for i, s := range states {
+		id := ids[i]
+		if s.state == taskRunning {
+			if !s.abandoned() {
+				// still running on other host
+				continue
+			}
+			if s.attempts >= maxBuildAttempts {
+				log.Warnf("task %s is abandoned %d times, give up", id, s.attempts)
+				db.Delete(queueRecordPrefix + id)
+				continue
+			}
+			log.Warnf("task %s is abandoned, replay", id)
+		}
+		replay = append(replay, i)
+	}
+	sort.SliceStable(replay, func(a, b int) bool {
+		return states[replay[a]].heartbeat.Before(states[replay[b]].heartbeat)
+	})
+	for _, i := range replay {
+		q.add(states[i].task.buildTask(), states[i].priority, states[i].attempts)
+	}
+	return
+}
+
+// saveState saves the state of the task, the done/failed task is removed from the db.
+func (q *BuildQueue) saveState(t *task, state string) {
+	q.lock.RLock()
+	db := q.db
+	q.lock.RUnlock()
+
+	if db == nil {
+		return
+	}
+
+	key := queueRecordPrefix + t.ID()
+	if state == taskDone || state == taskFailed {
+		if e := db.Delete(key); e != nil {
+			log.Errorf("delete task state %s: %v", t.ID(), e)
+		}
+		return
+	}
+
+	s := &taskState{
+		task:      newBuildTaskRecord(t.buildTask),
+		state:     state,
+		attempts:  t.attempts,
+		priority:  t.priority,
+		host:      hostname,
+		heartbeat: time.Now(),
+	}
+	if e := db.Put(key, s.store()); e != nil {
+		log.Errorf("save task state %s: %v", t.ID(), e)
+	}
+}
+
+// startHeartbeat keeps the running task alive, the returned function stops it.
+func (q *BuildQueue) startHeartbeat(t *task) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				q.saveState(t, taskRunning)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestBuildQueueLoad(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-queue")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	ensureDir(testDir)
+
+	db, err := storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the queue without processes never runs tasks
+	q := newBuildQueue(0)
+	err = q.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := &buildTask{
+		pkg:    pkg{name: "react", version: "17.0.2"},
+		deps:   pkgSlice{{name: "@scope/dep", version: "1.0.0"}},
+		alias:  map[string]string{"a": "b"},
+		target: "es2020",
+	}
+	q.Add(queued, PriorityInteractive)
+
+	newTask := func(name string, state string, attempts int, host string, heartbeat time.Time) *buildTask {
+		task := &buildTask{pkg: pkg{name: name, version: "1.0.0"}, target: "es2020"}
+		s := &taskState{
+			task:      newBuildTaskRecord(task),
+			state:     state,
+			attempts:  attempts,
+			host:      host,
+			heartbeat: heartbeat,
+		}
+		err := db.Put(queueRecordPrefix+task.ID(), s.store())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+	abandoned := newTask("abandoned", taskRunning, 1, hostname, time.Now())
+	timeout := newTask("timeout", taskRunning, 1, "other", time.Now().Add(-abandonedTimeout-time.Second))
+	running := newTask("running", taskRunning, 1, "other", time.Now())
+	exhausted := newTask("exhausted", taskRunning, maxBuildAttempts, hostname, time.Now())
+
+	q2 := newBuildQueue(0)
+	err = q2.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []*buildTask{queued, abandoned, timeout} {
+		if _, ok := q2.tasks[task.ID()]; !ok {
+			t.Fatalf("task %s should be replayed", task.ID())
+		}
+	}
+	if q2.tasks[queued.ID()].deps[0].name != "@scope/dep" || q2.tasks[queued.ID()].alias["a"] != "b" {
+		t.Fatal("task fields are not restored")
+	}
+	if q2.tasks[abandoned.ID()].attempts != 1 {
+		t.Fatalf("unexpected attempts %d", q2.tasks[abandoned.ID()].attempts)
+	}
+	for _, task := range []*buildTask{running, exhausted} {
+		if _, ok := q2.tasks[task.ID()]; ok {
+			t.Fatalf("task %s should not be replayed", task.ID())
+		}
+	}
+	_, _, err = db.Get(queueRecordPrefix + exhausted.ID())
+	if err != storage.ErrNotFound {
+		t.Fatalf("the record of task %s should be deleted, but %v", exhausted.ID(), err)
+	}
+	_, _, err = db.Get(queueRecordPrefix + running.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the canceled task is removed from the db
+	if !q2.Cancel(queued.ID()) {
+		t.Fatal("the queued task should be canceled")
+	}
+	_, _, err = db.Get(queueRecordPrefix + queued.ID())
+	if err != storage.ErrNotFound {
+		t.Fatalf("the record of the canceled task should be deleted, but %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"esm.sh/server/storage"
+
+	"github.com/ije/gox/utils"
+)
+
+const (
+	sharedQueueRecordPrefix = "shared-queue:"
+	// the frontends check the state of the shared tasks in the interval
+	sharedQueuePollInterval = time.Second
+)
+
+// errLeaseLost is returned when the lease of a task is taken over by another worker
+var errLeaseLost = errors.New("lease lost")
+
+// SharedQueue is the build queue shared by the esmd instances of a cluster, the frontends
+// enqueue the tasks and the build workers claim them with leases. A task is built once
+// in the cluster, the results are stored in the shared FS and DB.
+type SharedQueue interface {
+	// Enqueue adds the task, it returns false if the task is queued or running already.
+	Enqueue(task buildTaskRecord, priority BuildPriority) (bool, error)
+	// Claim claims the next task for the worker, it returns nil if no tasks are pending.
+	Claim(worker string, lease time.Duration) (*SharedTask, error)
+	// Renew extends the lease of the task claimed by the worker.
+	Renew(id string, worker string, lease time.Duration) error
+	// Complete finishes the task claimed by the worker, the done task is removed.
+	Complete(id string, worker string, err error) error
+	// State returns the task by ID, or `storage.ErrNotFound` if the task is done.
+	State(id string) (*SharedTask, error)
+}
+
+// SharedTask is a task of the shared queue
+type SharedTask struct {
+	ID         string
+	Task       buildTaskRecord
+	State      string
+	Priority   BuildPriority
+	Attempts   int
+	Worker     string
+	Lease      time.Time
+	CreateTime time.Time
+	Error      string
+}
+
+func (t *SharedTask) store() storage.Store {
+	return storage.Store{
+		"task":       string(utils.MustEncodeJSON(t.Task)),
+		"state":      t.State,
+		"priority":   strconv.Itoa(int(t.Priority)),
+		"attempts":   strconv.Itoa(t.Attempts),
+		"worker":     t.Worker,
+		"lease":      strconv.FormatInt(t.Lease.UnixNano(), 10),
+		"createTime": strconv.FormatInt(t.CreateTime.UnixNano(), 10),
+		"error":      t.Error,
+	}
+}
+
+func parseSharedTask(id string, store storage.Store) (t *SharedTask, err error) {
+	t = &SharedTask{
+		ID:     id,
+		State:  store["state"],
+		Worker: store["worker"],
+		Error:  store["error"],
+	}
+	err = json.Unmarshal([]byte(store["task"]), &t.Task)
+	if err != nil {
+		return nil, err
+	}
+	priority, _ := strconv.Atoi(store["priority"])
+	t.Priority = BuildPriority(priority)
+	t.Attempts, _ = strconv.Atoi(store["attempts"])
+	if ns, e := strconv.ParseInt(store["lease"], 10, 64); e == nil {
+		t.Lease = time.Unix(0, ns)
+	}
+	if ns, e := strconv.ParseInt(store["createTime"], 10, 64); e == nil {
+		t.CreateTime = time.Unix(0, ns)
+	}
+	return
+}
+
+// leaseExpired checks whether the running task lost its worker
+func (t *SharedTask) leaseExpired(now time.Time) bool {
+	return t.State == taskRunning && now.After(t.Lease)
+}
+
+// dbSharedQueue is the reference `SharedQueue` that is backed by the shared `storage.DB`.
+//
+// The tasks are found by scanning the record prefix, and every change is made in a DB
+// transaction that checks the state again, so the instances don't lose each other's changes.
+// It needs a DB that can be opened by all the instances of the cluster, like the `redis` db,
+// the `postdb` and `bolt` dbs lock the file exclusively.
+type dbSharedQueue struct {
+	db storage.DB
+}
+
+func newDBSharedQueue(db storage.DB) *dbSharedQueue {
+	return &dbSharedQueue{db: db}
+}
+
+func (q *dbSharedQueue) Enqueue(task buildTaskRecord, priority BuildPriority) (ok bool, err error) {
+	id := task.buildTask().ID()
+	err = q.db.Update(func(tx storage.DBTx) error {
+		ok = false
+		t, err := getSharedTask(tx, id)
+		if err == nil && t.State != taskFailed {
+			if t.State == taskQueued && priority < t.Priority {
+				t.Priority = priority
+				return tx.Put(sharedQueueRecordPrefix+id, t.store())
+			}
+			return nil
+		}
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		t = &SharedTask{
+			ID:         id,
+			Task:       task,
+			State:      taskQueued,
+			Priority:   priority,
+			CreateTime: time.Now(),
+		}
+		ok = true
+		return tx.Put(sharedQueueRecordPrefix+id, t.store())
+	})
+	if err != nil {
+		ok = false
+	}
+	return
+}
+
+func (q *dbSharedQueue) Claim(worker string, lease time.Duration) (*SharedTask, error) {
+	now := time.Now()
+	var next *SharedTask
+	var priority BuildPriority
+	var exhausted []string
+	err := q.db.Scan(sharedQueueRecordPrefix, func(key string, store storage.Store) bool {
+		t, err := parseSharedTask(strings.TrimPrefix(key, sharedQueueRecordPrefix), store)
+		if err != nil {
+			log.Errorf("shared task %s: %v", key, err)
+			return true
+		}
+		if t.leaseExpired(now) && t.Attempts >= maxBuildAttempts {
+			exhausted = append(exhausted, t.ID)
+			return true
+		}
+		if t.State != taskQueued && !t.leaseExpired(now) {
+			return true
+		}
+		p := agedPriority(t.Priority, t.CreateTime, now)
+		if next == nil || p < priority || (p == priority && t.CreateTime.Before(next.CreateTime)) {
+			next = t
+			priority = p
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range exhausted {
+		err = q.db.Update(func(tx storage.DBTx) error {
+			t, err := getSharedTask(tx, id)
+			if err != nil || !t.leaseExpired(now) || t.Attempts < maxBuildAttempts {
+				if err == storage.ErrNotFound {
+					err = nil
+				}
+				return err
+			}
+			log.Warnf("shared task %s is abandoned %d times, give up", id, t.Attempts)
+			t.State = taskFailed
+			t.Error = "abandoned"
+			return tx.Put(sharedQueueRecordPrefix+id, t.store())
+		})
+		if err != nil {
+			log.Errorf("shared task %s: %v", id, err)
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	// check the state again in the transaction in case another instance claimed the task
+	var claimed *SharedTask
+	err = q.db.Update(func(tx storage.DBTx) error {
+		claimed = nil
+		t, err := getSharedTask(tx, next.ID)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				err = nil
+			}
+			return err
+		}
+		if t.State != taskQueued && !t.leaseExpired(now) {
+			return nil
+		}
+		t.State = taskRunning
+		t.Worker = worker
+		t.Lease = now.Add(lease)
+		t.Attempts++
+		claimed = t
+		return tx.Put(sharedQueueRecordPrefix+t.ID, t.store())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (q *dbSharedQueue) Renew(id string, worker string, lease time.Duration) error {
+	return q.db.Update(func(tx storage.DBTx) error {
+		t, err := getClaimedTask(tx, id, worker)
+		if err != nil {
+			return err
+		}
+		t.Lease = time.Now().Add(lease)
+		return tx.Put(sharedQueueRecordPrefix+id, t.store())
+	})
+}
+
+func (q *dbSharedQueue) Complete(id string, worker string, buildErr error) error {
+	return q.db.Update(func(tx storage.DBTx) error {
+		t, err := getClaimedTask(tx, id, worker)
+		if err != nil {
+			return err
+		}
+		if buildErr != nil {
+			t.State = taskFailed
+			t.Error = buildErr.Error()
+			return tx.Put(sharedQueueRecordPrefix+id, t.store())
+		}
+		return tx.Delete(sharedQueueRecordPrefix + id)
+	})
+}
+
+func (q *dbSharedQueue) State(id string) (*SharedTask, error) {
+	return getSharedTask(q.db, id)
+}
+
+func getSharedTask(tx storage.DBTx, id string) (*SharedTask, error) {
+	store, _, err := tx.Get(sharedQueueRecordPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	return parseSharedTask(id, store)
+}
+
+// getClaimedTask returns the task that is claimed by the worker
+func getClaimedTask(tx storage.DBTx, id string, worker string) (*SharedTask, error) {
+	t, err := getSharedTask(tx, id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			err = errLeaseLost
+		}
+		return nil, err
+	}
+	if t.State != taskRunning || t.Worker != worker {
+		return nil, errLeaseLost
+	}
+	return t, nil
+}
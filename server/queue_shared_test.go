@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	"esm.sh/server/storage/redistest"
+)
+
+func TestDBSharedQueue(t *testing.T) {
+	t.Run("postdb", func(t *testing.T) {
+		testDir := path.Join(os.TempDir(), "esmd-testing-shared-queue")
+		os.RemoveAll(testDir)
+		defer os.RemoveAll(testDir)
+		ensureDir(testDir)
+
+		db, err := storage.OpenDB("postdb:" + path.Join(testDir, "esm.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		testDBSharedQueue(t, func() storage.DB { return db })
+	})
+
+	// the instances connect to the redis server with their own db handles
+	t.Run("redis", func(t *testing.T) {
+		server, err := redistest.NewServer("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		var dbs []storage.DB
+		defer func() {
+			for _, db := range dbs {
+				db.Close()
+			}
+		}()
+		testDBSharedQueue(t, func() storage.DB {
+			db, err := storage.OpenDB("redis:" + server.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbs = append(dbs, db)
+			return db
+		})
+	})
+}
+
+// testDBSharedQueue tests the queue with the db handles of the instances that are returned by the open
+func testDBSharedQueue(t *testing.T, open func() storage.DB) {
+	db := open()
+	q := newDBSharedQueue(db)
+	newRecord := func(name string) buildTaskRecord {
+		return newBuildTaskRecord(&buildTask{pkg: pkg{name: name, version: "1.0.0"}, target: "es2020"})
+	}
+	react := newRecord("react")
+	vue := newRecord("vue")
+	reactID := react.buildTask().ID()
+	vueID := vue.buildTask().ID()
+
+	for _, r := range []buildTaskRecord{react, vue} {
+		ok, err := q.Enqueue(r, PriorityBackground)
+		if err != nil || !ok {
+			t.Fatalf("enqueue %s: %v %v", r.Name, ok, err)
+		}
+	}
+	// the duplicate task is suppressed, but the priority is raised
+	ok, err := q.Enqueue(vue, PriorityInteractive)
+	if err != nil || ok {
+		t.Fatalf("the duplicate task should not be enqueued: %v", err)
+	}
+
+	st, err := q.Claim("worker-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || st.ID != vueID || st.Worker != "worker-1" || st.Attempts != 1 {
+		t.Fatalf("should claim '%s', but %v", vueID, st)
+	}
+	st, err = q.Claim("worker-2", 50*time.Millisecond)
+	if err != nil || st == nil || st.ID != reactID {
+		t.Fatalf("should claim '%s', but %v %v", reactID, st, err)
+	}
+	if st, _ = q.Claim("worker-3", time.Minute); st != nil {
+		t.Fatalf("should claim nothing, but %v", st)
+	}
+
+	// the lease of `worker-2` is expired
+	time.Sleep(60 * time.Millisecond)
+	st, err = q.Claim("worker-3", time.Minute)
+	if err != nil || st == nil || st.ID != reactID || st.Attempts != 2 {
+		t.Fatalf("should take over '%s', but %v %v", reactID, st, err)
+	}
+	if err = q.Renew(reactID, "worker-2", time.Minute); err != errLeaseLost {
+		t.Fatalf("should be lease lost error, but %v", err)
+	}
+	if err = q.Renew(reactID, "worker-3", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	err = q.Complete(vueID, "worker-1", errors.New("esbuild: error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = q.State(vueID)
+	if err != nil || st.State != taskFailed || st.Error != "esbuild: error" {
+		t.Fatalf("the task should be failed, but %v %v", st, err)
+	}
+	// the failed task can be enqueued again
+	if ok, err = q.Enqueue(vue, PriorityInteractive); err != nil || !ok {
+		t.Fatalf("the failed task should be enqueued again: %v", err)
+	}
+
+	err = q.Complete(reactID, "worker-3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.State(reactID); err != storage.ErrNotFound {
+		t.Fatalf("the done task should be removed, but %v", err)
+	}
+	var ids []string
+	err = db.Scan(sharedQueueRecordPrefix, func(id string, store storage.Store) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != sharedQueueRecordPrefix+vueID {
+		t.Fatalf("unexpected records %v", ids)
+	}
+
+	// the instances enqueue the same task concurrently, only one of them adds it
+	svelte := newRecord("svelte")
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		q := newDBSharedQueue(open())
+		go func() {
+			defer wg.Done()
+			ok, err := q.Enqueue(svelte, PriorityBackground)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("the task should be added once, but %d", added)
+	}
+
+	// the workers claim the tasks concurrently, every task is claimed once
+	for _, name := range []string{"preact", "lit"} {
+		if ok, err = q.Enqueue(newRecord(name), PriorityBackground); err != nil || !ok {
+			t.Fatalf("enqueue %s: %v %v", name, ok, err)
+		}
+	}
+	var lock sync.Mutex
+	claims := map[string]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		q := newDBSharedQueue(open())
+		go func(worker string) {
+			defer wg.Done()
+			for {
+				st, err := q.Claim(worker, time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if st == nil {
+					return
+				}
+				lock.Lock()
+				claims[st.ID]++
+				lock.Unlock()
+			}
+		}(fmt.Sprintf("worker-%d", i))
+	}
+	wg.Wait()
+	if len(claims) != 4 {
+		t.Fatalf("should claim 4 tasks, but %v", claims)
+	}
+	for id, n := range claims {
+		if n != 1 {
+			t.Fatalf("the task '%s' is claimed %d times", id, n)
+		}
+	}
+}
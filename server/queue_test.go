@@ -0,0 +1,100 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildQueuePick(t *testing.T) {
+	// the queue without processes never runs tasks
+	q := newBuildQueue(0)
+	newTask := func(name string) *buildTask {
+		return &buildTask{pkg: pkg{name: name, version: "1.0.0"}, target: "es2020"}
+	}
+
+	q.Add(newTask("dep"), PriorityPrefetch)
+	q.Add(newTask("prev"), PriorityBackground)
+	q.Add(newTask("@babel/core"), PriorityInteractive)
+	q.Add(newTask("@babel/parser"), PriorityInteractive)
+	q.Add(newTask("react"), PriorityInteractive)
+
+	now := time.Now()
+	pickAndRun := func(name string) {
+		t.Helper()
+		next := q.pick(now)
+		if next == nil || next.pkg.name != name {
+			t.Fatalf("should pick '%s', but %v", name, next)
+		}
+		next.inProcess = true
+		q.processes = append(q.processes, next)
+	}
+
+	pickAndRun("@babel/core")
+	// `@babel/parser` shares the processes with `@babel/core`
+	pickAndRun("react")
+	pickAndRun("@babel/parser")
+	pickAndRun("prev")
+
+	// raise the priority of an existing task
+	q.Add(newTask("dep2"), PriorityPrefetch)
+	q.Add(newTask("dep2"), PriorityBackground)
+	if p := q.tasks[newTask("dep2").ID()].priority; p != PriorityBackground {
+		t.Fatalf("unexpected priority %v", p)
+	}
+	pickAndRun("dep2")
+
+	// the waiting task is promoted by the aging
+	q.Add(newTask("vue"), PriorityInteractive)
+	now = now.Add(2 * priorityAging)
+	if p := q.tasks[newTask("dep").ID()].effectivePriority(now); p != PriorityInteractive {
+		t.Fatalf("unexpected effective priority %v", p)
+	}
+	pickAndRun("dep")
+	pickAndRun("vue")
+
+	if next := q.pick(now); next != nil {
+		t.Fatalf("should pick nothing, but %v", next)
+	}
+}
+
+func TestBuildQueueCancel(t *testing.T) {
+	// the queue without processes never runs tasks
+	q := newBuildQueue(0)
+	bt := &buildTask{pkg: pkg{name: "react", version: "17.0.2"}, target: "es2020"}
+
+	c1 := q.Add(bt, PriorityInteractive)
+	c2 := q.Add(bt, PriorityInteractive)
+	q.RemoveConsumer(bt, c1)
+	if q.Len() != 1 || len(q.tasks[bt.ID()].consumers) != 1 || q.tasks[bt.ID()].consumers[0] != c2 {
+		t.Fatal("the task should be kept with the other consumer")
+	}
+
+	// the task without consumers is canceled
+	q.RemoveConsumer(bt, c2)
+	if q.Len() != 0 {
+		t.Fatal("the task should be canceled")
+	}
+
+	c := q.Add(bt, PriorityBackground)
+	if !q.Cancel(bt.ID()) || q.Cancel(bt.ID()) {
+		t.Fatal("the task should be canceled once")
+	}
+	if output := <-c.C; output.err != errBuildCanceled {
+		t.Fatalf("should be canceled error, but %v", output.err)
+	}
+}
+
+func TestParseBuildTimeouts(t *testing.T) {
+	timeouts, err := parseBuildTimeouts("install=1m, total=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts.Install != time.Minute || timeouts.Total != 10*time.Minute || timeouts.Build != buildTimeouts.Build {
+		t.Fatalf("unexpected timeouts %v", timeouts)
+	}
+	for _, s := range []string{"install", "install=-1m", "link=1m"} {
+		if _, err := parseBuildTimeouts(s); err == nil {
+			t.Fatalf("'%s' should be invalid", s)
+		}
+	}
+}
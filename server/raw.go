@@ -0,0 +1,96 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// the max size of the raw files that are served from the package tarballs
+var rawFileMaxSize int64 = 20 << 20
+
+var (
+	errRawFileNotFound = errors.New("file not found")
+	errRawFileTooLarge = errors.New("file too large")
+)
+
+// fetchRawFile reads a file of the package from its tarball, the tarball is cached by the
+// npm installer, so the raw files are served without a CDN like unpkg.
+func fetchRawFile(ctx context.Context, m pkg) (data []byte, err error) {
+	info, _, _, err := getPackageInfo("", m.name, m.version)
+	if err != nil {
+		return
+	}
+	// the cached package info of previous versions has no dist
+	if info.Dist == nil {
+		info, err = cachePackageInfo(m.name, m.version)
+		if err != nil {
+			return
+		}
+	}
+	if info.Dist == nil || info.Dist.Tarball == "" {
+		err = fmt.Errorf("missing tarball of %s@%s", info.Name, info.Version)
+		return
+	}
+
+	tarball, err := fetchNpmTarball(ctx, info)
+	if err != nil {
+		return
+	}
+	return readTarballFile(tarball, m.submodule, rawFileMaxSize)
+}
+
+// readTarballFile reads a regular file of the npm tarball by the name which has no top-level
+// directory (usually `package/`), the directories are never listed.
+func readTarballFile(filename string, name string, maxSize int64) (data []byte, err error) {
+	name = path.Clean(name)
+	if name == "." || name == "" || name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return nil, errRawFileNotFound
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		var h *tar.Header
+		h, err = tr.Next()
+		if err == io.EOF {
+			return nil, errRawFileNotFound
+		}
+		if err != nil {
+			return
+		}
+
+		_, entryName := utils.SplitByFirstByte(strings.TrimPrefix(h.Name, "./"), '/')
+		if path.Clean(entryName) != name {
+			continue
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			// the directories and links
+			return nil, errRawFileNotFound
+		}
+		if h.Size > maxSize {
+			return nil, errRawFileTooLarge
+		}
+		return ioutil.ReadAll(io.LimitReader(tr, maxSize))
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+)
+
+func TestFetchRawFile(t *testing.T) {
+	testDir := path.Join(os.TempDir(), "esmd-testing-raw")
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	var err error
+	cache, err = storage.OpenCache("memory:raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node = &Node{npmRegistry: registry.URL + "/"}
+	npmCacheDir = path.Join(testDir, "cache")
+	defer func(maxSize int64) { rawFileMaxSize = maxSize }(rawFileMaxSize)
+	rawFileMaxSize = 1024
+
+	css := "body { color: red; }"
+	registry.publish("foo", "1.0.0", nil, map[string]string{
+		"index.js":         "export default 1",
+		"dist/style.css":   css,
+		"dist/big.wasm":    strings.Repeat("x", 2048),
+		"dist/fonts/a.ttf": "font",
+		"..foo.js":         "export {}",
+	})
+
+	data, err := fetchRawFile(context.Background(), pkg{name: "foo", version: "1.0.0", submodule: "dist/style.css"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != css {
+		t.Fatalf("unexpected content '%s'", data)
+	}
+
+	// the names that start with dots are not the parent dir
+	data, err = fetchRawFile(context.Background(), pkg{name: "foo", version: "1.0.0", submodule: "..foo.js"})
+	if err != nil || string(data) != "export {}" {
+		t.Fatalf("unexpected content '%s' of ..foo.js: %v", data, err)
+	}
+
+	for submodule, expected := range map[string]error{
+		"dist/missing.css": errRawFileNotFound,
+		"dist":             errRawFileNotFound,
+		"dist/fonts":       errRawFileNotFound,
+		"../package.json":  errRawFileNotFound,
+		"dist/big.wasm":    errRawFileTooLarge,
+	} {
+		_, err = fetchRawFile(context.Background(), pkg{name: "foo", version: "1.0.0", submodule: submodule})
+		if err != expected {
+			t.Fatalf("should be '%v' error of %s, but %v", expected, submodule, err)
+		}
+	}
+
+	// read from the tarball cache
+	registry.tarballs = map[string][]byte{}
+	data, err = fetchRawFile(context.Background(), pkg{name: "foo", version: "1.0.0", submodule: "dist/fonts/a.ttf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "font" {
+		t.Fatalf("unexpected content '%s'", data)
+	}
+}
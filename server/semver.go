@@ -0,0 +1,330 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	regSemverPartial  = regexp.MustCompile(`^v?(\d+|[xX*])(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?(?:-([0-9A-Za-z\-\.]+))?(?:\+[0-9A-Za-z\-\.]+)?$`)
+	regSemverOperator = regexp.MustCompile(`(<=|>=|<|>|=|~>|~|\^)\s+`)
+)
+
+// semver defines a semantic version, see https://semver.org
+type semver struct {
+	major      int64
+	minor      int64
+	patch      int64
+	prerelease []string
+}
+
+func parseSemver(s string) (*semver, error) {
+	major, minor, patch, prerelease, err := parseSemverPartial(strings.TrimPrefix(strings.TrimSpace(s), "="))
+	if err != nil {
+		return nil, err
+	}
+	if major < 0 || minor < 0 || patch < 0 {
+		return nil, fmt.Errorf("invalid version '%s'", s)
+	}
+	return &semver{major, minor, patch, prerelease}, nil
+}
+
+// parseSemverPartial parses a (partial) version like `1`, `1.2`, `1.x`, `1.2.3-beta.1`,
+// the missing or wildcard parts are returned as -1.
+func parseSemverPartial(s string) (major int64, minor int64, patch int64, prerelease []string, err error) {
+	m := regSemverPartial.FindStringSubmatch(s)
+	if m == nil {
+		err = fmt.Errorf("invalid version '%s'", s)
+		return
+	}
+	parts := []int64{-1, -1, -1}
+	for i := 0; i < 3; i++ {
+		if p := m[i+1]; p != "" && p != "x" && p != "X" && p != "*" {
+			parts[i], err = strconv.ParseInt(p, 10, 64)
+			if err != nil {
+				return
+			}
+		} else {
+			break
+		}
+	}
+	if m[4] != "" {
+		prerelease = strings.Split(m[4], ".")
+	}
+	return parts[0], parts[1], parts[2], prerelease, nil
+}
+
+func (v *semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if len(v.prerelease) > 0 {
+		s += "-" + strings.Join(v.prerelease, ".")
+	}
+	return s
+}
+
+// compare returns -1 if v < other, 1 if v > other, or 0 if they are equal
+func (v *semver) compare(other *semver) int {
+	for _, d := range []int64{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	// a version without prerelease has a higher precedence
+	a, b := v.prerelease, other.prerelease
+	if len(a) == 0 || len(b) == 0 {
+		if len(a) == len(b) {
+			return 0
+		}
+		if len(a) == 0 {
+			return 1
+		}
+		return -1
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		an, aErr := strconv.ParseInt(a[i], 10, 64)
+		bn, bErr := strconv.ParseInt(b[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an < bn {
+				return -1
+			}
+			return 1
+		// numeric identifiers have lower precedence than alphanumeric ones
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case a[i] < b[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if len(a) < len(b) {
+		return -1
+	}
+	if len(a) > len(b) {
+		return 1
+	}
+	return 0
+}
+
+type semverComparator struct {
+	op string
+	v  *semver
+}
+
+func (c semverComparator) test(v *semver) bool {
+	r := v.compare(c.v)
+	switch c.op {
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	default:
+		return r == 0
+	}
+}
+
+// semverRange defines a npm version range, it's a union(`||`) of comparator sets,
+// see https://github.com/npm/node-semver#ranges
+type semverRange [][]semverComparator
+
+func parseSemverRange(s string) (r semverRange, err error) {
+	for _, set := range strings.Split(s, "||") {
+		set = strings.TrimSpace(set)
+		var comparators []semverComparator
+		if a := strings.Split(set, " - "); len(a) == 2 {
+			comparators, err = parseSemverHyphenRange(strings.TrimSpace(a[0]), strings.TrimSpace(a[1]))
+		} else {
+			for _, token := range strings.Fields(regSemverOperator.ReplaceAllString(set, "$1")) {
+				var c []semverComparator
+				c, err = parseSemverComparator(token)
+				if err != nil {
+					break
+				}
+				comparators = append(comparators, c...)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, comparators)
+	}
+	return
+}
+
+// parseSemverHyphenRange desugars `1.2 - 2.3.4` to `>=1.2.0 <=2.3.4`
+func parseSemverHyphenRange(from string, to string) (comparators []semverComparator, err error) {
+	major, minor, patch, prerelease, err := parseSemverPartial(from)
+	if err != nil {
+		return
+	}
+	if major >= 0 {
+		comparators = append(comparators, semverComparator{">=", fillSemver(major, minor, patch, prerelease)})
+	}
+	major, minor, patch, prerelease, err = parseSemverPartial(to)
+	if err != nil {
+		return
+	}
+	switch {
+	case major < 0:
+	case minor < 0:
+		comparators = append(comparators, semverComparator{"<", &semver{major + 1, 0, 0, []string{"0"}}})
+	case patch < 0:
+		comparators = append(comparators, semverComparator{"<", &semver{major, minor + 1, 0, []string{"0"}}})
+	default:
+		comparators = append(comparators, semverComparator{"<=", &semver{major, minor, patch, prerelease}})
+	}
+	return
+}
+
+// parseSemverComparator desugars a token like `^1.2.3`, `~1.2`, `1.x` or `>=1.2` to primitive comparators
+func parseSemverComparator(token string) (comparators []semverComparator, err error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "~>", "~", "^"} {
+		if strings.HasPrefix(token, prefix) {
+			op = prefix
+			token = strings.TrimPrefix(token, prefix)
+			break
+		}
+	}
+	major, minor, patch, prerelease, err := parseSemverPartial(token)
+	if err != nil {
+		return
+	}
+
+	lower := fillSemver(major, minor, patch, prerelease)
+	upper := func(major int64, minor int64, patch int64) []semverComparator {
+		return []semverComparator{{">=", lower}, {"<", &semver{major, minor, patch, []string{"0"}}}}
+	}
+	anyVersion := []semverComparator{{">=", &semver{0, 0, 0, nil}}}
+
+	switch op {
+	case "", "=":
+		switch {
+		case major < 0:
+			return anyVersion, nil
+		case minor < 0:
+			return upper(major+1, 0, 0), nil
+		case patch < 0:
+			return upper(major, minor+1, 0), nil
+		}
+		return []semverComparator{{"=", lower}}, nil
+
+	case "~", "~>":
+		switch {
+		case major < 0:
+			return anyVersion, nil
+		case minor < 0:
+			return upper(major+1, 0, 0), nil
+		}
+		return upper(major, minor+1, 0), nil
+
+	case "^":
+		switch {
+		case major < 0:
+			return anyVersion, nil
+		case major > 0 || minor < 0:
+			return upper(major+1, 0, 0), nil
+		case minor > 0 || patch < 0:
+			return upper(0, minor+1, 0), nil
+		}
+		return upper(0, 0, patch+1), nil
+
+	case ">":
+		switch {
+		case major < 0:
+			// nothing is greater than `*`
+			return []semverComparator{{"<", &semver{0, 0, 0, []string{"0"}}}}, nil
+		case minor < 0:
+			return []semverComparator{{">=", &semver{major + 1, 0, 0, nil}}}, nil
+		case patch < 0:
+			return []semverComparator{{">=", &semver{major, minor + 1, 0, nil}}}, nil
+		}
+		return []semverComparator{{">", lower}}, nil
+
+	case ">=":
+		if major < 0 {
+			return anyVersion, nil
+		}
+		return []semverComparator{{">=", lower}}, nil
+
+	case "<":
+		if major < 0 {
+			return []semverComparator{{"<", &semver{0, 0, 0, []string{"0"}}}}, nil
+		}
+		if minor < 0 || patch < 0 {
+			lower.prerelease = []string{"0"}
+		}
+		return []semverComparator{{"<", lower}}, nil
+
+	case "<=":
+		switch {
+		case major < 0:
+			return anyVersion, nil
+		case minor < 0:
+			return []semverComparator{{"<", &semver{major + 1, 0, 0, []string{"0"}}}}, nil
+		case patch < 0:
+			return []semverComparator{{"<", &semver{major, minor + 1, 0, []string{"0"}}}}, nil
+		}
+		return []semverComparator{{"<=", lower}}, nil
+	}
+	return
+}
+
+func fillSemver(major int64, minor int64, patch int64, prerelease []string) *semver {
+	v := &semver{major, minor, patch, prerelease}
+	if v.major < 0 {
+		v.major = 0
+	}
+	if v.minor < 0 {
+		v.minor = 0
+		v.prerelease = nil
+	}
+	if v.patch < 0 {
+		v.patch = 0
+		v.prerelease = nil
+	}
+	return v
+}
+
+// satisfies checks whether the version satisfies the range, a prerelease version
+// only satisfies a comparator set that has a prerelease on the same [major, minor, patch]
+// tuple.
+func (r semverRange) satisfies(v *semver) bool {
+	for _, set := range r {
+		ok := true
+		for _, c := range set {
+			if !c.test(v) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		if len(v.prerelease) == 0 {
+			return true
+		}
+		for _, c := range set {
+			if len(c.v.prerelease) > 0 && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSemverRange(t *testing.T) {
+	for _, c := range []struct {
+		r       string
+		version string
+		ok      bool
+	}{
+		{"*", "1.2.3", true},
+		{"", "1.2.3", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"1", "1.9.9", true},
+		{"1", "2.0.0", false},
+		{"1.2", "1.2.9", true},
+		{"1.2", "1.3.0", false},
+		{"1.x", "1.3.0", true},
+		{"1.2.x", "1.3.0", false},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "1.2.2", false},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"^0.x", "0.9.0", true},
+		{"^1.2.3-beta.2", "1.2.3-beta.4", true},
+		{"^1.2.3-beta.2", "1.2.4-beta.2", false},
+		{"^1.2.3-beta.2", "1.3.0", true},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"~1", "2.0.0", false},
+		{">1.2.3", "1.2.4", true},
+		{">1.2", "1.2.9", false},
+		{">= 1.2.3", "1.2.3", true},
+		{"<1.2.3", "1.2.3", false},
+		{"<1.2", "1.1.9", true},
+		{"<1.2", "1.2.0-beta", false},
+		{"<=1.2", "1.2.9", true},
+		{">=1.2.3 <2", "1.9.9", true},
+		{">=1.2.3 <2", "2.0.0-beta", false},
+		{"1.2.3 - 2.3.4", "2.3.4", true},
+		{"1.2 - 2.3", "2.3.9", true},
+		{"1.2 - 2.3", "2.4.0", false},
+		{"1.2.3 - 2", "2.9.0", true},
+		{"^1.0.0 || ^2.0.0", "2.1.0", true},
+		{"^1.0.0 || ^2.0.0", "3.0.0", false},
+		{"^1.0.0", "1.1.0-beta.1", false},
+	} {
+		r, err := parseSemverRange(c.r)
+		if err != nil {
+			t.Fatalf("parse range '%s': %v", c.r, err)
+		}
+		v, err := parseSemver(c.version)
+		if err != nil {
+			t.Fatalf("parse version '%s': %v", c.version, err)
+		}
+		if r.satisfies(v) != c.ok {
+			t.Fatalf("'%s' satisfies '%s' should be %v", c.version, c.r, c.ok)
+		}
+	}
+}
+
+func TestResolvePackageVersion(t *testing.T) {
+	h := &NpmPackageRecords{
+		DistTags: map[string]string{"latest": "1.2.0", "next": "2.0.0-rc.1"},
+		Versions: map[string]NpmPackage{},
+	}
+	for _, version := range []string{"0.9.0", "1.0.0", "1.2.0", "1.3.0-beta.1", "1.10.0", "2.0.0-rc.1"} {
+		h.Versions[version] = NpmPackage{Version: version}
+	}
+	for r, version := range map[string]string{
+		"latest":       "1.2.0",
+		"next":         "2.0.0-rc.1",
+		"1.0.0":        "1.0.0",
+		"^1.0.0":       "1.2.0",
+		">1.2.0":       "1.10.0",
+		"~1.0.0":       "1.0.0",
+		"^0":           "0.9.0",
+		"^2.0.0-rc.0":  "2.0.0-rc.1",
+		">=1.3.0-beta": "1.10.0",
+		"<1":           "0.9.0",
+		"^3.0.0":       "",
+	} {
+		info, _ := resolvePackageVersion(h, resolveVersion(r))
+		if info.Version != version {
+			t.Fatalf("resolve '%s': unexpected version '%s', should be '%s'", r, info.Version, version)
+		}
+	}
+}
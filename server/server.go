@@ -1,19 +1,25 @@
 package server
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"esm.sh/server/storage"
 
 	logx "github.com/ije/gox/log"
+	"github.com/ije/gox/utils"
 	"github.com/ije/rex"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -31,16 +37,25 @@ func Serve(efs *embed.FS) {
 	embedFS = efs
 
 	var (
-		port       int
-		httpsPort  int
-		cacheUrl   string
-		dbUrl      string
-		fsUrl      string
-		etcDir     string
-		logLevel   string
-		logDir     string
-		noCompress bool
-		isDev      bool
+		port         int
+		httpsPort    int
+		cacheUrl     string
+		dbUrl        string
+		fsUrl        string
+		etcDir       string
+		logLevel     string
+		logDir       string
+		noCompress   bool
+		isDev        bool
+		timeouts     string
+		adminToken   string
+		metricsToken string
+		mode         string
+		gcKeep       int
+		gcIdleDays   int
+		gcInterval   time.Duration
+		fsDedup      bool
+		rawMaxSize   string
 	)
 
 	flag.IntVar(&port, "port", 80, "http server port")
@@ -48,12 +63,22 @@ func Serve(efs *embed.FS) {
 	flag.StringVar(&cacheUrl, "cache", "", "cache connection Url")
 	flag.StringVar(&dbUrl, "db", "", "database connection Url")
 	flag.StringVar(&fsUrl, "fs", "", "file system connection Url")
+	flag.BoolVar(&fsDedup, "fs-dedup", false, "store the identical files once in the file system")
 	flag.StringVar(&cdnDomain, "cdn-domain", "", "cdn domain")
 	flag.StringVar(&etcDir, "etc-dir", "/usr/local/etc/esmd", "the etc dir to store data")
 	flag.StringVar(&logLevel, "log-level", "info", "log level")
 	flag.StringVar(&logDir, "log-dir", "/var/log/esmd", "the log dir to store server logs")
 	flag.BoolVar(&noCompress, "no-compress", false, "disable compression for text content")
 	flag.BoolVar(&isDev, "dev", false, "run server in development mode")
+	flag.StringVar(&mode, "mode", "standalone", "server mode: standalone, frontend or worker")
+	flag.StringVar(&timeouts, "build-timeouts", "", "build timeouts, e.g. install=5m,build=5m,dts=5m,total=15m")
+	flag.StringVar(&purgeWebhook, "purge-webhook", "", "the url that receives the purge events of the admin APIs")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ESM_ADMIN_TOKEN"), "the token of admin APIs, default is disabled")
+	flag.StringVar(&metricsToken, "metrics-token", os.Getenv("ESM_METRICS_TOKEN"), "the token of the metrics, default is no authentication")
+	flag.IntVar(&gcKeep, "gc-keep-versions", 0, "keep the builds of the last N build versions in storage, default is keeping all")
+	flag.IntVar(&gcIdleDays, "gc-idle-days", 0, "remove the stored files that are not accessed in N days, default is disabled")
+	flag.DurationVar(&gcInterval, "gc-interval", 24*time.Hour, "the interval of the storage garbage collection")
+	flag.StringVar(&rawMaxSize, "raw-max-size", "20MB", "the max size of the raw files that are served from the package tarballs")
 	flag.Parse()
 
 	if isDev {
@@ -94,28 +119,109 @@ func Serve(efs *embed.FS) {
 	}
 	node, err = checkNode(nodeInstallDir)
 	if err != nil {
-		log.Fatalf("check nodejs env: %v", err)
+		// nodejs is optional, the packages are installed by the builtin npm installer
+		log.Warnf("check nodejs env: %v", err)
+		node = &Node{npmRegistry: getNpmRegistry()}
+	} else {
+		log.Debugf("nodejs v%s installed, registry: %s", node.version, node.npmRegistry)
+	}
+
+	npmCacheDir = os.Getenv("NPM_CACHE_DIR")
+	if npmCacheDir == "" {
+		// the cache dir of the `yarn add` that is replaced by the builtin installer
+		npmCacheDir = os.Getenv("YARN_CACHE_DIR")
+	}
+	if npmCacheDir == "" {
+		npmCacheDir = path.Join(etcDir, "npm")
+	}
+	if os.Getenv("YARN_MUTEX") != "" {
+		// the tarball cache is written atomically, the concurrent installs don't need a mutex
+		log.Warn("the YARN_MUTEX env is ignored, the builtin npm installer is safe for concurrent installs")
+	}
+
+	rawFileMaxSize, err = utils.ParseBytes(rawMaxSize)
+	if err != nil {
+		log.Fatalf("parse raw max size: %v", err)
+	}
+
+	if timeouts != "" {
+		buildTimeouts, err = parseBuildTimeouts(timeouts)
+		if err != nil {
+			log.Fatalf("parse build timeouts: %v", err)
+		}
 	}
-	log.Debugf("nodejs v%s installed, registry: %s", node.version, node.npmRegistry)
 
 	storage.SetLogger(log)
 	storage.SetIsDev(isDev)
 
 	cache, err = storage.OpenCache(cacheUrl)
 	if err != nil {
-		log.Fatalf("init storage(cache,%s): %v", cacheUrl, err)
+		log.Fatalf("init storage(cache,%s): %v", storage.RedactConfigUrl(cacheUrl), err)
 	}
 
 	db, err = storage.OpenDB(dbUrl)
 	if err != nil {
-		log.Fatalf("init storage(db,%s): %v", dbUrl, err)
+		log.Fatalf("init storage(db,%s): %v", storage.RedactConfigUrl(dbUrl), err)
+	}
+	if (mode == "frontend" || mode == "worker") && !storage.IsSharedDB(db) {
+		log.Fatalf("the %s mode needs a db that is shared by the instances, like the `redis` db", mode)
 	}
 
 	fs, err = storage.OpenFS(fsUrl)
 	if err != nil {
-		log.Fatalf("init storage(fs,%s): %v", fsUrl, err)
+		log.Fatalf("init storage(fs,%s): %v", storage.RedactConfigUrl(fsUrl), err)
+	}
+	// the `tiered` fs flushes the files that are not written back yet when it's closed
+	fsCloser, _ := fs.(io.Closer)
+
+	if fsDedup {
+		fs = storage.NewDedupFS(fs, db)
+		orphanCollector = fs.(storage.OrphanCollector)
 	}
 
+	// record the metrics of the storages
+	fsDriver, _ := utils.SplitByFirstByte(fsUrl, ':')
+	fs = newMetricsFS(fs, fsDriver)
+	// store the precompressed variants of the builds
+	fs = newPrecompressFS(fs)
+	cache = &metricsCache{cache}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGHUP)
+
+	switch mode {
+	case "standalone":
+		err = buildQueue.Load(db)
+		if err != nil {
+			log.Errorf("load build queue: %v", err)
+		}
+	case "frontend":
+		// the frontends enqueue the tasks into the shared queue and the workers build them
+		buildQueue.UseSharedQueue(newDBSharedQueue(db))
+	case "worker":
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-c
+			cancel()
+		}()
+		runWorker(ctx, newDBSharedQueue(db), buildQueue.maxProcesses)
+		if fsCloser != nil {
+			if err := fsCloser.Close(); err != nil {
+				log.Error(err)
+			}
+		}
+		db.Close()
+		log.FlushBuffer()
+		return
+	default:
+		log.Fatalf("unknown mode '%s'", mode)
+	}
+
+	startGC(GCOptions{
+		KeepVersions: gcKeep,
+		MaxIdle:      time.Duration(gcIdleDays) * 24 * time.Hour,
+	}, gcInterval)
+
 	var accessLogger *logx.Logger
 	if logDir == "" {
 		accessLogger = &logx.Logger{}
@@ -127,20 +233,6 @@ func Serve(efs *embed.FS) {
 	}
 	accessLogger.SetQuite(true)
 
-	// start cjs lexer server
-	go func() {
-		for {
-			err := startCJSLexerServer(path.Join(etcDir, "cjx-lexer.pid"), isDev)
-			if err != nil {
-				if err.Error() == "EADDRINUSE" {
-					cjsLexerServerPort++
-				} else {
-					log.Errorf("cjs lexer server: %v", err)
-				}
-			}
-		}
-	}()
-
 	if !noCompress {
 		rex.Use(rex.AutoCompress())
 	}
@@ -154,22 +246,12 @@ func Serve(efs *embed.FS) {
 			AllowHeaders:    []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding"},
 			MaxAge:          3600,
 		}),
+		metricsHandle(metricsToken),
+		admin(adminToken),
 		query(),
 	)
 
-	C := rex.Serve(rex.ServerConfig{
-		Port: uint16(port),
-		TLS: rex.TLSConfig{
-			Port: uint16(httpsPort),
-			AutoTLS: rex.AutoTLSConfig{
-				AcceptTOS: httpsPort > 0 && !isDev,
-				CacheDir:  path.Join(etcDir, "autotls"),
-			},
-		},
-	})
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGHUP)
+	C := serveHTTP(port, httpsPort, httpsPort > 0 && !isDev, path.Join(etcDir, "autotls"))
 
 	if isDev {
 		log.Debugf("Server ready on http://localhost:%d", port)
@@ -183,11 +265,56 @@ func Serve(efs *embed.FS) {
 	}
 
 	// release resource
+	if fsCloser != nil {
+		if err := fsCloser.Close(); err != nil {
+			log.Error(err)
+		}
+	}
 	db.Close()
 	accessLogger.FlushBuffer()
 	log.FlushBuffer()
 }
 
+// serveHTTP serves the rex APIs like `rex.Serve`, the responses are recorded by the http metrics.
+func serveHTTP(port int, httpsPort int, autoTLS bool, autoTLSCacheDir string) chan error {
+	c := make(chan error, 1)
+	handler := &metricsHandler{rex.Default()}
+
+	if port > 0 {
+		go func() {
+			serv := &http.Server{
+				Addr:    fmt.Sprintf(":%d", port),
+				Handler: handler,
+			}
+			err := serv.ListenAndServe()
+			c <- fmt.Errorf("server shutdown: %v", err)
+		}()
+	}
+
+	if autoTLS {
+		go func() {
+			err := ensureDir(autoTLSCacheDir)
+			if err != nil {
+				c <- fmt.Errorf("AutoTLS: can't create the cache dir '%s': %v", autoTLSCacheDir, err)
+				return
+			}
+			m := &autocert.Manager{
+				Prompt: autocert.AcceptTOS,
+				Cache:  autocert.DirCache(autoTLSCacheDir),
+			}
+			serv := &http.Server{
+				Addr:      fmt.Sprintf(":%d", httpsPort),
+				Handler:   handler,
+				TLSConfig: m.TLSConfig(),
+			}
+			err = serv.ListenAndServeTLS("", "")
+			c <- fmt.Errorf("server(https) shutdown: %v", err)
+		}()
+	}
+
+	return c
+}
+
 func init() {
 	log = &logx.Logger{}
 	embedFS = &embed.FS{}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const base64VLQChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// SourceMap defines a source map v3, see https://sourcemaps.info/spec.html
+type SourceMap struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file,omitempty"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent,omitempty"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+// sourceMapping is a decoded mapping segment, the `fields` are the absolute
+// values of [source, originalLine, originalColumn, name?]
+type sourceMapping struct {
+	offset int
+	fields []int
+}
+
+// textRun is a run of text that is moved from `oldStart` to `newStart` by a rewrite
+type textRun struct {
+	oldStart int
+	newStart int
+	length   int
+}
+
+// sourceMapper tracks the mappings of the esbuild output through the rewrites of the
+// build, a nil mapper ignores all the rewrites.
+type sourceMapper struct {
+	sm       *SourceMap
+	mappings []sourceMapping
+}
+
+func newSourceMapper(data []byte, content []byte) (*sourceMapper, error) {
+	var sm SourceMap
+	err := json.Unmarshal(data, &sm)
+	if err != nil {
+		return nil, err
+	}
+
+	lineOffsets := []int{0}
+	for i, c := range content {
+		if c == '\n' {
+			lineOffsets = append(lineOffsets, i+1)
+		}
+	}
+
+	m := &sourceMapper{sm: &sm}
+	fields := make([]int, 5)
+	for line, segments := range strings.Split(sm.Mappings, ";") {
+		fields[0] = 0
+		if line >= len(lineOffsets) {
+			break
+		}
+		for _, segment := range strings.Split(segments, ",") {
+			if segment == "" {
+				continue
+			}
+			values, err := decodeVLQ(segment)
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != 1 && len(values) != 4 && len(values) != 5 {
+				return nil, fmt.Errorf("invalid mapping segment '%s'", segment)
+			}
+			for i, v := range values {
+				fields[i] += v
+			}
+			mapping := sourceMapping{offset: lineOffsets[line] + fields[0]}
+			if len(values) > 1 {
+				mapping.fields = make([]int, len(values)-1)
+				copy(mapping.fields, fields[1:len(values)])
+			}
+			m.mappings = append(m.mappings, mapping)
+		}
+	}
+	return m, nil
+}
+
+// apply moves the mappings by the runs that are kept in a rewrite, a mapping in a
+// removed text is moved to the end of the previous run.
+func (m *sourceMapper) apply(runs []textRun) {
+	if m == nil {
+		return
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].oldStart < runs[j].oldStart })
+	for i, mapping := range m.mappings {
+		j := sort.Search(len(runs), func(k int) bool { return runs[k].oldStart > mapping.offset }) - 1
+		if j < 0 {
+			m.mappings[i].offset = 0
+			continue
+		}
+		run := runs[j]
+		if mapping.offset < run.oldStart+run.length {
+			m.mappings[i].offset = run.newStart + mapping.offset - run.oldStart
+		} else {
+			m.mappings[i].offset = run.newStart + run.length
+		}
+	}
+}
+
+// shift moves all the mappings by n bytes, it's used for the prepended code
+func (m *sourceMapper) shift(n int) {
+	if m == nil {
+		return
+	}
+	for i := range m.mappings {
+		m.mappings[i].offset += n
+	}
+}
+
+// encode encodes the source map for the final content, the absolute `sources` in
+// the build directory are made relative to it.
+func (m *sourceMapper) encode(content []byte, file string, wd string) []byte {
+	sm := *m.sm
+	sm.File = file
+	sm.Sources = make([]string, len(m.sm.Sources))
+	for i, source := range m.sm.Sources {
+		if !strings.HasPrefix(source, "<") {
+			source = strings.TrimPrefix(path.Join("/esbuild", source), wd+"/")
+		}
+		sm.Sources[i] = source
+	}
+	if sm.Names == nil {
+		sm.Names = []string{}
+	}
+
+	sort.SliceStable(m.mappings, func(i, j int) bool { return m.mappings[i].offset < m.mappings[j].offset })
+
+	buf := bytes.NewBuffer(nil)
+	prev := make([]int, 4)
+	lineStart, prevCol := 0, 0
+	first := true
+	for _, mapping := range m.mappings {
+		if mapping.offset > len(content) {
+			break
+		}
+		// move to the line of the mapping
+		for {
+			i := bytes.IndexByte(content[lineStart:], '\n')
+			if i < 0 || lineStart+i >= mapping.offset {
+				break
+			}
+			lineStart += i + 1
+			buf.WriteByte(';')
+			prevCol = 0
+			first = true
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		col := mapping.offset - lineStart
+		values := []int{col - prevCol}
+		prevCol = col
+		for i, v := range mapping.fields {
+			values = append(values, v-prev[i])
+			prev[i] = v
+		}
+		buf.WriteString(encodeVLQ(values))
+	}
+	sm.Mappings = buf.String()
+
+	data, _ := json.Marshal(sm)
+	return data
+}
+
+func decodeVLQ(s string) (values []int, err error) {
+	shift, value := 0, 0
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base64VLQChars, s[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base64 VLQ '%s'", s)
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 != 0 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		shift, value = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("invalid base64 VLQ '%s'", s)
+	}
+	return
+}
+
+func encodeVLQ(values []int) string {
+	buf := bytes.NewBuffer(nil)
+	for _, v := range values {
+		if v < 0 {
+			v = (-v << 1) | 1
+		} else {
+			v <<= 1
+		}
+		for {
+			digit := v & 31
+			v >>= 5
+			if v > 0 {
+				digit |= 32
+			}
+			buf.WriteByte(base64VLQChars[digit])
+			if v == 0 {
+				break
+			}
+		}
+	}
+	return buf.String()
+}
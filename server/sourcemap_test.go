@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestVLQ(t *testing.T) {
+	for _, values := range [][]int{{0}, {1, -1, 15, 16}, {-1024, 123456, 0, 31, -32}} {
+		s := encodeVLQ(values)
+		ret, err := decodeVLQ(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, values) {
+			t.Fatalf("decodeVLQ('%s'): %v, should be %v", s, ret, values)
+		}
+	}
+	if s := encodeVLQ([]int{0, 0, 1, 16}); s != "AACgB" {
+		t.Fatalf("unexpected VLQ '%s'", s)
+	}
+}
+
+func TestSourceMapper(t *testing.T) {
+	// `import a from "__ESM_SH_EXTERNAL:a";\nexport default a;\n`
+	content := []byte("import a from \"__ESM_SH_EXTERNAL:a\";\nexport default a;\n")
+	// mappings of `import` at 0:0, `;` at 0:35, `export` at 1:0 and `a` at 1:15
+	data, _ := json.Marshal(SourceMap{
+		Version:  3,
+		Sources:  []string{"../tmp/esm-build/node_modules/a/index.js"},
+		Names:    []string{},
+		Mappings: "AAAA," + encodeVLQ([]int{35, 0, 0, 35}) + ";AAAA,eAAe",
+	})
+	sm, err := newSourceMapper(data, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the external with `/v1/a@1.0.0/es2015/a.js`
+	marker := len("\"__ESM_SH_EXTERNAL:a\"")
+	replacement := len("\"/v1/a@1.0.0/es2015/a.js\"")
+	sm.apply([]textRun{
+		{0, 0, 14},
+		{14 + marker, 14 + replacement, len(content) - 14 - marker},
+	})
+	// prepend a header line
+	header := "/* esm.sh */\n"
+	sm.shift(len(header))
+
+	output := []byte(header + "import a from \"/v1/a@1.0.0/es2015/a.js\";\nexport default a;\n")
+	var ret SourceMap
+	err = json.Unmarshal(sm.encode(output, "a.js", "/tmp/esm-build"), &ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Mappings != ";AAAA,"+encodeVLQ([]int{39, 0, 0, 35})+";AAAA,eAAe" {
+		t.Fatalf("unexpected mappings '%s'", ret.Mappings)
+	}
+	if ret.Sources[0] != "node_modules/a/index.js" {
+		t.Fatalf("unexpected source '%s'", ret.Sources[0])
+	}
+	if ret.File != "a.js" {
+		t.Fatalf("unexpected file '%s'", ret.File)
+	}
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the size of the expiration header of the entry files
+	diskCacheHeaderSize = 8
+	// the modtime of an entry is updated on read at most once in the interval
+	diskCacheTouchInterval = time.Minute
+	diskCacheTempPrefix    = ".tmp-"
+)
+
+// diskCache stores the entries as files in the root directory, an entry file starts with
+// the expiration time in unix nanoseconds. The files are written by renaming, so the
+// cache can be shared by the processes on the same host. The least recently used entries
+// are evicted when the size exceeds the limit.
+type diskCache struct {
+	root       string
+	maxSize    int64
+	size       int64
+	gcInterval time.Duration
+	gcLock     sync.Mutex
+	evicting   int32
+}
+
+func (dc *diskCache) Has(key string) (bool, error) {
+	_, err := dc.Get(key)
+	if err == ErrNotFound || err == ErrExpired {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (dc *diskCache) Get(key string) ([]byte, error) {
+	filename := dc.filename(key)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if len(data) < diskCacheHeaderSize {
+		dc.remove(filename)
+		return nil, ErrNotFound
+	}
+	expiresAt := int64(binary.BigEndian.Uint64(data))
+	if expiresAt > 0 && time.Now().UnixNano() > expiresAt {
+		dc.remove(filename)
+		return nil, ErrExpired
+	}
+	if fi, err := os.Stat(filename); err == nil && time.Since(fi.ModTime()) > diskCacheTouchInterval {
+		now := time.Now()
+		os.Chtimes(filename, now, now)
+	}
+	return data[diskCacheHeaderSize:], nil
+}
+
+func (dc *diskCache) Set(key string, value []byte, ttl time.Duration) error {
+	filename := dc.filename(key)
+	err := os.MkdirAll(path.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(path.Dir(filename), diskCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, diskCacheHeaderSize)
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(header, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	_, err = f.Write(header)
+	if err == nil {
+		_, err = f.Write(value)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if atomic.AddInt64(&dc.size, int64(diskCacheHeaderSize+len(value))) > dc.maxSize && atomic.CompareAndSwapInt32(&dc.evicting, 0, 1) {
+		go func() {
+			dc.gc()
+			atomic.StoreInt32(&dc.evicting, 0)
+		}()
+	}
+	return nil
+}
+
+func (dc *diskCache) Delete(key string) error {
+	err := os.Remove(dc.filename(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (dc *diskCache) Flush() error {
+	entries, err := ioutil.ReadDir(dc.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(path.Join(dc.root, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&dc.size, 0)
+	return nil
+}
+
+func (dc *diskCache) filename(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return path.Join(dc.root, name[:2], name)
+}
+
+func (dc *diskCache) remove(filename string) {
+	fi, err := os.Stat(filename)
+	if err == nil && os.Remove(filename) == nil {
+		atomic.AddInt64(&dc.size, -fi.Size())
+	}
+}
+
+type diskCacheEntry struct {
+	filename string
+	size     int64
+	modtime  time.Time
+}
+
+// gc removes the expired entries and the stale temporary files, then evicts the least
+// recently used entries until the size is under the limit.
+func (dc *diskCache) gc() {
+	dc.gcLock.Lock()
+	defer dc.gcLock.Unlock()
+
+	now := time.Now()
+	var entries []diskCacheEntry
+	var size int64
+	header := make([]byte, diskCacheHeaderSize)
+	filepath.WalkDir(dc.root, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), diskCacheTempPrefix) {
+			if now.Sub(fi.ModTime()) > time.Hour {
+				os.Remove(filename)
+			}
+			return nil
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil
+		}
+		_, err = f.Read(header)
+		f.Close()
+		if err == nil {
+			expiresAt := int64(binary.BigEndian.Uint64(header))
+			if expiresAt > 0 && now.UnixNano() > expiresAt {
+				os.Remove(filename)
+				return nil
+			}
+		}
+		entries = append(entries, diskCacheEntry{filename, fi.Size(), fi.ModTime()})
+		size += fi.Size()
+		return nil
+	})
+
+	if size > dc.maxSize {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].modtime.Before(entries[j].modtime)
+		})
+		for _, entry := range entries {
+			if size <= dc.maxSize {
+				break
+			}
+			if os.Remove(entry.filename) == nil {
+				size -= entry.size
+			}
+		}
+	}
+	atomic.StoreInt64(&dc.size, size)
+}
+
+func (dc *diskCache) runGC() {
+	for {
+		dc.gc()
+		time.Sleep(dc.gcInterval)
+	}
+}
+
+type diskCacheDriver struct{}
+
+func (d *diskCacheDriver) Open(root string, options url.Values) (Cache, error) {
+	if root == "" {
+		return nil, errors.New("missing cache dir")
+	}
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 1<<30) // Default maximum size of cache is 1GB
+	if err != nil {
+		return nil, errors.New("invalid maxSize value")
+	}
+	gcInterval, err := parseDurationValue(options.Get("gcInterval"), 30*time.Minute)
+	if err != nil {
+		return nil, errors.New("invalid gcInterval value")
+	}
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{
+		root:       root,
+		maxSize:    maxSize,
+		gcInterval: gcInterval,
+	}
+	go c.runGC()
+	return c, nil
+}
+
+func init() {
+	RegisterCache("disk", &diskCacheDriver{})
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-cache-disk")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	cache, err := OpenCache("disk:" + root + "?maxSize=64&gcInterval=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set("key", []byte("hello world"), 0)
+	value, err := cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+
+	cache.Set("key2", []byte("hello world"), 100*time.Millisecond)
+	if ok, _ := cache.Has("key2"); !ok {
+		t.Fatal("key2 should be cached")
+	}
+	time.Sleep(150 * time.Millisecond)
+	_, err = cache.Get("key2")
+	if err != ErrExpired {
+		t.Fatal("should be expired error, but", err)
+	}
+	if ok, _ := cache.Has("key2"); ok {
+		t.Fatal("key2 should be removed")
+	}
+
+	// the entries survive the restart
+	cache, err = OpenCache("disk:" + root + "?maxSize=64&gcInterval=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := cache.(*diskCache)
+	value, err = cache.Get("key")
+	if err != nil || string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world': %v", value, err)
+	}
+
+	// evict the least recently used entries when the size exceeds the limit
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(dc.filename("key"), old, old)
+	cache.Set("key3", []byte("0123456789abcdef0123456789abcdef"), 0)
+	cache.Set("key4", []byte("0123456789abcdef"), 0)
+	dc.gc()
+	if ok, _ := cache.Has("key"); ok {
+		t.Fatal("key should be evicted")
+	}
+	if ok, _ := cache.Has("key4"); !ok {
+		t.Fatal("key4 should be cached")
+	}
+	if size := atomic.LoadInt64(&dc.size); size > dc.maxSize {
+		t.Fatalf("the size %d exceeds the limit", size)
+	}
+
+	err = cache.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Get("key4"); err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisCache is a cache backed by a redis server, so the esmd instances can share the
+// cache. The expired keys are removed by the redis server, `Get` returns `ErrNotFound`
+// for them. The `Flush` clears the selected redis db, so the db should not be shared
+// with other applications.
+type redisCache struct {
+	pool *redisPool
+}
+
+func (rc *redisCache) Has(key string) (bool, error) {
+	reply, err := rc.pool.do("EXISTS", key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := reply.(int64)
+	return n > 0, nil
+}
+
+func (rc *redisCache) Get(key string) ([]byte, error) {
+	reply, err := rc.pool.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return value, nil
+}
+
+func (rc *redisCache) Set(key string, value []byte, ttl time.Duration) (err error) {
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		_, err = rc.pool.do("SET", key, string(value), "PX", strconv.FormatInt(ms, 10))
+	} else {
+		_, err = rc.pool.do("SET", key, string(value))
+	}
+	return
+}
+
+func (rc *redisCache) Delete(key string) error {
+	_, err := rc.pool.do("DEL", key)
+	return err
+}
+
+func (rc *redisCache) Flush() error {
+	_, err := rc.pool.do("FLUSHDB")
+	return err
+}
+
+// redisError is the error reply of the redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// broken is set when a command fails with a connection error
+	broken bool
+}
+
+// redisPool is a pool of the redis connections, at most `size` connections are open at the same time
+type redisPool struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+	active   chan struct{}
+}
+
+func newRedisPool(addr string, password string, db int, size int, timeout time.Duration) *redisPool {
+	return &redisPool{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *redisConn, size),
+		active:   make(chan struct{}, size),
+	}
+}
+
+func (p *redisPool) do(args ...string) (reply interface{}, err error) {
+	p.active <- struct{}{}
+	defer func() { <-p.active }()
+
+	var c *redisConn
+	select {
+	case c = <-p.idle:
+		reply, err = c.do(p.timeout, args...)
+		if !isRedisConnError(err) {
+			p.put(c)
+			return
+		}
+		// the idle connection may be closed by the server, retry with a new connection
+		c.conn.Close()
+	default:
+	}
+
+	c, err = p.dial()
+	if err != nil {
+		return
+	}
+	reply, err = c.do(p.timeout, args...)
+	if isRedisConnError(err) {
+		c.conn.Close()
+		return
+	}
+	p.put(c)
+	return
+}
+
+// conn calls the fn with a connection that is not used by others until the fn returns,
+// for the commands that keep a state on the connection like `WATCH` and `MULTI`.
+func (p *redisPool) conn(fn func(c *redisConn) error) (err error) {
+	p.active <- struct{}{}
+	defer func() { <-p.active }()
+
+	var c *redisConn
+	select {
+	case c = <-p.idle:
+		// the idle connection may be closed by the server
+		if _, err = c.do(p.timeout, "PING"); isRedisConnError(err) {
+			c.conn.Close()
+			c = nil
+		}
+	default:
+	}
+	if c == nil {
+		c, err = p.dial()
+		if err != nil {
+			return
+		}
+	}
+	err = fn(c)
+	if c.broken {
+		c.conn.Close()
+		return
+	}
+	p.put(c)
+	return
+}
+
+func (p *redisPool) put(c *redisConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (p *redisPool) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if p.password != "" {
+		_, err = c.do(p.timeout, "AUTH", p.password)
+	}
+	if err == nil && p.db > 0 {
+		_, err = c.do(p.timeout, "SELECT", strconv.Itoa(p.db))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *redisPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func isRedisConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(redisError)
+	return !ok
+}
+
+// do sends the command in the RESP protocol and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err := c.w.Flush()
+	if err != nil {
+		c.broken = true
+		return nil, err
+	}
+	reply, err := readRedisReply(c.r)
+	if isRedisConnError(err) {
+		c.broken = true
+	}
+	return reply, err
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: bad reply")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = readRedisReply(r)
+			if e, ok := err.(redisError); ok {
+				a[i] = e
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, errors.New("redis: bad reply")
+}
+
+type redisCacheDriver struct{}
+
+func (d *redisCacheDriver) Open(addr string, options url.Values) (Cache, error) {
+	pool, err := openRedisPool(addr, options)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{pool}, nil
+}
+
+// openRedisPool parses the redis options that are shared by the cache and the db drivers,
+// and checks the connection.
+func openRedisPool(addr string, options url.Values) (*redisPool, error) {
+	addr = strings.TrimPrefix(addr, "//")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	} else if !strings.Contains(addr, ":") {
+		addr += ":6379"
+	}
+	db, err := strconv.Atoi(options.Get("db"))
+	if err != nil && options.Get("db") != "" {
+		return nil, errors.New("invalid db value")
+	}
+	poolSize, err := strconv.Atoi(options.Get("poolSize"))
+	if err != nil {
+		if options.Get("poolSize") != "" {
+			return nil, errors.New("invalid poolSize value")
+		}
+		poolSize = 16
+	}
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	timeout, err := parseDurationValue(options.Get("timeout"), 5*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid timeout value")
+	}
+
+	pool := newRedisPool(addr, options.Get("password"), db, poolSize, timeout)
+	// check the connection
+	_, err = pool.do("PING")
+	if err != nil {
+		pool.close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+func init() {
+	RegisterCache("redis", &redisCacheDriver{})
+}
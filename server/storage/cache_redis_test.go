@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage/redistest"
+)
+
+func TestRedisCache(t *testing.T) {
+	server, err := redistest.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	_, err = OpenCache(fmt.Sprintf("redis:%s?password=wrong", server.Addr))
+	if err == nil {
+		t.Fatal("should be auth error")
+	}
+
+	cache, err := OpenCache(fmt.Sprintf("redis:%s?password=secret&db=1&poolSize=4", server.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set("key", []byte("hello world"), 0)
+	value, err := cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+	if ok, _ := cache.Has("key"); !ok {
+		t.Fatal("key should be cached")
+	}
+	if _, err = cache.Get("missing"); err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+
+	cache.Set("key2", []byte("hello\r\nworld"), 100*time.Millisecond)
+	value, err = cache.Get("key2")
+	if err != nil || string(value) != "hello\r\nworld" {
+		t.Fatalf("invalid value(%v): %v", value, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if ok, _ := cache.Has("key2"); ok {
+		t.Fatal("key2 should be expired")
+	}
+
+	// the connections are reused
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			cache.Set(key, []byte(key), time.Minute)
+			if value, err := cache.Get(key); err != nil || string(value) != key {
+				t.Errorf("invalid value(%v) of %s: %v", value, key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := server.Conns(); n > 5 {
+		t.Fatalf("too many connections %d", n)
+	}
+
+	// reconnect after the server closes the idle connections
+	server.CloseConns()
+	if ok, err := cache.Has("key"); !ok || err != nil {
+		t.Fatalf("key should be cached: %v", err)
+	}
+
+	err = cache.Delete("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cache.Has("key"); ok {
+		t.Fatal("key should be deleted")
+	}
+	err = cache.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cache.Has("key-1"); ok {
+		t.Fatal("key-1 should be flushed")
+	}
+}
+
+func TestRedactConfigUrl(t *testing.T) {
+	for configUrl, expected := range map[string]string{
+		"redis:127.0.0.1:6379?password=secret&db=1": "redis:127.0.0.1:6379?db=1&password=redacted",
+		"redis:127.0.0.1:6379?db=1":                 "redis:127.0.0.1:6379?db=1",
+		"memory:default":                            "memory:default",
+		"redis:127.0.0.1:6379?password=%zz":         "redis:127.0.0.1:6379?redacted",
+	} {
+		if ret := RedactConfigUrl(configUrl); ret != expected {
+			t.Fatalf("unexpected redacted url of %s: %s", configUrl, ret)
+		}
+	}
+}
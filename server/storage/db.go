@@ -15,13 +15,40 @@ type DBDriver interface {
 	Open(config string, options url.Values) (conn DB, err error)
 }
 
+// DB is a key/value store of the records, `Put` merges the keys into the existing record,
+// and `Delete` of a missing record is not an error.
 type DB interface {
 	Get(id string) (store Store, modtime time.Time, err error)
 	Put(id string, store Store) error
 	Delete(id string) error
+	// Scan calls the fn with the records whose id has the prefix in the order of ids,
+	// it stops when the fn returns false.
+	Scan(prefix string, fn func(id string, store Store) bool) error
+	// Update runs the fn in a read-write transaction, the changes are discarded
+	// when the fn returns an error. The fn may be called again when the transaction
+	// of a shared db conflicts with another process.
+	Update(fn func(tx DBTx) error) error
 	Close() error
 }
 
+// DBTx is a read-write transaction of the DB
+type DBTx interface {
+	Get(id string) (store Store, modtime time.Time, err error)
+	Put(id string, store Store) error
+	Delete(id string) error
+}
+
+// SharedDB is implemented by the dbs that can be opened by several processes at the same time
+type SharedDB interface {
+	Shared() bool
+}
+
+// IsSharedDB returns true if the db can be opened by several processes at the same time
+func IsSharedDB(db DB) bool {
+	s, ok := db.(SharedDB)
+	return ok && s.Shared()
+}
+
 var dbDrivers = sync.Map{}
 
 func OpenDB(url string) (DB, error) {
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltRecordsBucket = []byte("records")
+
+type boltRecord struct {
+	Store   Store `json:"store"`
+	Modtime int64 `json:"modtime"`
+}
+
+type boltDB struct{}
+
+func (d *boltDB) Open(filename string, options url.Values) (DB, error) {
+	timeout, err := parseDurationValue(options.Get("timeout"), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRecordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDBInstance{db}, nil
+}
+
+type boltDBInstance struct {
+	db *bolt.DB
+}
+
+func (i *boltDBInstance) Get(id string) (store Store, modtime time.Time, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		store, modtime, err = (&boltDBTx{tx}).Get(id)
+		return err
+	})
+	return
+}
+
+func (i *boltDBInstance) Put(id string, store Store) error {
+	return i.Update(func(tx DBTx) error {
+		return tx.Put(id, store)
+	})
+}
+
+func (i *boltDBInstance) Delete(id string) error {
+	return i.Update(func(tx DBTx) error {
+		return tx.Delete(id)
+	})
+}
+
+func (i *boltDBInstance) Scan(prefix string, fn func(id string, store Store) bool) error {
+	return i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRecordsBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var r boltRecord
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			if !fn(string(k), r.Store) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (i *boltDBInstance) Update(fn func(tx DBTx) error) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltDBTx{tx})
+	})
+}
+
+func (i *boltDBInstance) Close() error {
+	return i.db.Close()
+}
+
+type boltDBTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltDBTx) Get(id string) (store Store, modtime time.Time, err error) {
+	r, err := t.get(id)
+	if err != nil {
+		return
+	}
+	return r.Store, time.Unix(0, r.Modtime), nil
+}
+
+func (t *boltDBTx) Put(id string, store Store) error {
+	r, err := t.get(id)
+	if err == ErrNotFound {
+		r, err = &boltRecord{Store: Store{}}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range store {
+		r.Store[key] = value
+	}
+	r.Modtime = time.Now().UnixNano()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return t.tx.Bucket(boltRecordsBucket).Put([]byte(id), data)
+}
+
+func (t *boltDBTx) Delete(id string) error {
+	return t.tx.Bucket(boltRecordsBucket).Delete([]byte(id))
+}
+
+func (t *boltDBTx) get(id string) (*boltRecord, error) {
+	data := t.tx.Bucket(boltRecordsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var r boltRecord
+	err := json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Store == nil {
+		r.Store = Store{}
+	}
+	return &r, nil
+}
+
+func init() {
+	RegisterDB("bolt", &boltDB{})
+}
@@ -2,9 +2,12 @@ package storage
 
 import (
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/postui/postdb"
+	"github.com/postui/postdb/post"
 	"github.com/postui/postdb/q"
 )
 
@@ -23,7 +26,73 @@ type postDBInstance struct {
 }
 
 func (i *postDBInstance) Get(id string) (store Store, modtime time.Time, err error) {
-	post, err := i.db.Get(q.Alias(id), q.Select("*"))
+	tx, err := i.db.Begin(false)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	return (&postDBTx{tx}).Get(id)
+}
+
+func (i *postDBInstance) Put(id string, store Store) error {
+	return i.Update(func(tx DBTx) error {
+		return tx.Put(id, store)
+	})
+}
+
+func (i *postDBInstance) Delete(id string) error {
+	return i.Update(func(tx DBTx) error {
+		return tx.Delete(id)
+	})
+}
+
+func (i *postDBInstance) Scan(prefix string, fn func(id string, store Store) bool) error {
+	tx, err := i.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the posts are ordered by the creation, not the alias
+	posts := tx.List(q.Filter(func(p post.Post) bool {
+		return p.Alias != "" && strings.HasPrefix(p.Alias, prefix)
+	}), q.Select("*"))
+	sort.Slice(posts, func(a, b int) bool {
+		return posts[a].Alias < posts[b].Alias
+	})
+	for _, post := range posts {
+		if !fn(post.Alias, toStore(post.KV)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (i *postDBInstance) Update(fn func(tx DBTx) error) error {
+	tx, err := i.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&postDBTx{tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (i *postDBInstance) Close() error {
+	return i.db.Close()
+}
+
+type postDBTx struct {
+	tx *postdb.Tx
+}
+
+func (t *postDBTx) Get(id string) (store Store, modtime time.Time, err error) {
+	post, err := t.tx.Get(q.Alias(id), q.Select("*"))
 	if err != nil {
 		if err == postdb.ErrNotFound {
 			err = ErrNotFound
@@ -31,39 +100,36 @@ func (i *postDBInstance) Get(id string) (store Store, modtime time.Time, err err
 		return
 	}
 
-	store = Store{}
-	for key, value := range post.KV {
-		store[key] = string(value)
-	}
+	store = toStore(post.KV)
 	modtime = time.Unix(int64(post.Modtime), 0)
 	return
 }
 
-func (i *postDBInstance) Put(id string, store Store) (err error) {
-	_, err = i.db.Get(q.Alias(id))
+func (t *postDBTx) Put(id string, store Store) (err error) {
+	kv := q.KV{}
+	for key, value := range store {
+		kv[key] = []byte(value)
+	}
+	_, err = t.tx.Get(q.Alias(id))
 	if err == nil {
-		kv := q.KV{}
-		for key, value := range store {
-			kv[key] = []byte(value)
-		}
-		err = i.db.Update(q.Alias(id), kv)
+		err = t.tx.Update(q.Alias(id), kv)
 	} else if err == postdb.ErrNotFound {
-		kv := q.KV{}
-		for key, value := range store {
-			kv[key] = []byte(value)
-		}
-		_, err = i.db.Put(q.Alias(id), kv)
+		_, err = t.tx.Put(q.Alias(id), kv)
 	}
 	return
 }
 
-func (i *postDBInstance) Delete(id string) error {
-	_, err := i.db.Delete(q.Alias(id))
+func (t *postDBTx) Delete(id string) error {
+	_, err := t.tx.Delete(q.Alias(id))
 	return err
 }
 
-func (i *postDBInstance) Close() error {
-	return i.db.Close()
+func toStore(kv map[string][]byte) Store {
+	store := Store{}
+	for key, value := range kv {
+		store[key] = string(value)
+	}
+	return store
 }
 
 func init() {
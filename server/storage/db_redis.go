@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisDBScanPageSize    = 100
+	redisDBUpdateAttempts  = 3
+	redisDBLockTTL         = 30 * time.Second
+	redisDBLockMaxInterval = 50 * time.Millisecond
+)
+
+// redisDB is a db backed by a redis server, so the esmd instances on different hosts can
+// open the same db. A record is stored as a json string at `{prefix}r:{id}`, and the ids
+// are indexed by the sorted set `{prefix}ids` to scan the records in order.
+//
+// The transactions are serialized by a lock key with a ttl, and the lock key is watched,
+// so a transaction whose lock expired and was taken by another process is aborted by the
+// `EXEC` and runs again. All the writes run in the transactions, so `Put` merges the keys
+// atomically.
+type redisDB struct {
+	pool   *redisPool
+	prefix string
+}
+
+func (db *redisDB) Get(id string) (store Store, modtime time.Time, err error) {
+	reply, err := db.pool.do("GET", db.prefix+"r:"+id)
+	if err != nil {
+		return
+	}
+	return decodeRedisRecord(reply)
+}
+
+func (db *redisDB) Put(id string, store Store) error {
+	return db.Update(func(tx DBTx) error {
+		return tx.Put(id, store)
+	})
+}
+
+func (db *redisDB) Delete(id string) error {
+	return db.Update(func(tx DBTx) error {
+		return tx.Delete(id)
+	})
+}
+
+func (db *redisDB) Scan(prefix string, fn func(id string, store Store) bool) error {
+	start := "[" + prefix
+	if prefix == "" {
+		start = "-"
+	}
+	for {
+		reply, err := db.pool.do("ZRANGEBYLEX", db.prefix+"ids", start, "+", "LIMIT", "0", strconv.Itoa(redisDBScanPageSize))
+		if err != nil {
+			return err
+		}
+		a, _ := reply.([]interface{})
+		if len(a) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(a))
+		keys := []string{"MGET"}
+		for _, v := range a {
+			id := string(toBytes(v))
+			if !strings.HasPrefix(id, prefix) {
+				break
+			}
+			ids = append(ids, id)
+			keys = append(keys, db.prefix+"r:"+id)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		reply, err = db.pool.do(keys...)
+		if err != nil {
+			return err
+		}
+		values, _ := reply.([]interface{})
+		if len(values) != len(ids) {
+			return fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		for i, id := range ids {
+			store, _, err := decodeRedisRecord(values[i])
+			if err == ErrNotFound {
+				// deleted after the ids were read
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !fn(id, store) {
+				return nil
+			}
+		}
+		if len(ids) < len(a) || len(a) < redisDBScanPageSize {
+			return nil
+		}
+		start = "(" + ids[len(ids)-1]
+	}
+}
+
+func (db *redisDB) Update(fn func(tx DBTx) error) (err error) {
+	for i := 0; i < redisDBUpdateAttempts; i++ {
+		var committed bool
+		err = db.pool.conn(func(c *redisConn) (err error) {
+			committed, err = db.update(c, fn)
+			return
+		})
+		if err != nil || committed {
+			return
+		}
+	}
+	return errors.New("redis: transaction conflicts")
+}
+
+// update runs the fn with the lock held, it returns false when the transaction is aborted
+// because the lock expired.
+func (db *redisDB) update(c *redisConn, fn func(tx DBTx) error) (bool, error) {
+	lockKey := db.prefix + "lock"
+	token, err := db.lock(c, lockKey)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.do(db.pool.timeout, "WATCH", lockKey)
+	if err != nil {
+		return false, err
+	}
+	// the lock may expire between the `SET` and the `WATCH`
+	reply, err := c.do(db.pool.timeout, "GET", lockKey)
+	if err != nil {
+		return false, err
+	}
+	if string(toBytes(reply)) != token {
+		_, err = c.do(db.pool.timeout, "UNWATCH")
+		return false, err
+	}
+
+	tx := &redisDBTx{db: db, c: c, writes: map[string]*redisDBWrite{}}
+	fnErr := fn(tx)
+	if c.broken {
+		return false, fnErr
+	}
+	if fnErr != nil {
+		// discard the writes, but release the lock
+		tx.writes = map[string]*redisDBWrite{}
+	}
+	_, err = c.do(db.pool.timeout, "MULTI")
+	if err != nil {
+		return false, err
+	}
+	for id, w := range tx.writes {
+		key := db.prefix + "r:" + id
+		if w.deleted {
+			_, err = c.do(db.pool.timeout, "DEL", key)
+			if err == nil {
+				_, err = c.do(db.pool.timeout, "ZREM", db.prefix+"ids", id)
+			}
+		} else {
+			var data []byte
+			data, err = json.Marshal(redisDBRecord{Store: w.store, Modtime: time.Now().UnixNano()})
+			if err == nil {
+				_, err = c.do(db.pool.timeout, "SET", key, string(data))
+			}
+			if err == nil {
+				_, err = c.do(db.pool.timeout, "ZADD", db.prefix+"ids", "0", id)
+			}
+		}
+		if err != nil {
+			c.do(db.pool.timeout, "DISCARD")
+			return false, err
+		}
+	}
+	_, err = c.do(db.pool.timeout, "DEL", lockKey)
+	if err != nil {
+		c.do(db.pool.timeout, "DISCARD")
+		return false, err
+	}
+	reply, err = c.do(db.pool.timeout, "EXEC")
+	if err != nil {
+		return false, err
+	}
+	if fnErr != nil {
+		return false, fnErr
+	}
+	// the reply is nil when the lock key was changed by others
+	return reply != nil, nil
+}
+
+// lock sets the lock key with a random token, it waits until the lock is released by
+// others or expired.
+func (db *redisDB) lock(c *redisConn, lockKey string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	ttl := strconv.FormatInt(redisDBLockTTL.Milliseconds(), 10)
+	deadline := time.Now().Add(2 * redisDBLockTTL)
+	interval := time.Millisecond
+	for {
+		reply, err := c.do(db.pool.timeout, "SET", lockKey, token, "NX", "PX", ttl)
+		if err != nil {
+			return "", err
+		}
+		if reply != nil {
+			return token, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("redis: lock timeout")
+		}
+		time.Sleep(interval)
+		if interval < redisDBLockMaxInterval {
+			interval *= 2
+		}
+	}
+}
+
+// Shared returns true since the redis server can be used by several processes
+func (db *redisDB) Shared() bool {
+	return true
+}
+
+func (db *redisDB) Close() error {
+	db.pool.close()
+	return nil
+}
+
+type redisDBRecord struct {
+	Store   Store `json:"store"`
+	Modtime int64 `json:"modtime"`
+}
+
+type redisDBWrite struct {
+	store   Store
+	deleted bool
+}
+
+// redisDBTx buffers the writes until the transaction is committed, `Get` reads the
+// buffered writes first.
+type redisDBTx struct {
+	db     *redisDB
+	c      *redisConn
+	writes map[string]*redisDBWrite
+}
+
+func (tx *redisDBTx) Get(id string) (store Store, modtime time.Time, err error) {
+	if w, ok := tx.writes[id]; ok {
+		if w.deleted {
+			return nil, time.Time{}, ErrNotFound
+		}
+		store = Store{}
+		for key, value := range w.store {
+			store[key] = value
+		}
+		return store, time.Now(), nil
+	}
+	reply, err := tx.c.do(tx.db.pool.timeout, "GET", tx.db.prefix+"r:"+id)
+	if err != nil {
+		return
+	}
+	return decodeRedisRecord(reply)
+}
+
+func (tx *redisDBTx) Put(id string, store Store) error {
+	current, _, err := tx.Get(id)
+	if err == ErrNotFound {
+		current, err = Store{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range store {
+		current[key] = value
+	}
+	tx.writes[id] = &redisDBWrite{store: current}
+	return nil
+}
+
+func (tx *redisDBTx) Delete(id string) error {
+	tx.writes[id] = &redisDBWrite{deleted: true}
+	return nil
+}
+
+func decodeRedisRecord(reply interface{}) (store Store, modtime time.Time, err error) {
+	if reply == nil {
+		err = ErrNotFound
+		return
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		err = fmt.Errorf("redis: unexpected reply %v", reply)
+		return
+	}
+	var r redisDBRecord
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return
+	}
+	if r.Store == nil {
+		r.Store = Store{}
+	}
+	return r.Store, time.Unix(0, r.Modtime), nil
+}
+
+func toBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+type redisDBDriver struct{}
+
+func (d *redisDBDriver) Open(addr string, options url.Values) (DB, error) {
+	pool, err := openRedisPool(addr, options)
+	if err != nil {
+		return nil, err
+	}
+	prefix := options.Get("prefix")
+	if prefix == "" {
+		prefix = "esmd:"
+	}
+	return &redisDB{pool: pool, prefix: prefix}, nil
+}
+
+func init() {
+	RegisterDB("redis", &redisDBDriver{})
+}
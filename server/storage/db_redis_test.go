@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"esm.sh/server/storage/redistest"
+)
+
+func TestRedisDBInstances(t *testing.T) {
+	server, err := redistest.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// the instances open the db with their own connections
+	dbs := make([]DB, 4)
+	for i := range dbs {
+		dbs[i], err = OpenDB(fmt.Sprintf("redis:%s?poolSize=2", server.Addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbs[i].Close()
+		if !IsSharedDB(dbs[i]) {
+			t.Fatal("the redis db should be shared")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(db DB) {
+			defer wg.Done()
+			err := db.Update(func(tx DBTx) error {
+				store, _, err := tx.Get("counter")
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+				n, _ := strconv.Atoi(store["n"])
+				return tx.Put("counter", Store{"n": strconv.Itoa(n + 1)})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(dbs[i%len(dbs)])
+	}
+	wg.Wait()
+	store, _, err := dbs[0].Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store["n"] != "40" {
+		t.Fatalf("lost updates, the counter is %s", store["n"])
+	}
+
+	// scan the pages of the ids
+	for i := 0; i < 250; i++ {
+		err = dbs[1].Put(fmt.Sprintf("item/%03d", i), Store{"i": strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	err = dbs[2].Scan("item/", func(id string, store Store) bool {
+		if id != fmt.Sprintf("item/%03d", n) || store["i"] != strconv.Itoa(n) {
+			t.Fatalf("unexpected record %s %v", id, store)
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 250 {
+		t.Fatalf("scanned %d records, should be 250", n)
+	}
+}
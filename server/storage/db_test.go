@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"esm.sh/server/storage/redistest"
+)
+
+// TestDBDrivers runs the conformance tests against every registered db driver
+func TestDBDrivers(t *testing.T) {
+	dbDrivers.Range(func(key interface{}, value interface{}) bool {
+		name := key.(string)
+		t.Run(name, func(t *testing.T) {
+			dir := path.Join(os.TempDir(), "esmd-testing-db-"+name)
+			os.RemoveAll(dir)
+			os.MkdirAll(dir, 0755)
+			defer os.RemoveAll(dir)
+
+			config := path.Join(dir, "esm.db")
+			if name == "redis" {
+				server, err := redistest.NewServer("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer server.Close()
+				config = server.Addr
+			}
+			db, err := OpenDB(name + ":" + config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			testDB(t, db)
+		})
+		return true
+	})
+}
+
+func testDB(t *testing.T, db DB) {
+	_, _, err := db.Get("v53/react@17.0.2/es2020/react.js")
+	if err != ErrNotFound {
+		t.Fatalf("should be not found error, but %v", err)
+	}
+
+	records := map[string]Store{
+		"v53/react@17.0.2/es2020/react.js":     {"esm": "{}", "dts": "/v53/react@17.0.2/index.d.ts"},
+		"v53/react@17.0.2/esnext/react.js":     {"esm": "{}"},
+		"v53/react-dom@17.0.2/es2020/react.js": {"esm": "{}"},
+		"v52/react@17.0.2/es2020/react.js":     {"esm": "{}"},
+	}
+	for id, store := range records {
+		err = db.Put(id, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// put merges the keys
+	id := "v53/react@17.0.2/es2020/react.js"
+	err = db.Put(id, Store{"esm": `{"exports":[]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, modtime, err := db.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(store, Store{"esm": `{"exports":[]}`, "dts": "/v53/react@17.0.2/index.d.ts"}) || modtime.IsZero() {
+		t.Fatalf("unexpected record %v %v", store, modtime)
+	}
+
+	var ids []string
+	err = db.Scan("v53/react@", func(id string, store Store) bool {
+		if store["esm"] == "" {
+			t.Fatalf("missing store of %s", id)
+		}
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"v53/react@17.0.2/es2020/react.js", "v53/react@17.0.2/esnext/react.js"}) {
+		t.Fatalf("unexpected scan %v", ids)
+	}
+	ids = nil
+	err = db.Scan("v5", func(id string, store Store) bool {
+		ids = append(ids, id)
+		return len(ids) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"v52/react@17.0.2/es2020/react.js", "v53/react-dom@17.0.2/es2020/react.js"}) {
+		t.Fatalf("unexpected stopped scan %v", ids)
+	}
+
+	// the changes of a failed transaction are discarded
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx DBTx) error {
+		err := tx.Put("v53/vue@3.2.0/es2020/vue.js", Store{"esm": "{}"})
+		if err != nil {
+			return err
+		}
+		err = tx.Delete("v52/react@17.0.2/es2020/react.js")
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("should be the abort error, but %v", err)
+	}
+	if _, _, err = db.Get("v53/vue@3.2.0/es2020/vue.js"); err != ErrNotFound {
+		t.Fatalf("the put should be discarded, but %v", err)
+	}
+	if _, _, err = db.Get("v52/react@17.0.2/es2020/react.js"); err != nil {
+		t.Fatalf("the delete should be discarded, but %v", err)
+	}
+
+	err = db.Update(func(tx DBTx) error {
+		store, _, err := tx.Get("v53/react@17.0.2/esnext/react.js")
+		if err != nil {
+			return err
+		}
+		err = tx.Put("v53/react@17.0.2/esnext/react.js", Store{"hits": store["hits"] + "1"})
+		if err != nil {
+			return err
+		}
+		// reads the write of the transaction
+		store, _, err = tx.Get("v53/react@17.0.2/esnext/react.js")
+		if err != nil {
+			return err
+		}
+		if store["hits"] != "1" || store["esm"] != "{}" {
+			t.Fatalf("unexpected record in the transaction %v", store)
+		}
+		return tx.Delete("v52/react@17.0.2/es2020/react.js")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = db.Get("v52/react@17.0.2/es2020/react.js"); err != ErrNotFound {
+		t.Fatalf("the record should be deleted, but %v", err)
+	}
+
+	err = db.Delete("v53/react-dom@17.0.2/es2020/react.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = db.Get("v53/react-dom@17.0.2/es2020/react.js"); err != ErrNotFound {
+		t.Fatalf("the record should be deleted, but %v", err)
+	}
+	// delete a missing record
+	if err = db.Delete("v53/react-dom@17.0.2/es2020/react.js"); err != nil {
+		t.Fatal(err)
+	}
+}
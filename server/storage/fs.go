@@ -19,6 +19,56 @@ type FS interface {
 	ReadFile(path string) (content io.ReadSeekCloser, err error)
 	WriteFile(path string, r io.Reader) (written int64, err error)
 	WriteData(path string, data []byte) error
+	// List returns the sorted paths of the files that start with the prefix
+	List(prefix string) (paths []string, err error)
+	// Delete deletes the file, it's not an error if the file doesn't exist
+	Delete(path string) error
+	// Stat returns the info of the file, or `ErrNotFound` if the file doesn't exist.
+	// It reads the metadata only, the content is not hashed.
+	Stat(path string) (info *FileInfo, err error)
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Size    int64     `json:"size"`
+	Modtime time.Time `json:"modtime"`
+	// the hex encoded sha256 of the file content, it's the stored checksum so the
+	// files that were written without the checksum have no hash
+	Hash string `json:"hash"`
+}
+
+// OrphanCollector is implemented by the file systems that may leave the unreferenced files,
+// they are deleted by the storage gc.
+type OrphanCollector interface {
+	// CollectOrphans deletes the unreferenced files and returns the count and size of them
+	CollectOrphans() (files int, bytes int64, err error)
+}
+
+// Walker is implemented by the file systems that list the files with their sizes without
+// loading all the paths into memory, the paths are not sorted.
+type Walker interface {
+	// Walk calls the fn with the paths that start with the prefix until it returns false
+	Walk(prefix string, fn func(path string, size int64) bool) error
+}
+
+// Walk calls the fn with the paths of the fs that start with the prefix until it returns
+// false, the paths are listed at once if the fs is not a `Walker`.
+func Walk(fs FS, prefix string, fn func(path string) bool) error {
+	if w, ok := fs.(Walker); ok {
+		return w.Walk(prefix, func(path string, size int64) bool {
+			return fn(path)
+		})
+	}
+	paths, err := fs.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if !fn(path) {
+			break
+		}
+	}
+	return nil
 }
 
 var fsDrivers = sync.Map{}
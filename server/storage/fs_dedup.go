@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dedupBlobsDir     = "blobs/"
+	dedupPathPrefix   = "dedup:path:"
+	dedupBlobPrefix   = "dedup:blob:"
+	dedupBlobRefsKey  = "refs"
+	dedupPathHashKey  = "hash"
+	dedupPathSizeKey  = "size"
+	dedupPathMtimeKey = "modtime"
+)
+
+// dedupFS is a content-addressed layer on top of a FS, the files are stored as the blobs
+// named by the sha256 of the content, and the paths are mapped to the blobs in the DB
+// with reference counting. The files that were written before the layer is enabled
+// are read from the FS directly.
+type dedupFS struct {
+	fs FS
+	db DB
+}
+
+// NewDedupFS returns a FS that stores the identical files once
+func NewDedupFS(fs FS, db DB) FS {
+	return &dedupFS{fs, db}
+}
+
+func (d *dedupFS) Exists(name string) (bool, time.Time, error) {
+	info, err := d.lookup(name)
+	if err == nil {
+		return true, info.Modtime, nil
+	}
+	if err != ErrNotFound {
+		return false, time.Time{}, err
+	}
+	return d.fs.Exists(name)
+}
+
+func (d *dedupFS) ReadFile(name string) (io.ReadSeekCloser, error) {
+	info, err := d.lookup(name)
+	if err == nil {
+		return d.fs.ReadFile(dedupBlobPath(info.Hash))
+	}
+	if err != ErrNotFound {
+		return nil, err
+	}
+	return d.fs.ReadFile(name)
+}
+
+func (d *dedupFS) WriteFile(name string, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), d.WriteData(name, data)
+}
+
+func (d *dedupFS) WriteData(name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	blobPath := dedupBlobPath(hash)
+
+	exists, _, err := d.fs.Exists(blobPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = d.fs.WriteData(blobPath, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	var newBlob bool
+	var unreferenced string
+	err = d.db.Update(func(tx DBTx) error {
+		var oldHash string
+		store, _, err := tx.Get(dedupPathPrefix + name)
+		if err == nil {
+			oldHash = store[dedupPathHashKey]
+		} else if err != ErrNotFound {
+			return err
+		}
+		newBlob, unreferenced = false, ""
+		if oldHash != hash {
+			refs, err := d.ref(tx, hash, 1)
+			if err != nil {
+				return err
+			}
+			newBlob = refs == 1
+			if oldHash != "" {
+				refs, err = d.ref(tx, oldHash, -1)
+				if err != nil {
+					return err
+				}
+				if refs <= 0 {
+					unreferenced = oldHash
+				}
+			}
+		}
+		return tx.Put(dedupPathPrefix+name, Store{
+			dedupPathHashKey:  hash,
+			dedupPathSizeKey:  strconv.Itoa(len(data)),
+			dedupPathMtimeKey: strconv.FormatInt(time.Now().UnixNano(), 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if unreferenced != "" {
+		d.deleteBlob(unreferenced)
+	}
+	// the blob may be deleted by the last dereference before the transaction
+	if newBlob {
+		exists, _, err = d.fs.Exists(blobPath)
+		if err == nil && !exists {
+			err = d.fs.WriteData(blobPath, data)
+		}
+	}
+	return err
+}
+
+func (d *dedupFS) List(prefix string) ([]string, error) {
+	paths, err := d.fs.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]struct{}{}
+	for _, name := range paths {
+		if !strings.HasPrefix(name, dedupBlobsDir) {
+			set[name] = struct{}{}
+		}
+	}
+	err = d.db.Scan(dedupPathPrefix+prefix, func(id string, store Store) bool {
+		set[strings.TrimPrefix(id, dedupPathPrefix)] = struct{}{}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths = nil
+	for name := range set {
+		paths = append(paths, name)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (d *dedupFS) Delete(name string) error {
+	var unreferenced string
+	err := d.db.Update(func(tx DBTx) error {
+		unreferenced = ""
+		store, _, err := tx.Get(dedupPathPrefix + name)
+		if err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		err = tx.Delete(dedupPathPrefix + name)
+		if err != nil {
+			return err
+		}
+		refs, err := d.ref(tx, store[dedupPathHashKey], -1)
+		if err == nil && refs <= 0 {
+			unreferenced = store[dedupPathHashKey]
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if unreferenced != "" {
+		d.deleteBlob(unreferenced)
+	}
+	return d.fs.Delete(name)
+}
+
+func (d *dedupFS) Stat(name string) (*FileInfo, error) {
+	info, err := d.lookup(name)
+	if err == ErrNotFound {
+		return d.fs.Stat(name)
+	}
+	return info, err
+}
+
+func (d *dedupFS) lookup(name string) (*FileInfo, error) {
+	store, _, err := d.db.Get(dedupPathPrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	size, _ := strconv.ParseInt(store[dedupPathSizeKey], 10, 64)
+	mtime, _ := strconv.ParseInt(store[dedupPathMtimeKey], 10, 64)
+	return &FileInfo{
+		Size:    size,
+		Modtime: time.Unix(0, mtime),
+		Hash:    store[dedupPathHashKey],
+	}, nil
+}
+
+// ref changes the reference count of the blob and returns the new count, the record of
+// the blob is deleted when it's not referenced any more. The blob file is deleted by
+// `deleteBlob` after the transaction is committed.
+func (d *dedupFS) ref(tx DBTx, hash string, delta int) (refs int, err error) {
+	store, _, err := tx.Get(dedupBlobPrefix + hash)
+	if err == nil {
+		refs, _ = strconv.Atoi(store[dedupBlobRefsKey])
+	} else if err != ErrNotFound {
+		return
+	}
+	refs += delta
+	if refs <= 0 {
+		err = tx.Delete(dedupBlobPrefix + hash)
+		return
+	}
+	err = tx.Put(dedupBlobPrefix+hash, Store{dedupBlobRefsKey: strconv.Itoa(refs)})
+	return
+}
+
+// deleteBlob deletes the blob file if it's not referenced. The check and the deletion are
+// in a transaction that writes nothing, so a concurrent writer that references the blob
+// again either keeps it, or rewrites it after its transaction. The blobs that failed to be
+// deleted are left to `CollectOrphans`.
+func (d *dedupFS) deleteBlob(hash string) (deleted bool, err error) {
+	err = d.db.Update(func(tx DBTx) error {
+		deleted = false
+		_, _, err := tx.Get(dedupBlobPrefix + hash)
+		if err != ErrNotFound {
+			return err
+		}
+		deleted = true
+		return d.fs.Delete(dedupBlobPath(hash))
+	})
+	if err != nil {
+		log.Warnf("dedup fs: delete blob %s: %v", hash, err)
+	}
+	return
+}
+
+// CollectOrphans deletes the blobs that are not referenced, e.g. the blobs that failed to be
+// deleted after the last dereference, or the blobs of the interrupted writes.
+func (d *dedupFS) CollectOrphans() (files int, bytes int64, err error) {
+	var walkErr error
+	err = Walk(d.fs, dedupBlobsDir, func(blobPath string) bool {
+		hash := path.Base(blobPath)
+		if len(hash) != sha256.Size*2 || blobPath != dedupBlobPath(hash) {
+			return true
+		}
+		if _, _, err := d.db.Get(dedupBlobPrefix + hash); err != ErrNotFound {
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			return true
+		}
+		info, err := d.fs.Stat(blobPath)
+		if err != nil {
+			return true
+		}
+		deleted, err := d.deleteBlob(hash)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		if deleted {
+			files++
+			bytes += info.Size
+		}
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	return
+}
+
+func dedupBlobPath(hash string) string {
+	return path.Join(dedupBlobsDir, hash[:2], hash)
+}
@@ -1,14 +1,30 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// the dir of the checksums, temporary and quarantined files in the root, it's not listed
+const localFSMetaDir = ".esmd"
+
+// the error to stop the walk of the dirs
+var errWalkStopped = errors.New("walk stopped")
+
 type localFS struct{}
 
 func (fs *localFS) Open(root string, options url.Values) (FS, error) {
@@ -17,11 +33,22 @@ func (fs *localFS) Open(root string, options url.Values) (FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &localFSLayer{root}, nil
+	return &localFSLayer{root: root}, nil
 }
 
+// localFSLayer writes the files atomically with a temporary file and rename, and stores
+// the sha256 checksum of each file. The files are verified when they are read, a corrupt
+// file is moved to the quarantine dir so it's rebuilt instead of being served.
 type localFSLayer struct {
 	root string
+	// the files that are verified, by the name
+	verified sync.Map
+	locks    [64]sync.Mutex
+}
+
+type localFSVerifiedFile struct {
+	size    int64
+	modtime time.Time
 }
 
 func (fs *localFSLayer) Exists(name string) (bool, time.Time, error) {
@@ -39,7 +66,30 @@ func (fs *localFSLayer) Exists(name string) (bool, time.Time, error) {
 
 func (fs *localFSLayer) ReadFile(name string) (file io.ReadSeekCloser, err error) {
 	fullPath := path.Join(fs.root, name)
-	return os.Open(fullPath)
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	if v, ok := fs.verified.Load(name); ok {
+		if vf := v.(localFSVerifiedFile); vf.size == fi.Size() && vf.modtime.Equal(fi.ModTime()) {
+			return f, nil
+		}
+	}
+	_, err = fs.verify(name, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	fs.verified.Store(name, localFSVerifiedFile{fi.Size(), fi.ModTime()})
+	return f, nil
 }
 
 func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
@@ -48,26 +98,229 @@ func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64
 	if err != nil {
 		return
 	}
+	tmpDir := path.Join(fs.root, localFSMetaDir, "tmp")
+	err = ensureDir(tmpDir)
+	if err != nil {
+		return
+	}
 
-	file, err := os.Create(fullPath)
+	file, err := ioutil.TempFile(tmpDir, path.Base(name)+".*")
 	if err != nil {
 		return
 	}
+	defer os.Remove(file.Name())
 
-	written, err = io.Copy(file, content)
+	hash := sha256.New()
+	written, err = io.Copy(io.MultiWriter(file, hash), content)
+	if err == nil {
+		// flush the content before the rename, or a crash may leave an empty file
+		err = file.Sync()
+	}
 	if closeError := file.Close(); closeError != nil && err == nil {
 		err = closeError
 	}
+	if err != nil {
+		return
+	}
+
+	lock := fs.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the checksum is stored before the file, a crash between the renames leaves
+	// a mismatched checksum which is quarantined by the next read
+	err = fs.writeChecksum(name, hex.EncodeToString(hash.Sum(nil)))
+	if err == nil {
+		err = os.Rename(file.Name(), fullPath)
+	}
+	fs.verified.Delete(name)
 	return
 }
 
 func (fs *localFSLayer) WriteData(name string, data []byte) error {
+	_, err := fs.WriteFile(name, bytes.NewReader(data))
+	return err
+}
+
+func (fs *localFSLayer) List(prefix string) (paths []string, err error) {
+	err = fs.Walk(prefix, func(name string, size int64) bool {
+		paths = append(paths, name)
+		return true
+	})
+	sort.Strings(paths)
+	return
+}
+
+func (fs *localFSLayer) Walk(prefix string, fn func(name string, size int64) bool) error {
+	// walk the deepest dir of the prefix
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	metaDir := path.Join(fs.root, localFSMetaDir)
+	err := filepath.WalkDir(path.Join(fs.root, dir), func(fullPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if filepath.ToSlash(fullPath) == metaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name, err := filepath.Rel(fs.root, fullPath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, strings.TrimPrefix(prefix, "./")) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fn(name, info.Size()) {
+			return errWalkStopped
+		}
+		return nil
+	})
+	if err == errWalkStopped {
+		return nil
+	}
+	return err
+}
+
+func (fs *localFSLayer) Delete(name string) error {
+	lock := fs.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fs.verified.Delete(name)
+	err := os.Remove(path.Join(fs.root, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(fs.checksumPath(name))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *localFSLayer) Stat(name string) (*FileInfo, error) {
+	fi, err := os.Stat(path.Join(fs.root, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	// the stored checksum, the file is verified when it's read
+	checksum, err := ioutil.ReadFile(fs.checksumPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &FileInfo{
+		Size:    fi.Size(),
+		Modtime: fi.ModTime(),
+		Hash:    string(checksum),
+	}, nil
+}
+
+// verify computes the sha256 of the file and checks it with the stored checksum, the files
+// that were written before the checksums are not verified.
+func (fs *localFSLayer) verify(name string, file *os.File) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	checksum, err := ioutil.ReadFile(fs.checksumPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sum, nil
+		}
+		return "", err
+	}
+	if string(checksum) != sum && fs.quarantine(name, file, sum) {
+		return "", ErrCorrupted
+	}
+	return sum, nil
+}
+
+// quarantine moves the corrupt file to the quarantine dir for the inspection, it checks
+// the file again with the lock of the renames, the file may be rewritten after it's opened.
+func (fs *localFSLayer) quarantine(name string, file *os.File, sum string) bool {
+	lock := fs.lock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
 	fullPath := path.Join(fs.root, name)
-	err := ensureDir(path.Dir(fullPath))
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+	if ofi, err := file.Stat(); err != nil || !os.SameFile(fi, ofi) {
+		return false
+	}
+	checksum, err := ioutil.ReadFile(fs.checksumPath(name))
+	if err != nil || string(checksum) == sum {
+		return false
+	}
+
+	quarantinePath := path.Join(fs.root, localFSMetaDir, "quarantine", name+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+	err = ensureDir(path.Dir(quarantinePath))
+	if err == nil {
+		err = os.Rename(fullPath, quarantinePath)
+	}
+	if err != nil {
+		log.Errorf("local fs: quarantine %s: %v", name, err)
+		return true
+	}
+	os.Remove(fs.checksumPath(name))
+	fs.verified.Delete(name)
+	log.Warnf("local fs: %s is corrupted, moved to %s", name, quarantinePath)
+	return true
+}
+
+func (fs *localFSLayer) writeChecksum(name string, sum string) error {
+	checksumPath := fs.checksumPath(name)
+	err := ensureDir(path.Dir(checksumPath))
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(path.Join(fs.root, localFSMetaDir, "tmp"), path.Base(name)+".sha256.*")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(fullPath, data, 0666)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(sum)
+	if closeError := file.Close(); closeError != nil && err == nil {
+		err = closeError
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), checksumPath)
+}
+
+func (fs *localFSLayer) checksumPath(name string) string {
+	return path.Join(fs.root, localFSMetaDir, "checksums", name)
+}
+
+// lock returns the lock of the renames of the name
+func (fs *localFSLayer) lock(name string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &fs.locks[h.Sum32()%uint32(len(fs.locks))]
 }
 
 func init() {
@@ -6,7 +6,6 @@ import (
 	"io"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"time"
 
@@ -26,7 +25,7 @@ func (fs *LocalLRUFS) Open(root string, options url.Values) (FS, error) {
 	}
 
 	remove := func(name string) {
-		go os.Remove(path.Join(root, name))
+		go backingFS.Delete(name)
 	}
 
 	cache, err := ristretto.NewCache(&ristretto.Config{
@@ -75,6 +74,13 @@ func (fs *LocalLRUFS) Open(root string, options url.Values) (FS, error) {
 			if err != nil {
 				return err
 			}
+			if entry.IsDir() {
+				// the checksums and temporary files of the local fs
+				if entry.Name() == localFSMetaDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			info, err := entry.Info()
 			if err != nil {
 				return err
@@ -107,6 +113,7 @@ func (fs *LocalLRUFS) Open(root string, options url.Values) (FS, error) {
 	}, nil
 }
 
+// localLRUFSLayer predates the `tiered` fs, it's kept for the compatibility.
 type localLRUFSLayer struct {
 	backingFS FS
 	cache     *ristretto.Cache
@@ -183,6 +190,34 @@ func (fs *localLRUFSLayer) WriteData(name string, data []byte) (err error) {
 	return
 }
 
+func (fs *localLRUFSLayer) List(prefix string) (paths []string, err error) {
+	fs.cache.Wait()
+	names, err := fs.backingFS.List(prefix)
+	if err != nil {
+		return
+	}
+	// skip the evicted files that are being removed
+	for _, name := range names {
+		if _, found := fs.cache.Get(name); found {
+			paths = append(paths, name)
+		}
+	}
+	return
+}
+
+func (fs *localLRUFSLayer) Delete(name string) error {
+	fs.cache.Del(name)
+	return fs.backingFS.Delete(name)
+}
+
+func (fs *localLRUFSLayer) Stat(name string) (*FileInfo, error) {
+	fs.cache.Wait()
+	if _, found := fs.cache.Get(name); !found {
+		return nil, ErrNotFound
+	}
+	return fs.backingFS.Stat(name)
+}
+
 func init() {
 	RegisterFS("localLRU", &LocalLRUFS{})
 }
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryFS struct{}
+
+func (fs *memoryFS) Open(root string, options url.Values) (FS, error) {
+	return &memoryFSLayer{files: map[string]*memoryFile{}}, nil
+}
+
+type memoryFile struct {
+	data    []byte
+	modtime time.Time
+	hash    string
+}
+
+// memoryFSLayer keeps the files in memory, it's the hot tier of the `tiered` fs that
+// limits its size.
+type memoryFSLayer struct {
+	lock  sync.RWMutex
+	files map[string]*memoryFile
+}
+
+func (fs *memoryFSLayer) get(name string) (*memoryFile, bool) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	file, ok := fs.files[name]
+	return file, ok
+}
+
+func (fs *memoryFSLayer) Exists(name string) (bool, time.Time, error) {
+	file, ok := fs.get(name)
+	if !ok {
+		return false, time.Time{}, nil
+	}
+	return true, file.modtime, nil
+}
+
+func (fs *memoryFSLayer) ReadFile(name string) (io.ReadSeekCloser, error) {
+	file, ok := fs.get(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &readSeekNopCloser{bytes.NewReader(file.data)}, nil
+}
+
+func (fs *memoryFSLayer) WriteFile(name string, content io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), fs.WriteData(name, data)
+}
+
+func (fs *memoryFSLayer) WriteData(name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	file := &memoryFile{
+		data:    data,
+		modtime: time.Now(),
+		hash:    hex.EncodeToString(sum[:]),
+	}
+	fs.lock.Lock()
+	fs.files[name] = file
+	fs.lock.Unlock()
+	return nil
+}
+
+func (fs *memoryFSLayer) List(prefix string) (paths []string, err error) {
+	fs.lock.RLock()
+	for name := range fs.files {
+		if strings.HasPrefix(name, prefix) {
+			paths = append(paths, name)
+		}
+	}
+	fs.lock.RUnlock()
+	sort.Strings(paths)
+	return
+}
+
+func (fs *memoryFSLayer) Delete(name string) error {
+	fs.lock.Lock()
+	delete(fs.files, name)
+	fs.lock.Unlock()
+	return nil
+}
+
+func (fs *memoryFSLayer) Stat(name string) (*FileInfo, error) {
+	file, ok := fs.get(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &FileInfo{
+		Size:    int64(len(file.data)),
+		Modtime: file.modtime,
+		Hash:    file.hash,
+	}, nil
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (r *readSeekNopCloser) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterFS("memory", &memoryFS{})
+}
@@ -2,8 +2,13 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,6 +18,11 @@ import (
 
 type s3FS struct{}
 
+// the object metadata key of the sha256 of the content
+const s3HashMetadataKey = "Sha256"
+
+// getBackingFS opens the `backingFS` option, it predates the `tiered` fs and is kept for
+// the compatibility.
 func getBackingFS(options url.Values) (FS, error) {
 	url := options.Get("backingFS")
 	if url != "" {
@@ -28,11 +38,46 @@ func (fs *s3FS) Open(bucket string, options url.Values) (FS, error) {
 	}
 	accountId := options.Get("accountId")
 	region := options.Get("region")
+	endpoint := options.Get("endpoint")
+	accessKeyId := options.Get("accessKeyId")
+	secretAccessKey := options.Get("secretAccessKey")
+	sessionToken := options.Get("sessionToken")
+	pathStyle := false
+	if v := options.Get("pathStyle"); v != "" {
+		pathStyle, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid pathStyle value")
+		}
+	}
+	partSize, err := parseBytesValue(options.Get("partSize"), 0)
+	if err != nil {
+		return nil, errors.New("invalid partSize value")
+	}
+	maxRetries := 2
+	if v := options.Get("maxRetries"); v != "" {
+		maxRetries, err = strconv.Atoi(v)
+		if err != nil || maxRetries < 0 {
+			return nil, errors.New("invalid maxRetries value")
+		}
+	}
+	timeout, err := parseDurationValue(options.Get("timeout"), 10*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid timeout value")
+	}
 	s3Client, err := NewS3Client(&SimpleS3ClientConfig{
-		Bucket:    &bucket,
-		AccountId: &accountId,
-		Region:    &region,
-		Log:       log,
+		Bucket:          &bucket,
+		AccountId:       &accountId,
+		Region:          &region,
+		Endpoint:        &endpoint,
+		PathStyle:       pathStyle,
+		AccessKeyId:     &accessKeyId,
+		SecretAccessKey: &secretAccessKey,
+		SessionToken:    &sessionToken,
+		Prefix:          options.Get("prefix"),
+		PartSize:        partSize,
+		MaxRetries:      maxRetries,
+		Timeout:         timeout,
+		Log:             log,
 	})
 	if err != nil {
 		return nil, err
@@ -45,6 +90,16 @@ type s3FSLayer struct {
 	s3Client  SimpleS3Client
 }
 
+func isS3NotFound(err error) bool {
+	// http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+	// https://github.com/awsdocs/aws-doc-sdk-examples/blob/master/go/example_code/extending_sdk/handleServiceErrorCodes.go
+	if awsErr, ok := err.(awserr.Error); ok {
+		// the HEAD request returns `NotFound` without the body
+		return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+	}
+	return false
+}
+
 func (fs *s3FSLayer) Exists(name string) (bool, time.Time, error) {
 	var modtime time.Time
 	if fs.backingFS != nil {
@@ -55,12 +110,8 @@ func (fs *s3FSLayer) Exists(name string) (bool, time.Time, error) {
 	}
 	result, err := fs.s3Client.Head(&name)
 	if err != nil {
-		// http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
-		// https://github.com/awsdocs/aws-doc-sdk-examples/blob/master/go/example_code/extending_sdk/handleServiceErrorCodes.go
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == s3.ErrCodeNoSuchKey {
-				return false, modtime, nil
-			}
+		if isS3NotFound(err) {
+			return false, modtime, nil
 		}
 		return false, modtime, err
 	}
@@ -93,23 +144,42 @@ func (fs *s3FSLayer) ReadFile(name string) (io.ReadSeekCloser, error) {
 }
 
 func (fs *s3FSLayer) WriteFile(name string, content io.Reader) (int64, error) {
-	_, err := fs.s3Client.Put(&name, aws.ReadSeekCloser(content))
+	// the metadata is sent before the content, so the hash is computed only if the
+	// content can be read twice, otherwise the content is streamed without the hash
+	metadata := map[string]*string{}
+	if rs, ok := content.(io.ReadSeeker); ok {
+		offset, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, rs)
+		if err == nil {
+			_, err = rs.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			return 0, err
+		}
+		metadata[s3HashMetadataKey] = aws.String(hex.EncodeToString(hash.Sum(nil)))
+	}
+	r := &s3CountingReader{r: content}
+	_, err := fs.s3Client.Put(&name, r, metadata)
 	if err != nil {
 		return 0, err
 	}
 	if fs.backingFS != nil {
-		go fs.backingFS.WriteFile(name, content)
-	}
-	result, err := fs.s3Client.Head(&name)
-	if err != nil {
-		return 0, err
+		// the copy of the backing fs is stale, it's restored from s3 by the next read
+		fs.backingFS.Delete(name)
 	}
-	return aws.Int64Value(result.ContentLength), nil
+	return r.n, nil
 }
 
 func (fs *s3FSLayer) WriteData(name string, data []byte) error {
 	content := bytes.NewReader(data)
-	_, err := fs.s3Client.Put(&name, content)
+	sum := sha256.Sum256(data)
+	_, err := fs.s3Client.Put(&name, content, map[string]*string{
+		s3HashMetadataKey: aws.String(hex.EncodeToString(sum[:])),
+	})
 	if err != nil {
 		return err
 	}
@@ -119,6 +189,66 @@ func (fs *s3FSLayer) WriteData(name string, data []byte) error {
 	return nil
 }
 
+func (fs *s3FSLayer) List(prefix string) ([]string, error) {
+	var keys []string
+	err := fs.Walk(prefix, func(key string, size int64) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (fs *s3FSLayer) Walk(prefix string, fn func(name string, size int64) bool) error {
+	return fs.s3Client.List(&prefix, fn)
+}
+
+func (fs *s3FSLayer) Delete(name string) error {
+	if fs.backingFS != nil {
+		err := fs.backingFS.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fs.s3Client.Delete(&name)
+	if err != nil && !isS3NotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *s3FSLayer) Stat(name string) (*FileInfo, error) {
+	result, err := fs.s3Client.Head(&name)
+	if err != nil {
+		if isS3NotFound(err) {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	info := &FileInfo{
+		Size:    aws.Int64Value(result.ContentLength),
+		Modtime: aws.TimeValue(result.LastModified),
+		// the objects that were written without the hash metadata have no hash
+		Hash: aws.StringValue(result.Metadata[s3HashMetadataKey]),
+	}
+	return info, nil
+}
+
+// s3CountingReader counts the bytes of the streamed content
+type s3CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *s3CountingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 func init() {
 	RegisterFS("s3", &s3FS{})
 }
@@ -6,29 +6,57 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	logx "github.com/ije/gox/log"
 )
 
 type SimpleS3Client interface {
 	Head(key *string) (*s3.HeadObjectOutput, error)
 	Get(key *string) (*s3.GetObjectOutput, error)
-	Put(key *string, body io.ReadSeeker) (*s3.PutObjectOutput, error)
+	Put(key *string, body io.Reader, metadata map[string]*string) (*s3.PutObjectOutput, error)
+	// List calls the fn with the keys and sizes of the prefix page by page until it returns false
+	List(prefix *string, fn func(key string, size int64) bool) error
+	Delete(key *string) (*s3.DeleteObjectOutput, error)
 }
 
 type SimpleS3ClientConfig struct {
 	AccountId *string
 	Bucket    *string
 	Region    *string
-	Log       *logx.Logger
+	// the endpoint of a S3 compatible service, e.g. MinIO or Cloudflare R2
+	Endpoint *string
+	// use the path-style urls (`endpoint/bucket/key`) instead of the bucket subdomains
+	PathStyle bool
+	// the static credentials, the credentials are derived by environment if not provided
+	AccessKeyId     *string
+	SecretAccessKey *string
+	SessionToken    *string
+	// the prefix of the object keys
+	Prefix string
+	// the files that are larger than the part size are uploaded in parts
+	PartSize   int64
+	MaxRetries int
+	Timeout    time.Duration
+	Log        *logx.Logger
 }
 
 func NewS3Client(config *SimpleS3ClientConfig) (SimpleS3Client, error) {
 
+	if config.Endpoint == nil || *config.Endpoint == "" {
+		S3_ENDPOINT, found := os.LookupEnv("S3_ENDPOINT")
+		if found {
+			config.Endpoint = aws.String(S3_ENDPOINT)
+		}
+	}
+	customEndpoint := aws.StringValue(config.Endpoint) != ""
+
 	if config.AccountId == nil || *config.AccountId == "" {
 		S3_ACCOUNT_ID, found := os.LookupEnv("S3_ACCOUNT_ID")
 		if !found {
@@ -39,7 +67,7 @@ func NewS3Client(config *SimpleS3ClientConfig) (SimpleS3Client, error) {
 		}
 		if found {
 			config.AccountId = aws.String(S3_ACCOUNT_ID)
-		} else {
+		} else if !customEndpoint {
 			return nil, errors.New("S3ClientConfig.AccountId not provided and cannot not be derived by environment")
 		}
 	}
@@ -63,24 +91,67 @@ func NewS3Client(config *SimpleS3ClientConfig) (SimpleS3Client, error) {
 		}
 		if found {
 			config.Region = aws.String(S3_REGION)
+		} else if customEndpoint {
+			// the S3 compatible services ignore the region mostly
+			config.Region = aws.String("us-east-1")
 		} else {
 			return nil, errors.New("S3ClientConfig.Region not provided and cannot not be derived by environment")
 		}
 	}
 
-	awsSession := session.Must(session.NewSession(&aws.Config{
-		MaxRetries:                    aws.Int(2),
+	if config.AccessKeyId == nil || *config.AccessKeyId == "" {
+		S3_ACCESS_KEY_ID, found := os.LookupEnv("S3_ACCESS_KEY_ID")
+		if found {
+			S3_SECRET_ACCESS_KEY := os.Getenv("S3_SECRET_ACCESS_KEY")
+			if S3_SECRET_ACCESS_KEY == "" {
+				return nil, errors.New("S3_SECRET_ACCESS_KEY not provided with S3_ACCESS_KEY_ID")
+			}
+			config.AccessKeyId = aws.String(S3_ACCESS_KEY_ID)
+			config.SecretAccessKey = aws.String(S3_SECRET_ACCESS_KEY)
+			config.SessionToken = aws.String(os.Getenv("S3_SESSION_TOKEN"))
+		}
+	} else if aws.StringValue(config.SecretAccessKey) == "" {
+		return nil, errors.New("S3ClientConfig.SecretAccessKey not provided with the AccessKeyId")
+	}
+
+	if config.PartSize == 0 {
+		config.PartSize = s3manager.DefaultUploadPartSize
+	} else if config.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("S3ClientConfig.PartSize must be at least %d bytes", s3manager.MinUploadPartSize)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	awsConfig := &aws.Config{
+		MaxRetries:                    aws.Int(config.MaxRetries),
 		CredentialsChainVerboseErrors: aws.Bool(true),
-		HTTPClient:                    &http.Client{Timeout: 10 * time.Second},
+		HTTPClient:                    &http.Client{Timeout: config.Timeout},
 		Region:                        config.Region,
-	}))
+		S3ForcePathStyle:              aws.Bool(config.PathStyle),
+	}
+	if customEndpoint {
+		awsConfig.Endpoint = config.Endpoint
+	}
+	if aws.StringValue(config.AccessKeyId) != "" {
+		// otherwise the default chain looks up the `AWS_*` env, the shared credentials file and the EC2 role
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			aws.StringValue(config.AccessKeyId),
+			aws.StringValue(config.SecretAccessKey),
+			aws.StringValue(config.SessionToken),
+		)
+	}
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("NewS3Client session err: %v", err)
+	}
 	s3Client := s3.New(awsSession)
 
-	config.Log.Debugf("NewS3Client HeadBucket request: %s, ExpectedBucketOwner: %s", *config.Bucket, *config.AccountId)
+	config.Log.Debugf("NewS3Client HeadBucket request: %s, ExpectedBucketOwner: %s", *config.Bucket, aws.StringValue(config.AccountId))
 
 	output, err := s3Client.HeadBucket(&s3.HeadBucketInput{
 		Bucket:              config.Bucket,
-		ExpectedBucketOwner: config.AccountId,
+		ExpectedBucketOwner: expectedBucketOwner(config),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("NewS3Client HeadBucket err: %v", err)
@@ -90,33 +161,79 @@ func NewS3Client(config *SimpleS3ClientConfig) (SimpleS3Client, error) {
 	return &simpleS3ClientImpl{
 		config:   config,
 		s3Client: s3Client,
+		uploader: s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+			u.PartSize = config.PartSize
+		}),
 	}, nil
 }
 
+// expectedBucketOwner returns nil if the account id is not provided for a S3 compatible service
+func expectedBucketOwner(config *SimpleS3ClientConfig) *string {
+	if aws.StringValue(config.AccountId) == "" {
+		return nil
+	}
+	return config.AccountId
+}
+
 type simpleS3ClientImpl struct {
 	config   *SimpleS3ClientConfig
 	s3Client *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func (c *simpleS3ClientImpl) key(name *string) *string {
+	return aws.String(c.config.Prefix + aws.StringValue(name))
 }
 
 func (c *simpleS3ClientImpl) Head(key *string) (*s3.HeadObjectOutput, error) {
 	return c.s3Client.HeadObject(&s3.HeadObjectInput{
 		Bucket:              c.config.Bucket,
-		Key:                 key,
-		ExpectedBucketOwner: c.config.AccountId,
+		Key:                 c.key(key),
+		ExpectedBucketOwner: expectedBucketOwner(c.config),
 	})
 }
 
 func (c *simpleS3ClientImpl) Get(key *string) (*s3.GetObjectOutput, error) {
 	return c.s3Client.GetObject(&s3.GetObjectInput{
 		Bucket: c.config.Bucket,
-		Key:    key,
+		Key:    c.key(key),
+	})
+}
+
+// Put uploads the body in one request, or in parts if it's larger than the part size
+func (c *simpleS3ClientImpl) Put(key *string, body io.Reader, metadata map[string]*string) (*s3.PutObjectOutput, error) {
+	output, err := c.uploader.Upload(&s3manager.UploadInput{
+		Bucket:   c.config.Bucket,
+		Key:      c.key(key),
+		Body:     body,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{
+		ETag:      output.ETag,
+		VersionId: output.VersionID,
+	}, nil
+}
+
+func (c *simpleS3ClientImpl) List(prefix *string, fn func(key string, size int64) bool) error {
+	return c.s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: c.config.Bucket,
+		Prefix: c.key(prefix),
+	}, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			if !fn(strings.TrimPrefix(aws.StringValue(object.Key), c.config.Prefix), aws.Int64Value(object.Size)) {
+				return false
+			}
+		}
+		return true
 	})
 }
 
-func (c *simpleS3ClientImpl) Put(key *string, body io.ReadSeeker) (*s3.PutObjectOutput, error) {
-	return c.s3Client.PutObject(&s3.PutObjectInput{
+func (c *simpleS3ClientImpl) Delete(key *string) (*s3.DeleteObjectOutput, error) {
+	return c.s3Client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: c.config.Bucket,
-		Key:    key,
-		Body:   body,
+		Key:    c.key(key),
 	})
 }
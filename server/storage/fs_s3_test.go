@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+func TestS3FSEndpoint(t *testing.T) {
+	server := newFakeS3Server("esm", "test-key")
+	defer server.Close()
+
+	_, err := OpenFS("s3:esm?endpoint=" + server.URL + "&pathStyle=true&accessKeyId=wrong-key&secretAccessKey=secret")
+	if err == nil {
+		t.Fatal("should be access denied error")
+	}
+
+	// the access key id without the secret
+	_, err = OpenFS("s3:esm?endpoint=" + server.URL + "&pathStyle=true&accessKeyId=test-key")
+	if err == nil {
+		t.Fatal("should be missing secret error")
+	}
+	os.Setenv("S3_ACCESS_KEY_ID", "test-key")
+	_, err = OpenFS("s3:esm?endpoint=" + server.URL + "&pathStyle=true")
+	os.Unsetenv("S3_ACCESS_KEY_ID")
+	if err == nil || !strings.Contains(err.Error(), "S3_SECRET_ACCESS_KEY") {
+		t.Fatalf("should be missing secret error, but %v", err)
+	}
+
+	fsUrl := "s3:esm?endpoint=" + server.URL + "&pathStyle=true&accessKeyId=test-key&secretAccessKey=secret&prefix=esm/&partSize=5MB&maxRetries=3"
+	fs, err := OpenFS(fsUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, fs)
+
+	// the keys are prefixed
+	if _, ok := server.object("esm/raw/react@17.0.2/package.json"); !ok {
+		t.Fatal("the key should be prefixed")
+	}
+
+	// the large file is uploaded in parts
+	name := "builds/v53/large@1.0.0/es2020/large.js"
+	data := bytes.Repeat([]byte("0123456789abcdef"), 768*1024)
+	err = fs.WriteData(name, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.completedUploads(); n != 1 {
+		t.Fatalf("should be uploaded in parts, but %d multipart uploads", n)
+	}
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || info.Hash != sha256Hex(data) {
+		t.Fatalf("unexpected stat %v", info)
+	}
+	r, err := fs.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatal("unexpected content of the large file")
+	}
+
+	// the failed requests are retried
+	server.failNext(2)
+	err = fs.WriteData("raw/retry@1.0.0/index.js", []byte("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.failNext(5)
+	if _, err = fs.Stat("raw/retry@1.0.0/index.js"); err == nil {
+		t.Fatal("should be error after the retries")
+	}
+}
+
+type fakeS3StoredObject struct {
+	data     []byte
+	metadata http.Header
+	modtime  time.Time
+}
+
+type fakeS3Upload struct {
+	metadata http.Header
+	parts    map[int][]byte
+}
+
+// fakeS3Server is a S3 compatible server with the path-style urls, it supports the requests
+// that the s3 fs sends only.
+type fakeS3Server struct {
+	*httptest.Server
+	bucket      string
+	accessKeyId string
+	lock        sync.Mutex
+	objects     map[string]*fakeS3StoredObject
+	uploads     map[string]*fakeS3Upload
+	uploadSeq   int
+	completed   int
+	failures    int
+}
+
+func newFakeS3Server(bucket string, accessKeyId string) *fakeS3Server {
+	s := &fakeS3Server{
+		bucket:      bucket,
+		accessKeyId: accessKeyId,
+		objects:     map[string]*fakeS3StoredObject{},
+		uploads:     map[string]*fakeS3Upload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeS3Server) object(key string) (*fakeS3StoredObject, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+func (s *fakeS3Server) completedUploads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.completed
+}
+
+// failNext makes the next n requests fail with the `500` status
+func (s *fakeS3Server) failNext(n int) {
+	s.lock.Lock()
+	s.failures = n
+	s.lock.Unlock()
+}
+
+func (s *fakeS3Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		s.error(w, r, 500, "InternalError")
+		return
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+s.accessKeyId+"/") {
+		s.error(w, r, 403, "AccessDenied")
+		return
+	}
+
+	bucket, key := splitFakeS3Path(r.URL.Path)
+	if bucket != s.bucket {
+		s.error(w, r, 404, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	if key == "" {
+		switch r.Method {
+		case "HEAD":
+			w.WriteHeader(200)
+		case "GET":
+			s.list(w, query.Get("prefix"))
+		default:
+			s.error(w, r, 405, "MethodNotAllowed")
+		}
+		return
+	}
+
+	switch r.Method {
+	case "HEAD", "GET":
+		object, ok := s.objects[key]
+		if !ok {
+			s.error(w, r, 404, "NoSuchKey")
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modtime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(200)
+		if r.Method == "GET" {
+			w.Write(object.data)
+		}
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, r, 400, "IncompleteBody")
+			return
+		}
+		if uploadId := query.Get("uploadId"); uploadId != "" {
+			upload, ok := s.uploads[uploadId]
+			if !ok {
+				s.error(w, r, 404, "NoSuchUpload")
+				return
+			}
+			partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+			upload.parts[partNumber] = data
+			w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, uploadId, partNumber))
+			w.WriteHeader(200)
+			return
+		}
+		s.objects[key] = &fakeS3StoredObject{data: data, metadata: amzMetadata(r.Header), modtime: time.Now()}
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(200)
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			s.uploadSeq++
+			uploadId := strconv.Itoa(s.uploadSeq)
+			s.uploads[uploadId] = &fakeS3Upload{metadata: amzMetadata(r.Header), parts: map[int][]byte{}}
+			writeFakeS3XML(w, "InitiateMultipartUploadResult", fmt.Sprintf(
+				"<Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId>", bucket, key, uploadId,
+			))
+			return
+		}
+		uploadId := query.Get("uploadId")
+		upload, ok := s.uploads[uploadId]
+		if !ok {
+			s.error(w, r, 404, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		buf := bytes.NewBuffer(nil)
+		for _, n := range numbers {
+			buf.Write(upload.parts[n])
+		}
+		delete(s.uploads, uploadId)
+		s.objects[key] = &fakeS3StoredObject{data: buf.Bytes(), metadata: upload.metadata, modtime: time.Now()}
+		s.completed++
+		writeFakeS3XML(w, "CompleteMultipartUploadResult", fmt.Sprintf(
+			"<Bucket>%s</Bucket><Key>%s</Key><ETag>\"etag\"</ETag>", bucket, key,
+		))
+	case "DELETE":
+		if uploadId := query.Get("uploadId"); uploadId != "" {
+			delete(s.uploads, uploadId)
+		} else {
+			delete(s.objects, key)
+		}
+		w.WriteHeader(204)
+	default:
+		s.error(w, r, 405, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3Server) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "<Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>", s.bucket, prefix, len(keys))
+	for _, key := range keys {
+		buf.WriteString("<Contents><Key>")
+		xml.EscapeText(buf, []byte(key))
+		fmt.Fprintf(buf, "</Key><Size>%d</Size></Contents>", len(s.objects[key].data))
+	}
+	writeFakeS3XML(w, "ListBucketResult", buf.String())
+}
+
+func (s *fakeS3Server) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func splitFakeS3Path(p string) (bucket string, key string) {
+	p = strings.TrimPrefix(p, "/")
+	i := strings.IndexByte(p, '/')
+	if i < 0 {
+		return p, ""
+	}
+	return p[:i], p[i+1:]
+}
+
+func amzMetadata(header http.Header) http.Header {
+	metadata := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+func writeFakeS3XML(w http.ResponseWriter, root string, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><%s xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</%s>`, root, body, root)
+}
+
+func TestRedactFSUrl(t *testing.T) {
+	fsUrl := "tiered:?tier=local:/var/cache/esmd%3FmaxSize%3D10GB&tier=s3:esm%3FaccessKeyId%3Dkey%26secretAccessKey%3Dsecret%26sessionToken%3Dtoken&write=back"
+	redacted := RedactConfigUrl(fsUrl)
+	_, addr := utils.SplitByFirstByte(redacted, ':')
+	_, options, err := parseConfigUrl(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"local:/var/cache/esmd?maxSize=10GB", "s3:esm?accessKeyId=key&secretAccessKey=redacted&sessionToken=redacted"}
+	if options.Get("write") != "back" || !reflect.DeepEqual(options["tier"], expected) {
+		t.Fatalf("unexpected redacted url %s", redacted)
+	}
+}
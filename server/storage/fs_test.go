@@ -0,0 +1,622 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLocalFS(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-local")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, fs)
+}
+
+func TestLocalFSIntegrity(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-local-integrity")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "builds/v53/react@17.0.2/es2020/react.js"
+	err = fs.WriteData(name, []byte("export default React"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file that was written before the checksums
+	err = os.MkdirAll(path.Join(root, "raw/react@17.0.2"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(root, "raw/react@17.0.2/index.js"), []byte("legacy"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{name, "raw/react@17.0.2/index.js"} {
+		r, err := fs.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+
+	// the metadata and temporary files are not listed
+	paths, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{name, "raw/react@17.0.2/index.js"}) {
+		t.Fatalf("unexpected list %v", paths)
+	}
+	tmpFiles, _ := ioutil.ReadDir(path.Join(root, localFSMetaDir, "tmp"))
+	if len(tmpFiles) > 0 {
+		t.Fatalf("the temporary files should be removed")
+	}
+
+	// truncate the file
+	err = os.WriteFile(path.Join(root, name), []byte("export def"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.ReadFile(name); err != ErrCorrupted {
+		t.Fatalf("should be corrupted error, but %v", err)
+	}
+	if found, _, _ := fs.Exists(name); found {
+		t.Fatalf("%s should be quarantined", name)
+	}
+	quarantined, _ := ioutil.ReadDir(path.Join(root, localFSMetaDir, "quarantine", path.Dir(name)))
+	if len(quarantined) != 1 {
+		t.Fatalf("%s should be moved to the quarantine dir", name)
+	}
+
+	// rebuild
+	err = fs.WriteData(name, []byte("export default React"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Hash != sha256Hex([]byte("export default React")) {
+		t.Fatalf("unexpected hash %s", info.Hash)
+	}
+}
+
+func TestLocalLRUFS(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-local-lru")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("localLRU:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, fs)
+}
+
+func TestS3FS(t *testing.T) {
+	fs := &s3FSLayer{s3Client: &fakeS3Client{objects: map[string]*fakeS3Object{}}}
+	testFS(t, fs)
+
+	// the object that was written without the hash metadata
+	client := fs.s3Client.(*fakeS3Client)
+	client.objects["legacy.js"] = &fakeS3Object{data: []byte("legacy"), modtime: time.Now()}
+	info, err := fs.Stat("legacy.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 6 || info.Hash != "" {
+		t.Fatalf("unexpected stat %v", info)
+	}
+
+	// the content that can't be read twice is streamed without the hash
+	written, err := fs.WriteFile("stream.js", io.MultiReader(strings.NewReader("export "), strings.NewReader("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = fs.Stat("stream.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 9 || info.Size != 9 || info.Hash != "" {
+		t.Fatalf("unexpected stat %v of %d bytes", info, written)
+	}
+}
+
+func TestDedupFS(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-dedup")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	localFS, err := OpenFS("local:" + path.Join(root, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB("bolt:" + path.Join(root, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fs := NewDedupFS(localFS, db)
+	testFS(t, fs)
+
+	// the identical files share a blob
+	content := []byte("export default React")
+	names := []string{"builds/v53/react@17.0.2/es2020/react.js", "builds/v53/react@17.0.2/X-ZHJl/es2020/react.js"}
+	for _, name := range names {
+		err = fs.WriteData(name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobPath := dedupBlobPath(sha256Hex(content))
+	blobs, err := localFS.List(dedupBlobsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !includesPath(blobs, blobPath) {
+		t.Fatalf("missing blob %s in %v", blobPath, blobs)
+	}
+	for _, name := range names {
+		r, err := fs.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(data, content) {
+			t.Fatalf("unexpected content of %s: %s", name, data)
+		}
+	}
+
+	// the blob is deleted with the last reference
+	err = fs.WriteData(names[0], []byte("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _, _ := localFS.Exists(blobPath); !found {
+		t.Fatal("the blob is still referenced")
+	}
+	err = fs.Delete(names[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _, _ := localFS.Exists(blobPath); found {
+		t.Fatal("the blob should be deleted")
+	}
+
+	// the orphan blobs are collected, the referenced blobs are kept
+	err = localFS.WriteData(blobPath, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, n, err := fs.(OrphanCollector).CollectOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 || n != int64(len(content)) {
+		t.Fatalf("unexpected orphans %d (%d bytes)", files, n)
+	}
+	if found, _, _ := localFS.Exists(blobPath); found {
+		t.Fatal("the orphan blob should be deleted")
+	}
+	if r, err := fs.ReadFile(names[0]); err != nil {
+		t.Fatal(err)
+	} else {
+		r.Close()
+	}
+
+	// the file that was written before the layer is enabled
+	err = localFS.WriteData("raw/react@17.0.2/index.js", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _, _ := fs.Exists("raw/react@17.0.2/index.js"); !found {
+		t.Fatal("the legacy file should be found")
+	}
+	paths, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{
+		"builds/v53/react-dom@17.0.2/es2020/dom.js",
+		names[0],
+		"raw/react@17.0.2/index.js",
+		"raw/react@17.0.2/package.json",
+	}) {
+		t.Fatalf("unexpected list %v", paths)
+	}
+}
+
+func includesPath(paths []string, name string) bool {
+	for _, p := range paths {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMemoryFS(t *testing.T) {
+	fs, err := OpenFS("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, fs)
+}
+
+func TestTieredFS(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-tiered")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("tiered:?tier=memory:&tier=local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFS(t, fs)
+
+	tiered := fs.(*tieredFSLayer)
+	hot, cold := tiered.tiers[0].fs, tiered.tiers[1].fs
+
+	// read-through promotion
+	name := "builds/v53/vue@3.2.0/es2020/vue.js"
+	err = cold.WriteData(name, []byte("export default Vue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := fs.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "export default Vue" {
+		t.Fatalf("unexpected content '%s'", data)
+	}
+	if found, _, _ := hot.Exists(name); !found {
+		t.Fatalf("%s should be promoted", name)
+	}
+}
+
+func TestTieredFSWriteBack(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-tiered-write-back")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("tiered:?tier=memory:&tier=local:" + root + "&write=back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold := fs.(*tieredFSLayer).tiers[1].fs
+
+	name := "builds/v53/vue@3.2.0/es2020/vue.js"
+	err = fs.WriteData(name, []byte("export default Vue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if found, _, _ := cold.Exists(name); found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s should be written back", name)
+}
+
+// failingFS fails the writes until the fails are used up
+type failingFS struct {
+	FS
+	fails int32
+}
+
+func (fs *failingFS) WriteData(name string, data []byte) error {
+	if atomic.AddInt32(&fs.fails, -1) >= 0 {
+		return errors.New("unavailable")
+	}
+	return fs.FS.WriteData(name, data)
+}
+
+func TestTieredFSWriteBackRetry(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-tiered-write-back-retry")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	defer func(backoff time.Duration) { tieredWriteBackBackoff = backoff }(tieredWriteBackBackoff)
+	tieredWriteBackBackoff = 10 * time.Millisecond
+
+	fs, err := OpenFS("tiered:?tier=memory:%3FmaxSize%3D10B&tier=local:" + root + "&write=back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered := fs.(*tieredFSLayer)
+	cold := &failingFS{FS: tiered.tiers[1].fs, fails: 2}
+	tiered.tiers[1].fs = cold
+
+	// the failed file is retried, and it's not evicted before it's written back
+	name := "builds/v53/vue@3.2.0/es2020/vue.js"
+	err = fs.WriteData(name, []byte("export default Vue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		hot, _, _ := tiered.tiers[0].fs.Exists(name)
+		if found, _, _ := cold.Exists(name); found {
+			break
+		}
+		if !hot {
+			t.Fatal("the dirty file should not be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if found, _, _ := cold.Exists(name); !found {
+		t.Fatalf("%s should be written back after the retries", name)
+	}
+
+	// the queue is drained when the layer is closed
+	atomic.StoreInt32(&cold.fails, 1)
+	names := []string{"builds/v53/vue@3.2.0/es2020/a.js", "builds/v53/vue@3.2.0/es2020/b.js"}
+	for _, name := range names {
+		err = fs.WriteData(name, []byte("export {}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fs.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if found, _, _ := cold.Exists(name); !found {
+			t.Fatalf("%s should be written back when the layer is closed", name)
+		}
+	}
+
+	// the files that can't be written back are reported by the close
+	fs, err = OpenFS("tiered:?tier=memory:%3FmaxSize%3D10B&tier=local:" + root + "&write=back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered = fs.(*tieredFSLayer)
+	tiered.tiers[1].fs = &failingFS{FS: tiered.tiers[1].fs, fails: 100}
+	err = fs.WriteData("builds/v53/vue@3.2.0/es2020/c.js", []byte("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.(io.Closer).Close(); err == nil {
+		t.Fatal("the close should report the file that is not written back")
+	}
+}
+
+func TestTieredFSEviction(t *testing.T) {
+	root := path.Join(os.TempDir(), "esmd-testing-fs-tiered-eviction")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	fs, err := OpenFS("tiered:?tier=memory:%3FmaxSize%3D10B&tier=local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered := fs.(*tieredFSLayer)
+	if tiered.tiers[0].maxSize != 10 || tiered.tiers[1].maxSize != 0 {
+		t.Fatalf("unexpected tier sizes %d, %d", tiered.tiers[0].maxSize, tiered.tiers[1].maxSize)
+	}
+	hot := tiered.tiers[0].fs
+
+	for _, name := range []string{"a.js", "b.js", "c.js"} {
+		err = fs.WriteData(name, []byte("12345"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := hot.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"b.js", "c.js"}) {
+		t.Fatalf("unexpected hot tier files %v", paths)
+	}
+	paths, err = fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"a.js", "b.js", "c.js"}) {
+		t.Fatalf("unexpected files %v", paths)
+	}
+}
+
+func testFS(t *testing.T, fs FS) {
+	files := map[string]string{
+		"builds/v53/react@17.0.2/es2020/react.js":   "export default React",
+		"builds/v53/react-dom@17.0.2/es2020/dom.js": "export default ReactDOM",
+		"raw/react@17.0.2/package.json":             `{"name":"react"}`,
+	}
+	for name, content := range files {
+		var err error
+		if strings.HasPrefix(name, "raw/") {
+			_, err = fs.WriteFile(name, strings.NewReader(content))
+		} else {
+			err = fs.WriteData(name, []byte(content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, expected := range map[string][]string{
+		"builds/v53/react@":          {"builds/v53/react@17.0.2/es2020/react.js"},
+		"builds/v53/react":           {"builds/v53/react-dom@17.0.2/es2020/dom.js", "builds/v53/react@17.0.2/es2020/react.js"},
+		"raw/react@17.0.2/":          {"raw/react@17.0.2/package.json"},
+		"types/v53/react@17.0.2/":    nil,
+		"builds/v53/react@17.0.2/es": {"builds/v53/react@17.0.2/es2020/react.js"},
+	} {
+		paths, err := fs.List(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("unexpected list of '%s': %v", prefix, paths)
+		}
+	}
+
+	// the walk stops when the fn returns false
+	var walked []string
+	err := Walk(fs, "builds/", func(name string) bool {
+		walked = append(walked, name)
+		return len(walked) < 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || !strings.HasPrefix(walked[0], "builds/v53/react") {
+		t.Fatalf("unexpected walk %v", walked)
+	}
+
+	name := "builds/v53/react@17.0.2/es2020/react.js"
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(files[name])) || info.Hash != sha256Hex([]byte(files[name])) || info.Modtime.IsZero() {
+		t.Fatalf("unexpected stat %v", info)
+	}
+
+	err = fs.Delete(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _, _ := fs.Exists(name); found {
+		t.Fatalf("%s should be deleted", name)
+	}
+	if _, err = fs.Stat(name); err != ErrNotFound {
+		t.Fatalf("should be not found error, but %v", err)
+	}
+	// delete a missing file
+	if err = fs.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type fakeS3Object struct {
+	data     []byte
+	metadata map[string]*string
+	modtime  time.Time
+}
+
+// fakeS3Client is an in-memory `SimpleS3Client`
+type fakeS3Client struct {
+	lock    sync.Mutex
+	objects map[string]*fakeS3Object
+}
+
+func (c *fakeS3Client) get(key string) (*fakeS3Object, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	object, ok := c.objects[key]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return object, nil
+}
+
+func (c *fakeS3Client) Head(key *string) (*s3.HeadObjectOutput, error) {
+	object, err := c.get(*key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.data))),
+		LastModified:  aws.Time(object.modtime),
+		Metadata:      object.metadata,
+	}, nil
+}
+
+func (c *fakeS3Client) Get(key *string) (*s3.GetObjectOutput, error) {
+	object, err := c.get(*key)
+	if err != nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(object.data)),
+		ContentLength: aws.Int64(int64(len(object.data))),
+		LastModified:  aws.Time(object.modtime),
+		Metadata:      object.metadata,
+	}, nil
+}
+
+func (c *fakeS3Client) Put(key *string, body io.Reader, metadata map[string]*string) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.objects[*key] = &fakeS3Object{data: data, metadata: metadata, modtime: time.Now()}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *fakeS3Client) List(prefix *string, fn func(key string, size int64) bool) error {
+	c.lock.Lock()
+	sizes := map[string]int64{}
+	var keys []string
+	for key, object := range c.objects {
+		if strings.HasPrefix(key, *prefix) {
+			keys = append(keys, key)
+			sizes[key] = int64(len(object.data))
+		}
+	}
+	c.lock.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, sizes[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *fakeS3Client) Delete(key *string) (*s3.DeleteObjectOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.objects, *key)
+	return &s3.DeleteObjectOutput{}, nil
+}
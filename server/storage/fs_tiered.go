@@ -0,0 +1,478 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// the size of the write-back queue
+const tieredWriteBackQueueSize = 1024
+
+// the backoff of the failed write-backs, it's doubled by each retry up to the max
+var (
+	tieredWriteBackBackoff    = time.Second
+	tieredWriteBackMaxBackoff = time.Minute
+)
+
+type tieredFS struct{}
+
+// Open opens the tiers of the `tier` options in order, the hot tier first and the
+// persistent tier last, e.g.
+//
+//	tiered:?tier=memory:&tier=local:/var/cache/esmd%3FmaxSize%3D10GB&tier=s3:bucket&write=back
+//
+// The `maxSize` option of a tier url limits the size of the tier, the least recently
+// used files are evicted from it. The last tier is never limited.
+func (fs *tieredFS) Open(root string, options url.Values) (FS, error) {
+	urls := options["tier"]
+	if len(urls) == 0 {
+		return nil, errors.New("missing tiers")
+	}
+	writeBack := false
+	switch options.Get("write") {
+	case "", "through":
+	case "back":
+		writeBack = true
+	default:
+		return nil, errors.New("invalid write value")
+	}
+
+	layer := &tieredFSLayer{}
+	for i, tierUrl := range urls {
+		tierFS, err := OpenFS(tierUrl)
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: %v", i, err)
+		}
+		_, addr := utils.SplitByFirstByte(tierUrl, ':')
+		_, tierOptions, err := parseConfigUrl(addr)
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: %v", i, err)
+		}
+		maxSize, err := parseBytesValue(tierOptions.Get("maxSize"), 0)
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: invalid maxSize value", i)
+		}
+		if i == len(urls)-1 {
+			maxSize = 0
+		}
+		layer.tiers = append(layer.tiers, newFSTier(tierFS, maxSize))
+	}
+	for _, tier := range layer.tiers {
+		if tier.maxSize > 0 {
+			go tier.hydrate()
+		}
+	}
+	if writeBack && len(layer.tiers) > 1 {
+		layer.writeBackQueue = make(chan string, tieredWriteBackQueueSize)
+		layer.writeBackDone = make(chan struct{})
+		go layer.writeBack()
+	}
+	return layer, nil
+}
+
+// tieredFSLayer reads the files from the first tier that has them and promotes them to
+// the upper tiers. The files are written to all tiers (write-through), or to the first
+// tier and flushed to the lower tiers in background (write-back).
+type tieredFSLayer struct {
+	tiers          []*fsTier
+	lock           sync.RWMutex
+	closed         bool
+	writeBackQueue chan string
+	writeBackDone  chan struct{}
+	// the files that are not written back when the layer is closed
+	writeBackLost int
+}
+
+func (fs *tieredFSLayer) Exists(name string) (bool, time.Time, error) {
+	var lastErr error
+	for _, tier := range fs.tiers {
+		found, modtime, err := tier.fs.Exists(name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if found {
+			return true, modtime, nil
+		}
+	}
+	return false, time.Time{}, lastErr
+}
+
+func (fs *tieredFSLayer) ReadFile(name string) (io.ReadSeekCloser, error) {
+	var lastErr error = ErrNotFound
+	for i, tier := range fs.tiers {
+		if found, _, err := tier.fs.Exists(name); err != nil || !found {
+			if err != nil {
+				lastErr = err
+			}
+			continue
+		}
+		r, err := tier.fs.ReadFile(name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tier.touch(name)
+		if i == 0 {
+			return r, nil
+		}
+
+		// promote the file to the upper tiers
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, upper := range fs.tiers[:i] {
+			if upper.fs.WriteData(name, data) == nil {
+				upper.add(name, int64(len(data)), false)
+			}
+		}
+		return &readSeekNopCloser{bytes.NewReader(data)}, nil
+	}
+	return nil, lastErr
+}
+
+func (fs *tieredFSLayer) WriteFile(name string, content io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), fs.WriteData(name, data)
+}
+
+func (fs *tieredFSLayer) WriteData(name string, data []byte) error {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	// the files are written through after the layer is closed
+	if fs.writeBackQueue != nil && !fs.closed {
+		top := fs.tiers[0]
+		err := top.fs.WriteData(name, data)
+		if err != nil {
+			return err
+		}
+		top.add(name, int64(len(data)), true)
+		fs.writeBackQueue <- name
+		return nil
+	}
+
+	// write the persistent tier first
+	for i := len(fs.tiers) - 1; i >= 0; i-- {
+		tier := fs.tiers[i]
+		err := tier.fs.WriteData(name, data)
+		if err != nil {
+			if i == len(fs.tiers)-1 {
+				return err
+			}
+			continue
+		}
+		tier.add(name, int64(len(data)), false)
+	}
+	return nil
+}
+
+type tieredWriteBackRetry struct {
+	retries int
+	at      time.Time
+}
+
+// writeBack flushes the files of the first tier to the lower tiers, the failed files are
+// retried with the backoff and stay dirty in the first tier until they are flushed. The
+// queue is drained when the layer is closed.
+func (fs *tieredFSLayer) writeBack() {
+	defer close(fs.writeBackDone)
+
+	failed := map[string]*tieredWriteBackRetry{}
+	retry := func(name string, err error) {
+		r, ok := failed[name]
+		if !ok {
+			r = &tieredWriteBackRetry{}
+			failed[name] = r
+		}
+		backoff := tieredWriteBackBackoff << r.retries
+		if backoff <= 0 || backoff > tieredWriteBackMaxBackoff {
+			backoff = tieredWriteBackMaxBackoff
+		} else {
+			r.retries++
+		}
+		r.at = time.Now().Add(backoff)
+		log.Errorf("tiered: write back %s: %v, retry in %v", name, err, backoff)
+	}
+	for {
+		var timer <-chan time.Time
+		if len(failed) > 0 {
+			var next time.Time
+			for _, r := range failed {
+				if next.IsZero() || r.at.Before(next) {
+					next = r.at
+				}
+			}
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case name, ok := <-fs.writeBackQueue:
+			if !ok {
+				// try the failed files once more before the exit
+				for name := range failed {
+					if err := fs.flush(name); err != nil {
+						log.Errorf("tiered: write back %s: %v, the file is not persisted", name, err)
+						fs.writeBackLost++
+					}
+				}
+				return
+			}
+			if err := fs.flush(name); err != nil {
+				retry(name, err)
+			} else {
+				delete(failed, name)
+			}
+		case <-timer:
+			now := time.Now()
+			for name, r := range failed {
+				if r.at.After(now) {
+					continue
+				}
+				if err := fs.flush(name); err != nil {
+					retry(name, err)
+				} else {
+					delete(failed, name)
+				}
+			}
+		}
+	}
+}
+
+// flush writes the file of the first tier to the lower tiers, the persistent tier first
+func (fs *tieredFSLayer) flush(name string) error {
+	top := fs.tiers[0]
+	r, err := top.fs.ReadFile(name)
+	if err != nil {
+		// deleted or evicted after it's written back
+		return nil
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	for i := len(fs.tiers) - 1; i > 0; i-- {
+		tier := fs.tiers[i]
+		err = tier.fs.WriteData(name, data)
+		if err != nil {
+			return err
+		}
+		tier.add(name, int64(len(data)), false)
+	}
+	top.clean(name)
+	return nil
+}
+
+// Close flushes the files that are not written back yet, it returns an error if some of
+// them failed. The files are written through after it's closed.
+func (fs *tieredFSLayer) Close() error {
+	fs.lock.Lock()
+	if fs.closed || fs.writeBackQueue == nil {
+		fs.closed = true
+		fs.lock.Unlock()
+		return nil
+	}
+	fs.closed = true
+	close(fs.writeBackQueue)
+	fs.lock.Unlock()
+	<-fs.writeBackDone
+	if fs.writeBackLost > 0 {
+		return fmt.Errorf("tiered: %d files are not written back", fs.writeBackLost)
+	}
+	return nil
+}
+
+func (fs *tieredFSLayer) List(prefix string) ([]string, error) {
+	set := map[string]struct{}{}
+	for _, tier := range fs.tiers {
+		paths, err := tier.fs.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range paths {
+			set[name] = struct{}{}
+		}
+	}
+	var paths []string
+	for name := range set {
+		paths = append(paths, name)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (fs *tieredFSLayer) Delete(name string) error {
+	for _, tier := range fs.tiers {
+		tier.remove(name)
+		err := tier.fs.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *tieredFSLayer) Stat(name string) (*FileInfo, error) {
+	for _, tier := range fs.tiers {
+		info, err := tier.fs.Stat(name)
+		if err == nil {
+			return info, nil
+		}
+		if err != ErrNotFound {
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type fsTierEntry struct {
+	name  string
+	size  int64
+	dirty bool
+}
+
+// fsTier tracks the size of a tier with the LRU list, the dirty files that are not
+// written back yet are not evicted.
+type fsTier struct {
+	fs      FS
+	maxSize int64
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newFSTier(fs FS, maxSize int64) *fsTier {
+	return &fsTier{
+		fs:      fs,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// hydrate tracks the files that are in the tier already, the sizes are listed by the
+// `Walker` tiers like `local`, the other tiers are stated file by file.
+func (t *fsTier) hydrate() {
+	track := func(name string, size int64) {
+		t.lock.Lock()
+		if _, ok := t.entries[name]; !ok {
+			t.size += size
+			t.entries[name] = t.lru.PushBack(&fsTierEntry{name: name, size: size})
+		}
+		t.lock.Unlock()
+	}
+	var err error
+	if w, ok := t.fs.(Walker); ok {
+		err = w.Walk("", func(name string, size int64) bool {
+			track(name, size)
+			return true
+		})
+	} else {
+		err = Walk(t.fs, "", func(name string) bool {
+			if info, err := t.fs.Stat(name); err == nil {
+				track(name, info.Size)
+			}
+			return true
+		})
+	}
+	if err != nil {
+		log.Errorf("tiered: hydrate: %v", err)
+	}
+	t.evict()
+}
+
+func (t *fsTier) add(name string, size int64, dirty bool) {
+	if t.maxSize <= 0 {
+		return
+	}
+	t.lock.Lock()
+	if e, ok := t.entries[name]; ok {
+		entry := e.Value.(*fsTierEntry)
+		t.size += size - entry.size
+		entry.size = size
+		entry.dirty = entry.dirty || dirty
+		t.lru.MoveToFront(e)
+	} else {
+		t.size += size
+		t.entries[name] = t.lru.PushFront(&fsTierEntry{name: name, size: size, dirty: dirty})
+	}
+	t.lock.Unlock()
+	t.evict()
+}
+
+func (t *fsTier) touch(name string) {
+	if t.maxSize <= 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e, ok := t.entries[name]; ok {
+		t.lru.MoveToFront(e)
+	}
+}
+
+func (t *fsTier) clean(name string) {
+	if t.maxSize <= 0 {
+		return
+	}
+	t.lock.Lock()
+	if e, ok := t.entries[name]; ok {
+		e.Value.(*fsTierEntry).dirty = false
+	}
+	t.lock.Unlock()
+	t.evict()
+}
+
+func (t *fsTier) remove(name string) {
+	if t.maxSize <= 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if e, ok := t.entries[name]; ok {
+		t.size -= e.Value.(*fsTierEntry).size
+		t.lru.Remove(e)
+		delete(t.entries, name)
+	}
+}
+
+// evict removes the least recently used clean files until the size is under the limit
+func (t *fsTier) evict() {
+	var evicted []string
+	t.lock.Lock()
+	for e := t.lru.Back(); e != nil && t.size > t.maxSize; {
+		prev := e.Prev()
+		entry := e.Value.(*fsTierEntry)
+		if !entry.dirty {
+			t.size -= entry.size
+			t.lru.Remove(e)
+			delete(t.entries, entry.name)
+			evicted = append(evicted, entry.name)
+		}
+		e = prev
+	}
+	t.lock.Unlock()
+	for _, name := range evicted {
+		t.fs.Delete(name)
+	}
+}
+
+func init() {
+	RegisterFS("tiered", &tieredFS{})
+}
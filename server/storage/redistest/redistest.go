@@ -0,0 +1,395 @@
+// Package redistest provides an in-process redis server for the tests, it supports
+// the commands used by the redis cache and db drivers.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type item struct {
+	value     string
+	expiresAt time.Time
+}
+
+// Server is a fake redis server listening on a local address
+type Server struct {
+	Addr     string
+	password string
+	listener net.Listener
+	conns    int32
+	lock     sync.Mutex
+	items    map[string]item
+	zsets    map[string]map[string]struct{}
+	versions map[string]int64
+	open     []net.Conn
+}
+
+// NewServer starts a server, the clients must send the `AUTH` command if the password is not empty
+func NewServer(password string) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     l.Addr().String(),
+		password: password,
+		listener: l,
+		items:    map[string]item{},
+		zsets:    map[string]map[string]struct{}{},
+		versions: map[string]int64{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			s.lock.Lock()
+			s.open = append(s.open, conn)
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+// Conns returns the number of the accepted connections
+func (s *Server) Conns() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+// Close stops the server and closes the open connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.CloseConns()
+}
+
+// CloseConns closes the open connections like a redis server closing the idle clients
+func (s *Server) CloseConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.open {
+		conn.Close()
+	}
+	s.open = nil
+}
+
+// session is the state of a connection
+type session struct {
+	authed  bool
+	watched map[string]int64
+	multi   bool
+	queued  [][]string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ss := &session{authed: s.password == ""}
+	for {
+		args, err := readCommand(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		s.lock.Lock()
+		reply := s.handle(ss, args)
+		s.lock.Unlock()
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle runs a command of the session with the lock held
+func (s *Server) handle(ss *session, args []string) string {
+	cmd := strings.ToUpper(args[0])
+	if !ss.authed && cmd != "AUTH" {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	switch cmd {
+	case "AUTH":
+		if len(args) != 2 || args[1] != s.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		ss.authed = true
+		return "+OK\r\n"
+	case "WATCH":
+		if ss.multi {
+			return "-ERR WATCH inside MULTI is not allowed\r\n"
+		}
+		if ss.watched == nil {
+			ss.watched = map[string]int64{}
+		}
+		for _, key := range args[1:] {
+			ss.watched[key] = s.versions[key]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		ss.watched = nil
+		return "+OK\r\n"
+	case "MULTI":
+		if ss.multi {
+			return "-ERR MULTI calls can not be nested\r\n"
+		}
+		ss.multi = true
+		ss.queued = nil
+		return "+OK\r\n"
+	case "DISCARD":
+		if !ss.multi {
+			return "-ERR DISCARD without MULTI\r\n"
+		}
+		ss.multi = false
+		ss.queued = nil
+		ss.watched = nil
+		return "+OK\r\n"
+	case "EXEC":
+		if !ss.multi {
+			return "-ERR EXEC without MULTI\r\n"
+		}
+		queued, watched := ss.queued, ss.watched
+		ss.multi = false
+		ss.queued = nil
+		ss.watched = nil
+		for key, version := range watched {
+			if s.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+		replies := make([]string, len(queued))
+		for i, args := range queued {
+			replies[i] = s.exec(args)
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(replies), strings.Join(replies, ""))
+	}
+	if ss.multi {
+		ss.queued = append(ss.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return s.exec(args)
+}
+
+// exec runs a data command with the lock held
+func (s *Server) exec(args []string) string {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		if len(args) < 3 {
+			return "-ERR wrong number of arguments for 'set' command\r\n"
+		}
+		it := item{value: args[2]}
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				if i+1 < len(args) {
+					ms, _ := strconv.Atoi(args[i+1])
+					it.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					i++
+				}
+			}
+		}
+		if _, ok := s.get(args[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		s.items[args[1]] = it
+		s.versions[args[1]]++
+		return "+OK\r\n"
+	case "GET":
+		if it, ok := s.get(args[1]); ok {
+			return bulk(it.value)
+		}
+		return "$-1\r\n"
+	case "MGET":
+		replies := make([]string, len(args)-1)
+		for i, key := range args[1:] {
+			if it, ok := s.get(key); ok {
+				replies[i] = bulk(it.value)
+			} else {
+				replies[i] = "$-1\r\n"
+			}
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(replies), strings.Join(replies, ""))
+	case "EXISTS":
+		if _, ok := s.get(args[1]); ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			_, ok := s.get(key)
+			_, isZset := s.zsets[key]
+			if ok || isZset {
+				n++
+				s.versions[key]++
+			}
+			delete(s.items, key)
+			delete(s.zsets, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "FLUSHDB":
+		for key := range s.items {
+			s.versions[key]++
+		}
+		for key := range s.zsets {
+			s.versions[key]++
+		}
+		s.items = map[string]item{}
+		s.zsets = map[string]map[string]struct{}{}
+		return "+OK\r\n"
+	case "ZADD":
+		// all the members have the same score, so they are sorted in lexicographical order
+		set, ok := s.zsets[args[1]]
+		if !ok {
+			set = map[string]struct{}{}
+			s.zsets[args[1]] = set
+		}
+		n := 0
+		for i := 3; i < len(args); i += 2 {
+			if _, ok := set[args[i]]; !ok {
+				set[args[i]] = struct{}{}
+				n++
+			}
+		}
+		s.versions[args[1]]++
+		return fmt.Sprintf(":%d\r\n", n)
+	case "ZREM":
+		set := s.zsets[args[1]]
+		n := 0
+		for _, member := range args[2:] {
+			if _, ok := set[member]; ok {
+				delete(set, member)
+				n++
+			}
+		}
+		if n > 0 {
+			s.versions[args[1]]++
+		}
+		if set != nil && len(set) == 0 {
+			delete(s.zsets, args[1])
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "ZRANGEBYLEX":
+		if len(args) != 4 && len(args) != 7 {
+			return "-ERR syntax error\r\n"
+		}
+		offset, count := 0, -1
+		if len(args) == 7 {
+			offset, _ = strconv.Atoi(args[5])
+			count, _ = strconv.Atoi(args[6])
+		}
+		members := []string{}
+		for member := range s.zsets[args[1]] {
+			if lexAbove(member, args[2]) && lexBelow(member, args[3]) {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		if offset < len(members) {
+			members = members[offset:]
+		} else {
+			members = nil
+		}
+		if count >= 0 && count < len(members) {
+			members = members[:count]
+		}
+		replies := make([]string, len(members))
+		for i, member := range members {
+			replies[i] = bulk(member)
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(replies), strings.Join(replies, ""))
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+func (s *Server) get(key string) (item, bool) {
+	it, ok := s.items[key]
+	if ok && !it.expiresAt.IsZero() && time.Now().After(it.expiresAt) {
+		delete(s.items, key)
+		return it, false
+	}
+	return it, ok
+}
+
+func lexAbove(member string, min string) bool {
+	switch {
+	case min == "-":
+		return true
+	case strings.HasPrefix(min, "["):
+		return member >= min[1:]
+	case strings.HasPrefix(min, "("):
+		return member > min[1:]
+	}
+	return false
+}
+
+func lexBelow(member string, max string) bool {
+	switch {
+	case max == "+":
+		return true
+	case strings.HasPrefix(max, "["):
+		return member <= max[1:]
+	case strings.HasPrefix(max, "("):
+		return member < max[1:]
+	}
+	return false
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+// readCommand reads a command that is sent as an array of the bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readHeader(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func readHeader(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 4 || line[0] != prefix || !strings.HasSuffix(line, "\r\n") {
+		return 0, errors.New("bad request")
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || n < 0 {
+		return 0, errors.New("bad request")
+	}
+	return n, nil
+}
@@ -18,6 +18,8 @@ var (
 	ErrExpired  = errors.New("record is expired")
 	ErrNotFound = errors.New("record not found")
 	ErrIO       = errors.New("io error")
+	// ErrCorrupted is returned when the file doesn't match its checksum, the file is quarantined
+	ErrCorrupted = errors.New("file is corrupted")
 )
 
 func SetLogger(logger *logx.Logger) {
@@ -39,6 +41,42 @@ func parseConfigUrl(configUrl string) (root string, options url.Values, err erro
 	return root, options, nil
 }
 
+// the options of the config urls that are masked in the logs
+var secretOptions = map[string]bool{
+	"password":        true,
+	"secretAccessKey": true,
+	"sessionToken":    true,
+}
+
+// the options of the config urls that are the nested config urls
+var nestedUrlOptions = map[string]bool{
+	"tier":      true,
+	"backingFS": true,
+}
+
+// RedactConfigUrl masks the secret options of the config url and its nested urls, e.g. the
+// password of redis or the secret key of s3, so the url can be logged.
+func RedactConfigUrl(configUrl string) string {
+	root, query := utils.SplitByFirstByte(configUrl, '?')
+	if query == "" {
+		return configUrl
+	}
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return root + "?redacted"
+	}
+	for key, values := range options {
+		for i, value := range values {
+			if secretOptions[key] {
+				values[i] = "redacted"
+			} else if nestedUrlOptions[key] {
+				values[i] = RedactConfigUrl(value)
+			}
+		}
+	}
+	return root + "?" + options.Encode()
+}
+
 func parseBytesValue(str string, defaultValue int64) (int64, error) {
 	if str != "" {
 		return utils.ParseBytes(str)
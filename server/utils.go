@@ -4,11 +4,9 @@ import (
 	"encoding/base64"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/ije/gox/utils"
 	"github.com/ije/gox/valid"
 )
 
@@ -63,37 +61,6 @@ func (s *stringSet) Values() []string {
 	return a
 }
 
-// sortable version slice
-type versionSlice []string
-
-func (s versionSlice) Len() int      { return len(s) }
-func (s versionSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s versionSlice) Less(i, j int) bool {
-	avs, aStage := utils.SplitByFirstByte(s[i], '-')
-	bvs, bStage := utils.SplitByFirstByte(s[j], '-')
-	av := strings.Split(avs, ".")
-	bv := strings.Split(bvs, ".")
-	if len(av) != 3 || len(bv) != 3 {
-		return avs > bvs
-	}
-	if av[0] == bv[0] {
-		if av[1] == bv[1] {
-			if av[2] == bv[2] {
-				return aStage > bStage
-			}
-			a2, _ := strconv.Atoi(av[2])
-			b2, _ := strconv.Atoi(bv[2])
-			return a2 > b2
-		}
-		a1, _ := strconv.Atoi(av[1])
-		b1, _ := strconv.Atoi(bv[1])
-		return a1 > b1
-	}
-	a0, _ := strconv.Atoi(av[0])
-	b0, _ := strconv.Atoi(bv[0])
-	return a0 > b0
-}
-
 func identify(importPath string) string {
 	p := []byte(importPath)
 	for i, c := range p {
@@ -133,6 +100,15 @@ func endsWith(s string, suffixs ...string) bool {
 	return false
 }
 
+func includes(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func dirExists(filepath string) bool {
 	fi, err := os.Lstat(filepath)
 	return err == nil && fi.IsDir()
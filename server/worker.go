@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// runWorker claims the tasks of the shared queue and builds them with the local build
+// queue, it returns when the ctx is done.
+func runWorker(ctx context.Context, shared SharedQueue, concurrency int) {
+	worker := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	log.Infof("worker %s started with %d processes", worker, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if claimAndBuild(ctx, shared, worker) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(sharedQueuePollInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// claimAndBuild builds a task of the shared queue, the lease of the task is renewed
+// during the build. It returns false if no tasks are claimed.
+func claimAndBuild(ctx context.Context, shared SharedQueue, worker string) bool {
+	st, err := shared.Claim(worker, abandonedTimeout)
+	if err != nil {
+		log.Errorf("claim shared task: %v", err)
+		return false
+	}
+	if st == nil {
+		return false
+	}
+
+	task := st.Task.buildTask()
+	c := buildQueue.Add(task, st.Priority)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case output := <-c.C:
+			err = shared.Complete(st.ID, worker, output.err)
+			if err != nil {
+				log.Errorf("complete shared task %s: %v", st.ID, err)
+			}
+			return true
+		case <-ticker.C:
+			err = shared.Renew(st.ID, worker, abandonedTimeout)
+			if err == errLeaseLost {
+				// another worker took the task over
+				log.Warnf("shared task %s: %v", st.ID, err)
+				buildQueue.RemoveConsumer(task, c)
+				return true
+			} else if err != nil {
+				log.Errorf("renew shared task %s: %v", st.ID, err)
+			}
+		case <-ctx.Done():
+			// the task is claimed by another worker after the lease expired
+			buildQueue.RemoveConsumer(task, c)
+			return true
+		}
+	}
+}